@@ -12,6 +12,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/nzenitram/relay-esp/middleware"
 	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/utils"
 )
 
 type ESPController struct {
@@ -45,6 +47,19 @@ func (ec *ESPController) GetESPs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	espIDs := make([]int, len(esps))
+	for i, esp := range esps {
+		espIDs[i] = esp.ESPID
+	}
+	usage, err := models.GetESPSendUsage(ec.DB, espIDs, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range esps {
+		esps[i].Usage = usage[esps[i].ESPID]
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string][]models.ESP{"esps": esps})
 }
@@ -67,6 +82,12 @@ func (ec *ESPController) CreateESP(w http.ResponseWriter, r *http.Request) {
 	// Set the UserID to the authenticated user's ID
 	esp.UserID = authUser.ID
 
+	if err := esp.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	esp.Usage = nil
+
 	// Create the ESP
 	err = models.CreateESP(ec.DB, &esp)
 	if err != nil {
@@ -75,6 +96,7 @@ func (ec *ESPController) CreateESP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(esp.UpdatedAt))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(esp)
 }
@@ -107,15 +129,195 @@ func (ec *ESPController) UpdateESP(w http.ResponseWriter, r *http.Request) {
 	esp.ESPID = espID
 	esp.UserID = authUser.ID
 
+	existing, err := models.GetESPByID(ec.DB, espID)
+	if err != nil || existing.UserID != authUser.ID {
+		if err == nil || err == sql.ErrNoRows {
+			http.Error(w, "ESP not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Credentials are write-only, so omitted fields keep their stored
+	// values. Switching provider starts from an empty credential document.
+	if !strings.EqualFold(esp.ProviderName, existing.ProviderName) {
+		existing.Credentials = nil
+		existing.CredentialHints = nil
+	}
+	existing.MergeCredentials(esp.Credentials)
+	esp.Credentials = existing.Credentials
+	esp.CredentialHints = existing.CredentialHints
+	esp.WeightFactor = existing.WeightFactor
+
+	if err := esp.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	esp.Usage = nil
+
 	// Update the ESP
 	err = models.UpdateESP(ec.DB, &esp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if strings.Contains(err.Error(), "no ESP found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
 	// Return the updated ESP
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(esp.UpdatedAt))
+	json.NewEncoder(w).Encode(esp)
+}
+
+// providerInfo describes a supported provider to API clients
+type providerInfo struct {
+	Name             string                      `json:"name"`
+	EventTypes       []providers.EventType       `json:"event_types"`
+	CredentialFields []providers.CredentialField `json:"credential_fields"`
+}
+
+// GetProviders lists the supported providers with the credential document
+// each one expects on its ESPs
+func (ec *ESPController) GetProviders(w http.ResponseWriter, r *http.Request) {
+	infos := []providerInfo{}
+	for _, name := range providers.Names() {
+		adapter, _ := providers.Get(name)
+		infos = append(infos, providerInfo{
+			Name:             adapter.Name(),
+			EventTypes:       adapter.EventTypes(),
+			CredentialFields: adapter.CredentialFields(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]providerInfo{"providers": infos})
+}
+
+// PatchESP applies a JSON Merge Patch to one of the user's ESPs. Members of
+// the credentials object set a field, or remove it when null. An If-Match
+// header guards against overwriting concurrent changes.
+func (ec *ESPController) PatchESP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	espID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ESP ID", http.StatusBadRequest)
+		return
+	}
+
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	existing, err := models.GetESPByID(ec.DB, espID)
+	if err != nil || existing.UserID != authUser.ID {
+		if err == nil || err == sql.ErrNoRows {
+			http.Error(w, "ESP not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !checkIfMatch(w, r, existing.UpdatedAt) {
+		return
+	}
+
+	body, ok := readPatchBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Credentials are write-only, so their patch is applied to the stored
+	// document rather than the ESP's JSON representation
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		http.Error(w, "Merge patch must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	credsPatch, hasCredsPatch := patch["credentials"]
+	delete(patch, "credentials")
+	body, _ = json.Marshal(patch)
+
+	current, err := json.Marshal(existing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	merged, err := utils.MergePatch(current, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var esp models.ESP
+	if err := json.Unmarshal(merged, &esp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Identity and timestamps can't be patched
+	esp.ESPID = existing.ESPID
+	esp.UserID = existing.UserID
+	esp.CreatedAt = existing.CreatedAt
+	esp.UpdatedAt = existing.UpdatedAt
+	esp.Credentials = existing.Credentials
+	esp.CredentialHints = existing.CredentialHints
+	esp.WeightFactor = existing.WeightFactor
+
+	if !strings.EqualFold(esp.ProviderName, existing.ProviderName) {
+		esp.Credentials = nil
+		esp.CredentialHints = nil
+	}
+
+	if hasCredsPatch {
+		var fields map[string]*string
+		if err := json.Unmarshal(credsPatch, &fields); err != nil {
+			http.Error(w, "credentials must be an object of strings", http.StatusBadRequest)
+			return
+		}
+		if fields == nil {
+			esp.Credentials = nil
+			esp.CredentialHints = nil
+		}
+		for name, value := range fields {
+			if value == nil {
+				esp.RemoveCredential(name)
+			} else {
+				esp.MergeCredentials(providers.Credentials{name: *value})
+			}
+		}
+	}
+	if esp.Credentials == nil {
+		esp.Credentials = providers.Credentials{}
+	}
+	if esp.CredentialHints == nil {
+		esp.CredentialHints = map[string]models.CredentialHint{}
+	}
+
+	if err := esp.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	esp.Usage = nil
+
+	err = models.UpdateESPIfUnmodified(ec.DB, &esp, existing.UpdatedAt)
+	if err == models.ErrModified {
+		http.Error(w, "Precondition failed: the resource has been modified", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(esp.UpdatedAt))
 	json.NewEncoder(w).Encode(esp)
 }
 
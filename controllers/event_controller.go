@@ -13,6 +13,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/nzenitram/relay-esp/middleware"
 	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
 )
 
 type EventController struct {
@@ -72,43 +73,16 @@ func (ec *EventController) GetEventsByType(w http.ResponseWriter, r *http.Reques
 		bucketSize = "1 hour" // Default bucket size
 	}
 
-	// Construct the SQL query based on the event type
-	var query string
-	switch eventType {
-	case "processed":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM processed_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	case "delivered":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM delivered_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	case "bounce":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM bounce_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	case "deferred":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM deferred_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	case "open":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM open_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	case "dropped":
-		query = `SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
-                 FROM dropped_events
-                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
-                 GROUP BY 1, 2 ORDER BY 1, 2`
-	default:
+	// Look up the time-series table for the event type
+	tableName, ok := models.EventTable(eventType)
+	if !ok || !providers.IsValidEventType(eventType) {
 		http.Error(w, "Invalid event type", http.StatusBadRequest)
 		return
 	}
+	query := fmt.Sprintf(`SELECT time_bucket($1, time) AS time, provider, COUNT(DISTINCT message_id) AS count
+                 FROM %s
+                 WHERE time BETWEEN $2 AND $3 AND user_id = $4
+                 GROUP BY 1, 2 ORDER BY 1, 2`, tableName)
 
 	// Execute the query
 	rows, err := ec.DB.Query(query, bucketSize, startTime, endTime, authUser.ID)
@@ -140,12 +114,37 @@ func (ec *EventController) GetEventsByType(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(results)
 }
 
-func (ec *EventController) GetAvailableEventTypes(w http.ResponseWriter, r *http.Request) {
-	eventTypes, err := models.GetAvailableEventTypes(ec.DB)
+func (ec *EventController) GetMessageTimeline(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageID := mux.Vars(r)["message_id"]
+
+	events, err := models.GetMessageTimeline(ec.DB, authUser.ID, messageID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(events) == 0 {
+		http.Error(w, "No events found for message", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_id": messageID,
+		"events":     events,
+	})
+}
+
+func (ec *EventController) GetAvailableEventTypes(w http.ResponseWriter, r *http.Request) {
+	eventTypes := []string{}
+	for _, t := range providers.EventTypes() {
+		eventTypes = append(eventTypes, string(t))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string][]string{"event_types": eventTypes})
@@ -202,13 +201,8 @@ func (ec *EventController) GetAvailableEventTypes(w http.ResponseWriter, r *http
 
 // Helper functions to validate input
 func isValidProvider(provider string) bool {
-	validProviders := []string{"sendgrid", "postmark", "sparkpost", "socketlabs"} // Add all valid providers
-	for _, p := range validProviders {
-		if p == provider {
-			return true
-		}
-	}
-	return false
+	_, ok := providers.Get(provider)
+	return ok
 }
 
 func (ec *ESPController) GetProviderEventStats(w http.ResponseWriter, r *http.Request) {
@@ -224,6 +218,10 @@ func (ec *ESPController) GetProviderEventStats(w http.ResponseWriter, r *http.Re
 		http.Error(w, "Provider name is required", http.StatusBadRequest)
 		return
 	}
+	if !isValidProvider(providerName) {
+		http.Error(w, "Invalid provider", http.StatusBadRequest)
+		return
+	}
 
 	eventType := r.URL.Query().Get("event_type")
 	if eventType == "" {
@@ -235,6 +233,101 @@ func (ec *ESPController) GetProviderEventStats(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	startTime, endTime, timeBucket, ok := parseStatsWindow(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := models.GetProviderEventStatsByType(ec.DB, authUser.ID, providerName, eventType, startTime, endTime, timeBucket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetProviderEventRates reports an event type relative to delivered
+// messages, e.g. event_type=spam_report for a provider's complaint rate
+func (ec *ESPController) GetProviderEventRates(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	providerName := mux.Vars(r)["provider"]
+	if !isValidProvider(providerName) {
+		http.Error(w, "Invalid provider", http.StatusBadRequest)
+		return
+	}
+
+	eventType := r.URL.Query().Get("event_type")
+	if eventType == "" {
+		eventType = string(providers.EventSpamReport)
+	}
+	if !isValidEventType(eventType) {
+		http.Error(w, "Invalid event type", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, timeBucket, ok := parseStatsWindow(w, r)
+	if !ok {
+		return
+	}
+
+	rates, err := models.GetEventRateStats(ec.DB, authUser.ID, providerName, eventType, startTime, endTime, timeBucket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func (ec *ESPController) GetProviderClickStats(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	providerName := mux.Vars(r)["provider"]
+	if !isValidProvider(providerName) {
+		http.Error(w, "Invalid provider", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, timeBucket, ok := parseStatsWindow(w, r)
+	if !ok {
+		return
+	}
+
+	rates, err := models.GetEventRateStats(ec.DB, authUser.ID, providerName, string(providers.EventUniqueClick), startTime, endTime, timeBucket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting click-through stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	links, err := models.GetLinkClickStats(ec.DB, authUser.ID, providerName, startTime, endTime, timeBucket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting link stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"click_through": rates,
+		"links":         links,
+	})
+}
+
+// parseStatsWindow reads the start_date, end_date and time_bucket query
+// parameters shared by the stats endpoints. It writes the error response
+// itself.
+func parseStatsWindow(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, string, bool) {
 	startDateStr := r.URL.Query().Get("start_date")
 	endDateStr := r.URL.Query().Get("end_date")
 	timeBucket := r.URL.Query().Get("time_bucket")
@@ -242,13 +335,13 @@ func (ec *ESPController) GetProviderEventStats(w http.ResponseWriter, r *http.Re
 	startTime, err := time.Parse("2006-01-02", startDateStr)
 	if err != nil {
 		http.Error(w, "Invalid start_date format. Use YYYY-MM-DD", http.StatusBadRequest)
-		return
+		return time.Time{}, time.Time{}, "", false
 	}
 
 	endTime, err := time.Parse("2006-01-02", endDateStr)
 	if err != nil {
 		http.Error(w, "Invalid end_date format. Use YYYY-MM-DD", http.StatusBadRequest)
-		return
+		return time.Time{}, time.Time{}, "", false
 	}
 
 	// Set end time to the end of the day
@@ -266,30 +359,16 @@ func (ec *ESPController) GetProviderEventStats(w http.ResponseWriter, r *http.Re
 		}
 		if !validBuckets[timeBucket] {
 			http.Error(w, "Invalid time_bucket. Valid values are: 1 minute, 5 minutes, 15 minutes, 30 minutes, 1 hour, 1 day, 1 week, 1 month", http.StatusBadRequest)
-			return
+			return time.Time{}, time.Time{}, "", false
 		}
 		// Add space before the time unit for PostgreSQL time_bucket function
-		if len(timeBucket) > 1 {
-			timeBucket = timeBucket[:1] + " " + timeBucket[1:]
-		}
+		unit := strings.TrimLeft(timeBucket, "0123456789")
+		timeBucket = strings.TrimSuffix(timeBucket, unit) + " " + unit
 	}
 
-	stats, err := models.GetProviderEventStatsByType(ec.DB, authUser.ID, providerName, eventType, startTime, endTime, timeBucket)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting stats: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	return startTime, endTime, timeBucket, true
 }
 
 func isValidEventType(eventType string) bool {
-	validTypes := []string{"processed", "delivered", "bounce", "deferred", "unique_open", "open", "dropped"}
-	for _, t := range validTypes {
-		if t == eventType {
-			return true
-		}
-	}
-	return false
+	return providers.IsValidEventType(eventType)
 }
@@ -0,0 +1,72 @@
+// controllers/message_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/routing"
+	"github.com/nzenitram/relay-esp/sending"
+)
+
+// Maximum accepted size of a message, including base64 attachments
+const maxMessageBodySize = 40 << 20
+
+type MessageController struct {
+	DB     *sql.DB
+	Sender *sending.Service
+}
+
+func NewMessageController(db *sql.DB, sender *sending.Service) *MessageController {
+	return &MessageController{DB: db, Sender: sender}
+}
+
+// SendMessage sends a provider-neutral message through one of the user's
+// ESPs, chosen by weighted routing on the From domain
+func (mc *MessageController) SendMessage(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var msg providers.Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageBodySize)).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := mc.Sender.Send(r.Context(), authUser.ID, &msg)
+	if err != nil {
+		var sendErr *providers.SendError
+		var limitErr *sending.LimitError
+		switch {
+		case errors.Is(err, providers.ErrInvalidMessage):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, routing.ErrNoESP), errors.Is(err, sending.ErrUnsupportedProvider),
+			errors.Is(err, providers.ErrMissingCredentials), errors.Is(err, sending.ErrSuppressed):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.As(err, &limitErr):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		case errors.As(err, &sendErr):
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			log.Printf("Error sending message for user %d: %v", authUser.ID, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(result)
+}
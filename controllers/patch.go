@@ -0,0 +1,50 @@
+// controllers/patch.go
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum accepted size of a merge patch body
+const maxPatchBodySize = 1 << 20
+
+// etag derives a resource's ETag from its updated_at, which changes on
+// every write
+func etag(updatedAt time.Time) string {
+	return fmt.Sprintf(`"%d"`, updatedAt.UnixNano())
+}
+
+// checkIfMatch enforces the request's If-Match header, if any, against the
+// resource's current ETag. It writes the 412 response itself.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, updatedAt time.Time) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || strings.TrimSpace(ifMatch) == "*" {
+		return true
+	}
+
+	current := etag(updatedAt)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == current {
+			return true
+		}
+	}
+
+	w.Header().Set("ETag", current)
+	http.Error(w, "Precondition failed: the resource has been modified", http.StatusPreconditionFailed)
+	return false
+}
+
+// readPatchBody reads a merge patch request body. It writes the error
+// response itself.
+func readPatchBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
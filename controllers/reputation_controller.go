@@ -0,0 +1,90 @@
+// controllers/reputation_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/reputation"
+)
+
+// Maximum number of weight adjustments returned at once
+const maxWeightAdjustments = 1000
+
+type ReputationController struct {
+	DB         *sql.DB
+	Reputation *reputation.Controller
+}
+
+func NewReputationController(db *sql.DB, rep *reputation.Controller) *ReputationController {
+	return &ReputationController{DB: db, Reputation: rep}
+}
+
+// GetReputation scores the user's ESPs and reports the weight factors the
+// reputation controller would set on its next run, without applying them
+func (rc *ReputationController) GetReputation(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	assessments, err := rc.Reputation.Assess(authUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cfg := rc.Reputation.Config()
+	response := map[string]interface{}{
+		"enabled": cfg.Enabled,
+		"dry_run": cfg.DryRun,
+		"esps":    assessments,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetWeightAdjustments lists the weight changes made to the user's ESPs,
+// newest first, optionally filtered by esp_id
+func (rc *ReputationController) GetWeightAdjustments(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	espID := 0
+	if v := query.Get("esp_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid esp_id", http.StatusBadRequest)
+			return
+		}
+		espID = id
+	}
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxWeightAdjustments {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	adjustments, err := models.GetWeightAdjustments(rc.DB, authUser.ID, espID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adjustments)
+}
@@ -0,0 +1,82 @@
+// controllers/routing_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/routing"
+)
+
+type RoutingController struct {
+	DB     *sql.DB
+	Router *routing.Router
+}
+
+func NewRoutingController(db *sql.DB, router *routing.Router) *RoutingController {
+	return &RoutingController{DB: db, Router: router}
+}
+
+// ExplainRoute routes a hypothetical message from sender_domain to
+// recipient_domain and reports which ESP would be chosen and why
+func (rc *RoutingController) ExplainRoute(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	senderDomain := r.URL.Query().Get("sender_domain")
+	if senderDomain == "" {
+		http.Error(w, "sender_domain is required", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := rc.Router.Explain(routing.Request{
+		UserID:          authUser.ID,
+		SenderDomain:    senderDomain,
+		RecipientDomain: r.URL.Query().Get("recipient_domain"),
+	})
+	if err != nil && !errors.Is(err, routing.ErrNoESP) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// With no eligible ESP the candidates still explain why
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		decision.Reason = err.Error()
+	}
+	json.NewEncoder(w).Encode(decision)
+}
+
+// GetBreakers reports the circuit breaker state and recent send results of
+// each of the user's ESPs
+func (rc *RoutingController) GetBreakers(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	esps, err := models.GetESPsByUserID(rc.DB, authUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	breakers := make([]routing.BreakerStatus, 0, len(esps))
+	for _, esp := range esps {
+		status := rc.Router.Breakers().Status(esp.ESPID)
+		status.Provider = esp.ProviderName
+		breakers = append(breakers, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakers)
+}
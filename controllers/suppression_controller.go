@@ -0,0 +1,350 @@
+// controllers/suppression_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+)
+
+// Maximum accepted size of a suppression CSV import
+const maxSuppressionImportSize = 20 << 20
+
+// Columns of exported suppression lists. Imports read the value, reason and
+// expires_at columns and ignore the rest.
+var suppressionCSVHeader = []string{"value", "kind", "reason", "expires_at", "message_id", "created_at"}
+
+type SuppressionController struct {
+	DB *sql.DB
+}
+
+func NewSuppressionController(db *sql.DB) *SuppressionController {
+	return &SuppressionController{DB: db}
+}
+
+// suppressionImportError reports a CSV line that wasn't imported
+type suppressionImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// GetSuppressions lists the user's suppressed addresses and domains
+func (sc *SuppressionController) GetSuppressions(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter := suppressionFilter(r)
+	filter.Limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	filter.Offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	if filter.Limit <= 0 {
+		filter.Limit = 50 // Default limit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	suppressions, err := models.GetSuppressions(sc.DB, authUser.ID, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppressions)
+}
+
+// GetSuppression returns one entry
+func (sc *SuppressionController) GetSuppression(w http.ResponseWriter, r *http.Request) {
+	suppression, ok := sc.loadSuppression(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppression)
+}
+
+// CreateSuppression suppresses an address or a whole domain
+func (sc *SuppressionController) CreateSuppression(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var suppression models.Suppression
+	if err := json.NewDecoder(r.Body).Decode(&suppression); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	suppression.UserID = authUser.ID
+	suppression.MessageID = ""
+	suppression.Normalize()
+	if err := suppression.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := models.CreateSuppression(sc.DB, &suppression); err != nil {
+		if err == models.ErrSuppressionExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(suppression)
+}
+
+// UpdateSuppression changes an entry's reason and expiry. Leaving out
+// expires_at makes the entry permanent.
+func (sc *SuppressionController) UpdateSuppression(w http.ResponseWriter, r *http.Request) {
+	suppression, ok := sc.loadSuppression(w, r)
+	if !ok {
+		return
+	}
+
+	var update struct {
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Reason != "" {
+		suppression.Reason = update.Reason
+	}
+	suppression.ExpiresAt = update.ExpiresAt
+	if err := suppression.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := models.UpdateSuppression(sc.DB, suppression); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Suppression not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppression)
+}
+
+// DeleteSuppression lifts an entry, allowing sends to the address or domain
+// again
+func (sc *SuppressionController) DeleteSuppression(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid suppression ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.DeleteSuppression(sc.DB, authUser.ID, id); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Suppression not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportSuppressions adds entries from a CSV body, replacing existing ones
+// that expire; permanent entries are kept. The first row may be a header
+// naming the value, reason and expires_at columns; without one the columns
+// are read in that order. Lines that can't be imported are reported and
+// skipped.
+func (sc *SuppressionController) ImportSuppressions(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reader := csv.NewReader(http.MaxBytesReader(w, r.Body, maxSuppressionImportSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := map[string]int{"value": 0, "reason": 1, "expires_at": 2}
+	seen := map[string]bool{}
+	var suppressions []*models.Suppression
+	skipped := []suppressionImportError{}
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				skipped = append(skipped, suppressionImportError{Line: parseErr.Line, Error: parseErr.Err.Error()})
+				continue
+			}
+			http.Error(w, "Error reading CSV: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		line, _ := reader.FieldPos(0)
+		if first && isSuppressionHeader(record) {
+			columns = map[string]int{}
+			for i, name := range record {
+				columns[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			continue
+		}
+
+		suppression, err := suppressionFromCSV(record, columns)
+		if err != nil {
+			skipped = append(skipped, suppressionImportError{Line: line, Error: err.Error()})
+			continue
+		}
+		if seen[suppression.Value] {
+			skipped = append(skipped, suppressionImportError{Line: line, Error: "duplicate of an earlier line"})
+			continue
+		}
+		seen[suppression.Value] = true
+		suppression.UserID = authUser.ID
+		suppressions = append(suppressions, suppression)
+	}
+
+	imported, kept, err := models.ImportSuppressions(sc.DB, suppressions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": imported,
+		"kept":     kept,
+		"skipped":  skipped,
+	})
+}
+
+// ExportSuppressions writes the user's entries as CSV. It takes the same
+// filters as GetSuppressions, without paging.
+func (sc *SuppressionController) ExportSuppressions(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	suppressions, err := models.GetSuppressions(sc.DB, authUser.ID, suppressionFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="suppressions.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write(suppressionCSVHeader)
+	for _, s := range suppressions {
+		expiresAt := ""
+		if s.ExpiresAt != nil {
+			expiresAt = s.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		writer.Write([]string{s.Value, s.Kind, s.Reason, expiresAt, s.MessageID,
+			s.CreatedAt.UTC().Format(time.RFC3339)})
+	}
+	writer.Flush()
+}
+
+// suppressionFilter reads the kind, reason and include_expired query
+// parameters
+func suppressionFilter(r *http.Request) models.SuppressionFilter {
+	query := r.URL.Query()
+	includeExpired, _ := strconv.ParseBool(query.Get("include_expired"))
+	return models.SuppressionFilter{
+		Kind:           query.Get("kind"),
+		Reason:         query.Get("reason"),
+		IncludeExpired: includeExpired,
+	}
+}
+
+func isSuppressionHeader(record []string) bool {
+	for _, field := range record {
+		if strings.EqualFold(strings.TrimSpace(field), "value") {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressionFromCSV builds an entry from one CSV record
+func suppressionFromCSV(record []string, columns map[string]int) (*models.Suppression, error) {
+	field := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	suppression := &models.Suppression{Value: field("value"), Reason: field("reason")}
+	if expiresAt := field("expires_at"); expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_at: %s", expiresAt)
+		}
+		suppression.ExpiresAt = &t
+	}
+	suppression.Normalize()
+	if err := suppression.Validate(); err != nil {
+		return nil, err
+	}
+	return suppression, nil
+}
+
+// loadSuppression looks up the user's entry named in the URL. It writes the
+// error response itself.
+func (sc *SuppressionController) loadSuppression(w http.ResponseWriter, r *http.Request) (*models.Suppression, bool) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid suppression ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	suppression, err := models.GetSuppression(sc.DB, authUser.ID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Suppression not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return suppression, true
+}
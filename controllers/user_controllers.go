@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	netmail "net/mail"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/lib/pq"
 	"github.com/nzenitram/relay-esp/middleware"
 	"github.com/nzenitram/relay-esp/models"
 	"github.com/nzenitram/relay-esp/utils"
@@ -124,9 +127,107 @@ func (uc *UserController) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(user.UpdatedAt))
 	json.NewEncoder(w).Encode(user)
 }
 
+// PatchUser applies a JSON Merge Patch to the authenticated user. An
+// If-Match header guards against overwriting concurrent changes.
+func (uc *UserController) PatchUser(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check if the authenticated user is updating their own data
+	if authUser.ID != id {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	existing, err := models.GetUserByID(uc.DB, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !checkIfMatch(w, r, existing.UpdatedAt) {
+		return
+	}
+
+	patch, ok := readPatchBody(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := json.Marshal(existing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	merged, err := utils.MergePatch(current, patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	if err := json.Unmarshal(merged, &user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Identity and timestamps can't be patched
+	user.ID = existing.ID
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = existing.UpdatedAt
+
+	if err := validateUser(&user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = models.UpdateUserIfUnmodified(uc.DB, &user, existing.UpdatedAt)
+	if err == models.ErrModified {
+		http.Error(w, "Precondition failed: the resource has been modified", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Username, email or API key already in use", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(user.UpdatedAt))
+	json.NewEncoder(w).Encode(user)
+}
+
+// validateUser checks the fields a user can't be saved without
+func validateUser(user *models.User) error {
+	if strings.TrimSpace(user.Username) == "" {
+		return fmt.Errorf("username is required")
+	}
+	if _, err := netmail.ParseAddress(user.Email); err != nil {
+		return fmt.Errorf("invalid email")
+	}
+	if user.APIKey == "" {
+		return fmt.Errorf("api_key is required")
+	}
+	return nil
+}
+
 func (uc *UserController) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
 	if !ok {
@@ -0,0 +1,241 @@
+// controllers/warmup_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+)
+
+// Pause thresholds of schedules created without them
+const (
+	defaultWarmupMaxBounceRate    = 0.05
+	defaultWarmupMaxComplaintRate = 0.001
+)
+
+type WarmupController struct {
+	DB *sql.DB
+}
+
+func NewWarmupController(db *sql.DB) *WarmupController {
+	return &WarmupController{DB: db}
+}
+
+// warmupProgress is a schedule with how far along it is
+type warmupProgress struct {
+	*models.Warmup
+	Days int `json:"days"`
+	// Today's ceiling; absent once the warm-up has completed
+	DailyCeiling *int `json:"daily_ceiling,omitempty"`
+	// Share of the schedule's days completed, from 0 to 1
+	Progress float64 `json:"progress"`
+}
+
+func newWarmupProgress(w *models.Warmup) warmupProgress {
+	p := warmupProgress{Warmup: w, Days: w.Days()}
+	if w.Status == models.WarmupCompleted {
+		p.Progress = 1
+		return p
+	}
+	ceiling := w.Ceiling()
+	p.DailyCeiling = &ceiling
+	p.Progress = float64(w.Day) / float64(p.Days)
+	return p
+}
+
+// GetWarmups lists the user's warm-up schedules and their progress
+func (wc *WarmupController) GetWarmups(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	warmups, err := models.GetWarmupsByUserID(wc.DB, authUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	progress := make([]warmupProgress, len(warmups))
+	for i, warmup := range warmups {
+		progress[i] = newWarmupProgress(warmup)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// GetWarmup returns one schedule and its progress
+func (wc *WarmupController) GetWarmup(w http.ResponseWriter, r *http.Request) {
+	warmup, ok := wc.loadWarmup(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWarmupProgress(warmup))
+}
+
+// CreateWarmup attaches a schedule to one of the user's ESPs for one of its
+// sending domains, starting today
+func (wc *WarmupController) CreateWarmup(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var warmup models.Warmup
+	if err := json.NewDecoder(r.Body).Decode(&warmup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	warmup.UserID = authUser.ID
+	if warmup.MaxBounceRate == 0 {
+		warmup.MaxBounceRate = defaultWarmupMaxBounceRate
+	}
+	if warmup.MaxComplaintRate == 0 {
+		warmup.MaxComplaintRate = defaultWarmupMaxComplaintRate
+	}
+	if err := warmup.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Look the ESP up without its credentials, which a warmup doesn't need
+	var esps []models.ESP
+	if warmup.ESPID > 0 {
+		var err error
+		esps, err = models.GetESPsByUserIDWithFilters(wc.DB, authUser.ID, warmup.ESPID, "", "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(esps) == 0 {
+		http.Error(w, "ESP not found", http.StatusBadRequest)
+		return
+	}
+	if !hasSendingDomain(&esps[0], warmup.SendingDomain) {
+		http.Error(w, "sending_domain is not a sending domain of the ESP", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.CreateWarmup(wc.DB, &warmup); err != nil {
+		if err == models.ErrWarmupExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newWarmupProgress(&warmup))
+}
+
+// DeleteWarmup removes a schedule, lifting its ceiling
+func (wc *WarmupController) DeleteWarmup(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid warm-up ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.DeleteWarmup(wc.DB, authUser.ID, id); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Warm-up not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PauseWarmup holds an active schedule at its current day
+func (wc *WarmupController) PauseWarmup(w http.ResponseWriter, r *http.Request) {
+	warmup, ok := wc.loadWarmup(w, r)
+	if !ok {
+		return
+	}
+	if warmup.Status != models.WarmupActive {
+		http.Error(w, "Warm-up is "+warmup.Status, http.StatusConflict)
+		return
+	}
+	warmup.Pause("paused manually")
+	wc.saveProgress(w, warmup)
+}
+
+// ResumeWarmup continues a paused schedule from its current day, which
+// counts as starting today
+func (wc *WarmupController) ResumeWarmup(w http.ResponseWriter, r *http.Request) {
+	warmup, ok := wc.loadWarmup(w, r)
+	if !ok {
+		return
+	}
+	if warmup.Status != models.WarmupPaused {
+		http.Error(w, "Warm-up is "+warmup.Status, http.StatusConflict)
+		return
+	}
+	warmup.Resume()
+	wc.saveProgress(w, warmup)
+}
+
+func (wc *WarmupController) saveProgress(w http.ResponseWriter, warmup *models.Warmup) {
+	if err := models.UpdateWarmupProgress(wc.DB, warmup); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWarmupProgress(warmup))
+}
+
+// loadWarmup looks up the user's schedule named in the URL. It writes the
+// error response itself.
+func (wc *WarmupController) loadWarmup(w http.ResponseWriter, r *http.Request) (*models.Warmup, bool) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid warm-up ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	warmup, err := models.GetWarmup(wc.DB, authUser.ID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Warm-up not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return warmup, true
+}
+
+func hasSendingDomain(esp *models.ESP, domain string) bool {
+	for _, d := range esp.SendingDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
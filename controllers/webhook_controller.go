@@ -0,0 +1,160 @@
+// controllers/webhook_controller.go
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nzenitram/relay-esp/ingest"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+// Maximum accepted size of a single webhook request body
+const maxWebhookBodySize = 10 << 20
+
+type WebhookController struct {
+	DB    *sql.DB
+	Queue *ingest.Queue
+}
+
+func NewWebhookController(db *sql.DB, queue *ingest.Queue) *WebhookController {
+	return &WebhookController{DB: db, Queue: queue}
+}
+
+// ReceiveWebhook handles webhook posts for any registered provider. The
+// provider's adapter authenticates the request against the ESP's stored
+// credentials and maps the payload onto normalized events.
+func (wc *WebhookController) ReceiveWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	adapter, ok := providers.Get(vars["provider"])
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	esp, ok := wc.loadESP(w, r, adapter.Name())
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	creds := esp.Credentials
+	if err := adapter.VerifyWebhook(r, body, creds); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if h, ok := adapter.(providers.Handshaker); ok {
+		response, ok, err := h.Handshake(r, body, creds)
+		if err != nil {
+			log.Printf("Error completing %s handshake for ESP %d: %v", adapter.Name(), esp.ESPID, err)
+			http.Error(w, "Handshake failed", http.StatusBadGateway)
+			return
+		}
+		if ok {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			w.Write(response)
+			return
+		}
+	}
+
+	// Kept so the payload can be replayed once a failure's cause is fixed;
+	// the provider doesn't need to resend it
+	stored := providers.RedactWebhook(adapter, r, body)
+
+	events, err := adapter.ParseWebhook(r, body)
+	if err != nil {
+		id, dlErr := models.CreateParseFailure(wc.DB, esp, adapter.Name(), r.Header, stored, err)
+		if dlErr != nil {
+			log.Printf("Error dead-lettering %s webhook for ESP %d: %v", adapter.Name(), esp.ESPID, dlErr)
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Dead-lettered %s webhook for ESP %d as failure %d: %v", adapter.Name(), esp.ESPID, id, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	batch := providerEvents(esp, adapter.Name(), events)
+	source := models.NewWebhookSource(r.Header, stored)
+	for _, pe := range batch {
+		pe.Source = source
+	}
+
+	// Events are written asynchronously; tell the provider to back off if
+	// we can't take them
+	if err := wc.Queue.Enqueue(batch); err != nil {
+		log.Printf("Error enqueuing %d %s events for ESP %d: %v", len(batch), adapter.Name(), esp.ESPID, err)
+		if err == ingest.ErrQueueFull {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		} else {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// providerEvents attaches the ESP's owner to normalized events
+func providerEvents(esp *models.ESP, provider string, events []providers.NormalizedEvent) []*models.ProviderEvent {
+	batch := make([]*models.ProviderEvent, 0, len(events))
+	for _, ev := range events {
+		batch = append(batch, &models.ProviderEvent{
+			NormalizedEvent: ev,
+			UserID:          esp.UserID,
+			ESPID:           esp.ESPID,
+			Provider:        provider,
+		})
+	}
+	return batch
+}
+
+// loadESP looks up the ESP named in the URL and checks it belongs to the
+// provider the webhook is for. It writes the error response itself.
+func (wc *WebhookController) loadESP(w http.ResponseWriter, r *http.Request, provider string) (*models.ESP, bool) {
+	vars := mux.Vars(r)
+	espID, err := strconv.Atoi(vars["esp_id"])
+	if err != nil {
+		http.Error(w, "Invalid ESP ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	esp, err := models.GetESPByID(wc.DB, espID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "ESP not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+
+	if !strings.EqualFold(esp.ProviderName, provider) {
+		http.Error(w, "ESP not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return esp, true
+}
+
+// GetIngestStats returns the ingestion queue depth and the number of
+// duplicate provider events dropped since startup
+func (wc *WebhookController) GetIngestStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wc.Queue.Stats())
+}
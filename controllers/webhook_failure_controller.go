@@ -0,0 +1,235 @@
+// controllers/webhook_failure_controller.go
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+// Maximum number of failures listed or replayed per request
+const maxWebhookFailures = 1000
+
+// ReplayResult is the outcome of replaying one dead-lettered webhook
+type ReplayResult struct {
+	ID         int64  `json:"id"`
+	Replayed   bool   `json:"replayed"`
+	Events     int    `json:"events"`
+	Duplicates int    `json:"duplicates"`
+	Error      string `json:"error,omitempty"`
+}
+
+// GetWebhookFailures lists the authenticated user's dead-lettered webhooks.
+// Supports esp_id, provider, start and end (RFC 3339), pending and limit.
+func (wc *WebhookController) GetWebhookFailures(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter, ok := parseFailureFilter(w, r)
+	if !ok {
+		return
+	}
+	filter.PendingOnly = r.URL.Query().Get("pending") == "true"
+
+	failures, err := models.GetWebhookFailures(wc.DB, authUser.ID, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]models.WebhookFailure{"failures": failures})
+}
+
+// ReplayWebhookFailure re-ingests a single dead-lettered webhook
+func (wc *WebhookController) ReplayWebhookFailure(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid failure ID", http.StatusBadRequest)
+		return
+	}
+
+	failure, err := models.GetWebhookFailure(wc.DB, authUser.ID, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Failure not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	result := wc.replay(failure)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Replayed {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// ReplayWebhookFailures re-ingests every pending dead-lettered webhook
+// matching the same filters as GetWebhookFailures; start and end are required
+func (wc *WebhookController) ReplayWebhookFailures(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(middleware.AuthUserKey).(*models.User)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter, ok := parseFailureFilter(w, r)
+	if !ok {
+		return
+	}
+	if filter.Start.IsZero() || filter.End.IsZero() {
+		http.Error(w, "start and end are required", http.StatusBadRequest)
+		return
+	}
+	filter.PendingOnly = true
+
+	failures, err := models.GetWebhookFailures(wc.DB, authUser.ID, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]ReplayResult, 0, len(failures))
+	replayed := 0
+	for i := range failures {
+		result := wc.replay(&failures[i])
+		if result.Replayed {
+			replayed++
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"replayed": replayed,
+		"failed":   len(results) - replayed,
+		"results":  results,
+	})
+}
+
+// replay parses a failure's request again and writes its events, recording
+// the outcome. Going back through the provider's adapter means a fixed
+// mapping applies; events already written are dropped as duplicates.
+func (wc *WebhookController) replay(failure *models.WebhookFailure) ReplayResult {
+	result := ReplayResult{ID: failure.ID}
+
+	events, err := wc.failureEvents(failure)
+	if err == nil {
+		result.Events = len(events)
+		result.Duplicates, err = wc.Queue.Record(events)
+	}
+
+	if recErr := models.RecordWebhookFailureReplay(wc.DB, failure.ID, err); recErr != nil {
+		err = recErr
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Replayed = true
+	return result
+}
+
+// failureEvents parses the events of a dead-lettered webhook
+func (wc *WebhookController) failureEvents(failure *models.WebhookFailure) ([]*models.ProviderEvent, error) {
+	switch failure.Stage {
+	case models.FailureStageParse, models.FailureStageWrite:
+		adapter, ok := providers.Get(failure.Provider)
+		if !ok {
+			return nil, fmt.Errorf("unknown provider: %s", failure.Provider)
+		}
+
+		esp, err := models.GetESPByID(wc.DB, failure.ESPID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, errors.New("ESP no longer exists")
+			}
+			return nil, err
+		}
+
+		// The request was authenticated when it was received, so only the
+		// headers the adapter parses with are needed
+		req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(failure.Payload)))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(failure.Headers, &req.Header); err != nil {
+			return nil, fmt.Errorf("error decoding stored headers: %v", err)
+		}
+
+		events, err := adapter.ParseWebhook(req, []byte(failure.Payload))
+		if err != nil {
+			return nil, err
+		}
+		return providerEvents(esp, adapter.Name(), events), nil
+	}
+
+	return nil, fmt.Errorf("unknown failure stage: %s", failure.Stage)
+}
+
+// parseFailureFilter reads the esp_id, provider, start, end and limit query
+// parameters. It writes the error response itself.
+func parseFailureFilter(w http.ResponseWriter, r *http.Request) (models.WebhookFailureFilter, bool) {
+	query := r.URL.Query()
+	filter := models.WebhookFailureFilter{
+		Provider: query.Get("provider"),
+		Limit:    maxWebhookFailures,
+	}
+
+	if value := query.Get("esp_id"); value != "" {
+		espID, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid esp_id", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.ESPID = espID
+	}
+
+	for name, dest := range map[string]*time.Time{"start": &filter.Start, "end": &filter.End} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid "+name+" format. Use RFC 3339, e.g. 2024-01-02T15:04:05Z", http.StatusBadRequest)
+			return filter, false
+		}
+		*dest = t
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxWebhookFailures {
+			http.Error(w, fmt.Sprintf("Invalid limit. Use 1 to %d", maxWebhookFailures), http.StatusBadRequest)
+			return filter, false
+		}
+		filter.Limit = limit
+	}
+
+	return filter, true
+}
@@ -0,0 +1,30 @@
+-- Append-only history of every provider event, one row per webhook event.
+-- The rolled-up row per message stays in events.
+CREATE TABLE IF NOT EXISTS message_events (
+    id          BIGSERIAL PRIMARY KEY,
+    message_id  TEXT        NOT NULL,
+    user_id     INTEGER     NOT NULL,
+    esp_id      INTEGER     NOT NULL,
+    provider    TEXT        NOT NULL,
+    event_type  TEXT        NOT NULL,
+    event_time  TIMESTAMPTZ NOT NULL,
+    recipient   TEXT,
+    reason      TEXT,
+    bounce_type TEXT,
+    payload     JSONB       NOT NULL DEFAULT '{}',
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS message_events_message_idx
+    ON message_events (message_id, event_time, id);
+
+CREATE OR REPLACE FUNCTION message_events_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'message_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS message_events_immutable ON message_events;
+CREATE TRIGGER message_events_immutable
+    BEFORE UPDATE OR DELETE ON message_events
+    FOR EACH ROW EXECUTE FUNCTION message_events_immutable();
@@ -0,0 +1,32 @@
+-- Click tracking on the rolled-up events row
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS unique_click      BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS unique_click_time BIGINT,
+    ADD COLUMN IF NOT EXISTS click             BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS click_count       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_click_time   BIGINT;
+
+ALTER TABLE message_events ADD COLUMN IF NOT EXISTS url TEXT;
+
+-- Every click, with the URL that was clicked
+CREATE TABLE IF NOT EXISTS click_events (
+    time       TIMESTAMPTZ NOT NULL,
+    user_id    INTEGER     NOT NULL,
+    provider   TEXT        NOT NULL,
+    message_id TEXT        NOT NULL,
+    url        TEXT
+);
+SELECT create_hypertable('click_events', 'time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS click_events_user_provider_idx
+    ON click_events (user_id, provider, time DESC);
+
+-- The first click on each message
+CREATE TABLE IF NOT EXISTS unique_click_events (
+    time       TIMESTAMPTZ NOT NULL,
+    user_id    INTEGER     NOT NULL,
+    provider   TEXT        NOT NULL,
+    message_id TEXT        NOT NULL
+);
+SELECT create_hypertable('unique_click_events', 'time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS unique_click_events_user_provider_idx
+    ON unique_click_events (user_id, provider, time DESC);
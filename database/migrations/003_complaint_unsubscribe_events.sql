@@ -0,0 +1,26 @@
+-- Spam complaints and unsubscribes on the rolled-up events row
+ALTER TABLE events
+    ADD COLUMN IF NOT EXISTS spam_report      BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS spam_report_time BIGINT,
+    ADD COLUMN IF NOT EXISTS unsubscribe      BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS unsubscribe_time BIGINT;
+
+CREATE TABLE IF NOT EXISTS spam_report_events (
+    time       TIMESTAMPTZ NOT NULL,
+    user_id    INTEGER     NOT NULL,
+    provider   TEXT        NOT NULL,
+    message_id TEXT        NOT NULL
+);
+SELECT create_hypertable('spam_report_events', 'time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS spam_report_events_user_provider_idx
+    ON spam_report_events (user_id, provider, time DESC);
+
+CREATE TABLE IF NOT EXISTS unsubscribe_events (
+    time       TIMESTAMPTZ NOT NULL,
+    user_id    INTEGER     NOT NULL,
+    provider   TEXT        NOT NULL,
+    message_id TEXT        NOT NULL
+);
+SELECT create_hypertable('unsubscribe_events', 'time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS unsubscribe_events_user_provider_idx
+    ON unsubscribe_events (user_id, provider, time DESC);
@@ -0,0 +1,7 @@
+-- Durable overflow for the in-process ingestion queue. Rows are removed in
+-- the same transaction that writes them to the event tables.
+CREATE TABLE IF NOT EXISTS ingest_spill (
+    id         BIGSERIAL PRIMARY KEY,
+    event      JSONB       NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+-- Provider event IDs seen recently, used to drop webhook retries. Rows are
+-- pruned once their provider's dedupe window has passed.
+CREATE TABLE IF NOT EXISTS provider_event_ids (
+    provider   TEXT        NOT NULL,
+    event_id   TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (provider, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_provider_event_ids_expires_at ON provider_event_ids (expires_at);
@@ -0,0 +1,20 @@
+-- Dead-letter store for webhooks that couldn't be parsed and events that
+-- couldn't be written, kept so they can be replayed once the cause is fixed.
+-- Parse failures keep the raw request body; write failures keep the
+-- normalized event as JSON.
+CREATE TABLE IF NOT EXISTS webhook_failures (
+    id                BIGSERIAL PRIMARY KEY,
+    user_id           INTEGER     NOT NULL,
+    esp_id            INTEGER     NOT NULL,
+    provider          TEXT        NOT NULL,
+    stage             TEXT        NOT NULL,
+    error             TEXT        NOT NULL,
+    headers           JSONB       NOT NULL DEFAULT '{}',
+    payload           TEXT        NOT NULL,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    replay_count      INTEGER     NOT NULL DEFAULT 0,
+    replayed_at       TIMESTAMPTZ,
+    last_replay_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_failures_user_created ON webhook_failures (user_id, created_at);
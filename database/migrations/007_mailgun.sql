@@ -0,0 +1,3 @@
+-- Mailgun signs its webhooks with a per-account HTTP webhook signing key
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS mailgun_webhook_signing_key TEXT;
@@ -0,0 +1,3 @@
+-- SES notifications are only accepted from the SNS topic configured on the ESP
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS ses_topic_arn TEXT;
@@ -0,0 +1,35 @@
+-- Webhook credentials move from one column per provider secret to a
+-- per-provider document, keyed by the field names each provider declares
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS credentials JSONB NOT NULL DEFAULT '{}';
+
+UPDATE email_service_providers
+SET credentials = jsonb_strip_nulls(CASE LOWER(provider_name)
+    WHEN 'sendgrid' THEN jsonb_build_object(
+        'verification_key', NULLIF(sendgrid_verification_key, ''))
+    WHEN 'sparkpost' THEN jsonb_build_object(
+        'webhook_user', NULLIF(sparkpost_webhook_user, ''),
+        'webhook_password', NULLIF(sparkpost_webhook_password, ''))
+    WHEN 'postmark' THEN jsonb_build_object(
+        'webhook_user', NULLIF(postmark_webhook_user, ''),
+        'webhook_password', NULLIF(postmark_webhook_password, ''))
+    WHEN 'socketlabs' THEN jsonb_build_object(
+        'server_id', NULLIF(socketlabs_server_id, ''),
+        'secret_key', NULLIF(socketlabs_secret_key, ''))
+    WHEN 'mailgun' THEN jsonb_build_object(
+        'webhook_signing_key', NULLIF(mailgun_webhook_signing_key, ''))
+    WHEN 'ses' THEN jsonb_build_object(
+        'topic_arn', NULLIF(ses_topic_arn, ''))
+    ELSE '{}'::jsonb
+END);
+
+ALTER TABLE email_service_providers
+    DROP COLUMN IF EXISTS sendgrid_verification_key,
+    DROP COLUMN IF EXISTS sparkpost_webhook_user,
+    DROP COLUMN IF EXISTS sparkpost_webhook_password,
+    DROP COLUMN IF EXISTS socketlabs_secret_key,
+    DROP COLUMN IF EXISTS socketlabs_server_id,
+    DROP COLUMN IF EXISTS postmark_webhook_user,
+    DROP COLUMN IF EXISTS postmark_webhook_password,
+    DROP COLUMN IF EXISTS mailgun_webhook_signing_key,
+    DROP COLUMN IF EXISTS ses_topic_arn;
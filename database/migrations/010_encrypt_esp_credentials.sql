@@ -0,0 +1,7 @@
+-- ESP credentials are stored envelope-encrypted. The plaintext credentials
+-- column is emptied at startup once its rows have been encrypted with the
+-- configured master key.
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS credentials_ciphertext BYTEA,
+    ADD COLUMN IF NOT EXISTS credentials_data_key   BYTEA,
+    ADD COLUMN IF NOT EXISTS credentials_key_id     TEXT;
@@ -0,0 +1,4 @@
+-- Masked hints and last-updated times of each ESP's credential fields, so
+-- responses can describe credentials without decrypting or returning them
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS credentials_meta JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,26 @@
+-- Multiplier the reputation controller applies to each ESP's configured
+-- weight when routing
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS weight_factor DOUBLE PRECISION NOT NULL DEFAULT 1;
+
+-- Every weight change the reputation controller made, or would have made
+-- in dry-run mode, with the stats behind it
+CREATE TABLE IF NOT EXISTS esp_weight_adjustments (
+    id              BIGSERIAL PRIMARY KEY,
+    user_id         INTEGER          NOT NULL,
+    esp_id          INTEGER          NOT NULL,
+    previous_factor DOUBLE PRECISION NOT NULL,
+    factor          DOUBLE PRECISION NOT NULL,
+    weight          INTEGER          NOT NULL,
+    effective_weight INTEGER          NOT NULL,
+    score           DOUBLE PRECISION NOT NULL,
+    sample_size     INTEGER          NOT NULL,
+    bounce_rate     DOUBLE PRECISION NOT NULL,
+    deferral_rate   DOUBLE PRECISION NOT NULL,
+    complaint_rate  DOUBLE PRECISION NOT NULL,
+    reason          TEXT             NOT NULL,
+    dry_run         BOOLEAN          NOT NULL DEFAULT false,
+    created_at      TIMESTAMPTZ      NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_esp_weight_adjustments_user_created ON esp_weight_adjustments (user_id, created_at);
@@ -0,0 +1,14 @@
+-- Per-ESP send rate limits and volume caps, optionally per sending domain
+ALTER TABLE email_service_providers
+    ADD COLUMN IF NOT EXISTS send_limits JSONB NOT NULL DEFAULT '{}';
+
+-- Messages sent per ESP per day and month, enforcing volume caps. The empty
+-- sending domain holds the ESP's total.
+CREATE TABLE IF NOT EXISTS esp_send_usage (
+    esp_id         INTEGER NOT NULL,
+    sending_domain TEXT    NOT NULL DEFAULT '',
+    period         TEXT    NOT NULL,
+    period_start   DATE    NOT NULL,
+    count          INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (esp_id, sending_domain, period, period_start)
+);
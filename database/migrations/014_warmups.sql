@@ -0,0 +1,25 @@
+-- Warm-up schedules ramping the daily volume of an ESP for one sending
+-- domain, either as explicit day-by-day ceilings or as a growth curve
+CREATE TABLE IF NOT EXISTS warmup_schedules (
+    id                 BIGSERIAL PRIMARY KEY,
+    user_id            INTEGER          NOT NULL,
+    esp_id             INTEGER          NOT NULL,
+    sending_domain     TEXT             NOT NULL,
+    daily_limits       INTEGER[]        NOT NULL DEFAULT '{}',
+    initial_volume     INTEGER          NOT NULL DEFAULT 0,
+    growth_rate        DOUBLE PRECISION NOT NULL DEFAULT 0,
+    target_volume      INTEGER          NOT NULL DEFAULT 0,
+    max_bounce_rate    DOUBLE PRECISION NOT NULL,
+    max_complaint_rate DOUBLE PRECISION NOT NULL,
+    -- Zero-based day of the schedule in effect, advanced once per UTC day
+    -- while the ramp is active
+    day                INTEGER          NOT NULL DEFAULT 0,
+    day_started_on     DATE             NOT NULL DEFAULT (now() AT TIME ZONE 'utc')::date,
+    status             TEXT             NOT NULL DEFAULT 'active',
+    paused_reason      TEXT,
+    created_at         TIMESTAMPTZ      NOT NULL DEFAULT now(),
+    updated_at         TIMESTAMPTZ      NOT NULL DEFAULT now(),
+    UNIQUE (esp_id, sending_domain)
+);
+
+CREATE INDEX IF NOT EXISTS idx_warmup_schedules_user ON warmup_schedules (user_id);
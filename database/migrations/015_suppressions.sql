@@ -0,0 +1,16 @@
+-- Recipients a user never sends to: single addresses, or every address at a
+-- domain. Entries with an expiry stop applying once it passes.
+CREATE TABLE IF NOT EXISTS suppressions (
+    id         BIGSERIAL   PRIMARY KEY,
+    user_id    INTEGER     NOT NULL,
+    kind       TEXT        NOT NULL,
+    -- Lowercased address or domain
+    value      TEXT        NOT NULL,
+    reason     TEXT        NOT NULL,
+    -- Message whose event added the entry, when it was added automatically
+    message_id TEXT,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, value)
+);
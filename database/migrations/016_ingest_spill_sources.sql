@@ -0,0 +1,14 @@
+-- Webhook requests that spilled events were parsed from, stored once per
+-- request rather than with each event. An event that can't be written is
+-- dead-lettered as its request, so replay parses it again.
+CREATE TABLE IF NOT EXISTS ingest_spill_sources (
+    id         BIGSERIAL PRIMARY KEY,
+    headers    JSONB       NOT NULL DEFAULT '{}',
+    body       TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE ingest_spill
+    ADD COLUMN IF NOT EXISTS source_id BIGINT REFERENCES ingest_spill_sources (id);
+
+CREATE INDEX IF NOT EXISTS idx_ingest_spill_source ON ingest_spill (source_id);
@@ -0,0 +1,381 @@
+// Package ingest decouples webhook handlers from event storage. Handlers
+// validate and enqueue events, and worker goroutines write them to Postgres
+// in batches. Events that don't fit in the in-process queue are spilled to
+// the ingest_spill table and drained back as capacity allows.
+package ingest
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+var (
+	// ErrQueueFull means the queue and the spill table are both at capacity;
+	// the provider should retry later
+	ErrQueueFull = errors.New("ingestion queue is full")
+	// ErrUnavailable means events could neither be queued nor spilled
+	ErrUnavailable = errors.New("ingestion is unavailable")
+)
+
+// Config controls the size and pacing of the ingestion pipeline
+type Config struct {
+	// Number of events held in memory
+	QueueSize int
+	// Maximum number of events written per batch
+	BatchSize int
+	// How long a worker waits to fill a batch before flushing it
+	FlushInterval time.Duration
+	// Number of worker goroutines
+	Workers int
+	// Maximum number of events parked in ingest_spill before rejecting
+	MaxSpill int
+	// How long provider event IDs are remembered to drop retried events
+	Dedupe models.DedupeWindows
+}
+
+// ConfigFromEnv reads the INGEST_* environment variables, falling back to
+// defaults for any that are unset or invalid
+func ConfigFromEnv() Config {
+	return Config{
+		QueueSize:     envInt("INGEST_QUEUE_SIZE", 50000),
+		BatchSize:     envInt("INGEST_BATCH_SIZE", 1000),
+		FlushInterval: time.Duration(envInt("INGEST_FLUSH_INTERVAL_MS", 500)) * time.Millisecond,
+		Workers:       envInt("INGEST_WORKERS", 4),
+		MaxSpill:      envInt("INGEST_MAX_SPILL", 1000000),
+		Dedupe:        dedupeWindowsFromEnv(),
+	}
+}
+
+// dedupeWindowsFromEnv reads INGEST_DEDUPE_WINDOW_HOURS and its per-provider
+// overrides, e.g. INGEST_DEDUPE_WINDOW_HOURS_SENDGRID. Adapters must be
+// registered before it is called.
+func dedupeWindowsFromEnv() models.DedupeWindows {
+	windows := models.DedupeWindows{
+		Default:     time.Duration(envInt("INGEST_DEDUPE_WINDOW_HOURS", 72)) * time.Hour,
+		PerProvider: map[string]time.Duration{},
+	}
+	for _, name := range providers.Names() {
+		hours := envInt("INGEST_DEDUPE_WINDOW_HOURS_"+strings.ToUpper(name), 0)
+		if hours > 0 {
+			windows.PerProvider[name] = time.Duration(hours) * time.Hour
+		}
+	}
+	return windows
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Queue is a bounded in-process queue of provider events
+type Queue struct {
+	db     *sql.DB
+	cfg    Config
+	events chan *models.ProviderEvent
+
+	// mu serializes producers so a batch is either queued whole or spilled
+	mu      sync.Mutex
+	stopped bool
+
+	// Events in ingest_spill, tracked in memory so producers don't count
+	// the table. It's recounted periodically since other instances share
+	// the table.
+	spilled atomic.Int64
+
+	statsMu    sync.Mutex
+	duplicates map[string]int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewQueue(db *sql.DB, cfg Config) *Queue {
+	return &Queue{
+		db:         db,
+		cfg:        cfg,
+		events:     make(chan *models.ProviderEvent, cfg.QueueSize),
+		done:       make(chan struct{}),
+		duplicates: map[string]int64{},
+	}
+}
+
+// Stats is a snapshot of the pipeline's counters
+type Stats struct {
+	Queued int `json:"queued"`
+	// Duplicate events dropped since startup, by provider
+	DuplicatesDropped map[string]int64 `json:"duplicates_dropped"`
+}
+
+// Stats returns the current queue depth and duplicate counters
+func (q *Queue) Stats() Stats {
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+
+	duplicates := make(map[string]int64, len(q.duplicates))
+	for provider, n := range q.duplicates {
+		duplicates[provider] = n
+	}
+	return Stats{Queued: len(q.events), DuplicatesDropped: duplicates}
+}
+
+// isolateSpillFailure drains the spill one event at a time after a batch
+// failed, dead-lettering the first event that can't be written so it
+// doesn't block the spill forever
+func (q *Queue) isolateSpillFailure() {
+	for i := 0; i < q.cfg.BatchSize; i++ {
+		drained, duplicates, err := models.DrainSpilledEvents(q.db, 1, q.cfg.Dedupe)
+		if err != nil {
+			moved, dlErr := models.DeadLetterSpilledEvent(q.db, err)
+			if dlErr != nil {
+				log.Printf("Error dead-lettering spilled event: %v", dlErr)
+			} else if moved {
+				q.spilled.Add(-1)
+			}
+			return
+		}
+		q.spilled.Add(-int64(len(drained)))
+		q.countDuplicates(duplicates)
+		if len(drained) == 0 {
+			return
+		}
+	}
+}
+
+// countDuplicates adds dropped duplicate events to the per-provider counters
+func (q *Queue) countDuplicates(duplicates []*models.ProviderEvent) {
+	if len(duplicates) == 0 {
+		return
+	}
+
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+	for _, pe := range duplicates {
+		q.duplicates[pe.Provider]++
+	}
+}
+
+// Start launches the batch workers and the spill drainer
+func (q *Queue) Start() {
+	q.recountSpill()
+
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	q.wg.Add(1)
+	go q.drainSpill()
+}
+
+// Stop rejects new events, flushes everything still queued and waits for the
+// workers to finish
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.done)
+	close(q.events)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+// Enqueue accepts the events from one webhook request. They are queued in
+// memory if they all fit, otherwise spilled to Postgres. It returns
+// ErrQueueFull when the spill table is at capacity too.
+func (q *Queue) Enqueue(events []*models.ProviderEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return ErrUnavailable
+	}
+
+	// Producers hold mu and workers only take from the channel, so these
+	// sends can't block once we've checked there is room
+	if len(q.events)+len(events) <= cap(q.events) {
+		for _, pe := range events {
+			q.events <- pe
+		}
+		q.mu.Unlock()
+		return nil
+	}
+	q.mu.Unlock()
+
+	// Reserve room in the spill before writing to it, outside mu so other
+	// producers can still queue in memory meanwhile
+	n := int64(len(events))
+	if q.spilled.Add(n) > int64(q.cfg.MaxSpill) {
+		q.spilled.Add(-n)
+		return ErrQueueFull
+	}
+	if err := models.SpillEvents(q.db, events); err != nil {
+		q.spilled.Add(-n)
+		log.Printf("Error spilling events: %v", err)
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// recountSpill resets the spill size from the table
+func (q *Queue) recountSpill() {
+	spilled, err := models.CountSpilledEvents(q.db)
+	if err != nil {
+		log.Printf("Error counting spilled events: %v", err)
+		return
+	}
+	q.spilled.Store(int64(spilled))
+}
+
+// work collects events into batches and writes each batch once it's full or
+// the flush interval has passed
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*models.ProviderEvent, 0, q.cfg.BatchSize)
+	for {
+		select {
+		case pe, ok := <-q.events:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, pe)
+			if len(batch) >= q.cfg.BatchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// Record writes events synchronously, bypassing the queue. It is used to
+// replay dead-lettered webhooks and returns the number of duplicates dropped.
+func (q *Queue) Record(events []*models.ProviderEvent) (int, error) {
+	duplicates, err := models.RecordEventBatch(q.db, events, q.cfg.Dedupe)
+	if err != nil {
+		return 0, err
+	}
+	q.countDuplicates(duplicates)
+	return len(duplicates), nil
+}
+
+// flush writes a batch. If the batch fails, its events are written one at a
+// time so a single bad event can't sink the others; events that still fail
+// are dead-lettered, or spilled for a later retry if that fails too.
+func (q *Queue) flush(batch []*models.ProviderEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	duplicates, err := models.RecordEventBatch(q.db, batch, q.cfg.Dedupe)
+	if err == nil {
+		q.countDuplicates(duplicates)
+		return
+	}
+	log.Printf("Error writing batch of %d events: %v", len(batch), err)
+
+	var failed []*models.ProviderEvent
+	deadLettered := map[*models.WebhookSource]bool{}
+	for _, pe := range batch {
+		if len(batch) > 1 {
+			duplicates, err = models.RecordEventBatch(q.db, []*models.ProviderEvent{pe}, q.cfg.Dedupe)
+			if err == nil {
+				q.countDuplicates(duplicates)
+				continue
+			}
+		}
+		// Failures are stored as their request, so one failure covers every
+		// failed event of a request
+		if pe.Source != nil && deadLettered[pe.Source] {
+			continue
+		}
+		if _, dlErr := models.CreateWriteFailure(q.db, pe, err); dlErr != nil {
+			log.Printf("Error dead-lettering %s event for ESP %d: %v", pe.Provider, pe.ESPID, dlErr)
+			failed = append(failed, pe)
+			continue
+		}
+		deadLettered[pe.Source] = true
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	if err := models.SpillEvents(q.db, failed); err != nil {
+		log.Printf("Error spilling %d failed events: %v", len(failed), err)
+		return
+	}
+	q.spilled.Add(int64(len(failed)))
+}
+
+// drainSpill moves spilled events into the event tables while the in-memory
+// queue has spare capacity, so spilled events never starve live ones. It also
+// prunes expired provider event IDs and source requests no longer needed.
+func (q *Queue) drainSpill() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	recount := time.NewTicker(time.Minute)
+	defer recount.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-recount.C:
+			q.recountSpill()
+		case <-prune.C:
+			if _, err := models.PruneProviderEventIDs(q.db); err != nil {
+				log.Printf("Error pruning provider event IDs: %v", err)
+			}
+			if _, err := models.PruneSpillSources(q.db); err != nil {
+				log.Printf("Error pruning spilled source requests: %v", err)
+			}
+		case <-ticker.C:
+			for len(q.events) < cap(q.events)/2 {
+				drained, duplicates, err := models.DrainSpilledEvents(q.db, q.cfg.BatchSize, q.cfg.Dedupe)
+				if err != nil {
+					log.Printf("Error draining spilled events: %v", err)
+					q.isolateSpillFailure()
+					break
+				}
+				q.spilled.Add(-int64(len(drained)))
+				q.countDuplicates(duplicates)
+				if len(drained) == 0 {
+					break
+				}
+			}
+		}
+	}
+}
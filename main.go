@@ -2,16 +2,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/nzenitram/relay-esp/controllers"
 	"github.com/nzenitram/relay-esp/database"
+	"github.com/nzenitram/relay-esp/ingest"
 	"github.com/nzenitram/relay-esp/middleware"
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/reputation"
+	"github.com/nzenitram/relay-esp/routing"
+	"github.com/nzenitram/relay-esp/secrets"
+	"github.com/nzenitram/relay-esp/sending"
+	"github.com/nzenitram/relay-esp/smtpd"
+	"github.com/nzenitram/relay-esp/warmup"
 )
 
 func main() {
@@ -20,11 +34,60 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
+	// Register the supported ESP adapters
+	providers.Register(providers.SendGrid{})
+	providers.Register(providers.SparkPost{})
+	providers.Register(providers.Postmark{})
+	providers.Register(providers.SocketLabs{})
+	providers.Register(providers.Mailgun{})
+
+	// SNS signing certificates are fetched from SNS unless a local
+	// certificate is configured, e.g. for testing
+	var snsCerts providers.CertSource = providers.NewSNSCertFetcher()
+	if path := os.Getenv("SES_SNS_CERT_FILE"); path != "" {
+		cert, err := providers.LoadCertFile(path)
+		if err != nil {
+			log.Fatalf("Error loading SES_SNS_CERT_FILE: %v", err)
+		}
+		snsCerts = cert
+	}
+	providers.Register(providers.NewSES(snsCerts))
+
+	// Load the master keys ESP credentials are encrypted with
+	keyring, err := secrets.KeyringFromEnv()
+	if err != nil {
+		log.Fatalf("Error loading credential master keys: %v", err)
+	}
+	secrets.SetKeyring(keyring)
+
 	// Connect to the database
 	database.InitDB()
 	db := database.GetDB()
 	defer database.CloseDB()
 
+	if err := database.Migrate(db); err != nil {
+		log.Fatalf("Error running migrations: %v", err)
+	}
+
+	// Admin command: re-encrypt all ESP credentials under the active master key
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		n, err := models.RotateCredentialKeys(db)
+		if err != nil {
+			log.Fatalf("Error rotating credential keys: %v", err)
+		}
+		log.Printf("Re-encrypted credentials of %d ESPs under master key %s", n, keyring.ActiveKeyID())
+		return
+	}
+
+	if n, err := models.EncryptPlaintextCredentials(db); err != nil {
+		log.Fatalf("Error encrypting ESP credentials: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted credentials of %d ESPs", n)
+	}
+	if _, err := models.BackfillCredentialHints(db); err != nil {
+		log.Fatalf("Error computing ESP credential hints: %v", err)
+	}
+
 	// Initialize router
 	r := mux.NewRouter()
 
@@ -32,6 +95,25 @@ func main() {
 	userController := controllers.NewUserController(db)
 	eventController := controllers.NewEventController(db)
 	espController := controllers.NewESPController(db)
+	// Start the webhook ingestion pipeline
+	ingestQueue := ingest.NewQueue(db, ingest.ConfigFromEnv())
+	ingestQueue.Start()
+
+	webhookController := controllers.NewWebhookController(db, ingestQueue)
+
+	router := routing.NewRouter(db, routing.OptionsFromEnv())
+	routingController := controllers.NewRoutingController(db, router)
+	sender := sending.NewService(db, router, sending.ConfigFromEnv())
+	weightAdjuster := reputation.NewController(db, reputation.ConfigFromEnv())
+	if weightAdjuster.Config().Enabled {
+		weightAdjuster.Start()
+	}
+	warmupScheduler := warmup.NewController(db, warmup.ConfigFromEnv())
+	warmupScheduler.Start()
+	messageController := controllers.NewMessageController(db, sender)
+	reputationController := controllers.NewReputationController(db, weightAdjuster)
+	warmupController := controllers.NewWarmupController(db)
+	suppressionController := controllers.NewSuppressionController(db)
 
 	// Public routes
 	r.HandleFunc("/health", HealthCheck).Methods("GET")
@@ -39,34 +121,114 @@ func main() {
 	r.HandleFunc("/request-password-reset", userController.RequestPasswordReset).Methods("POST")
 	r.HandleFunc("/reset-password", userController.ResetPassword).Methods("POST")
 
+	// Provider webhooks (authenticated by each provider's own scheme)
+	r.HandleFunc("/webhooks/{provider}/{esp_id}", webhookController.ReceiveWebhook).Methods("POST")
+
 	// Protected routes
 	api := r.PathPrefix("/api/v1").Subrouter()
 	api.Use(middleware.JWTAuth(db))
 	api.HandleFunc("/users", userController.GetUsers).Methods("GET")
 	api.HandleFunc("/users/{id}", userController.GetUser).Methods("GET")
 	api.HandleFunc("/users/{id}", userController.UpdateUser).Methods("PUT")
+	api.HandleFunc("/users/{id}", userController.PatchUser).Methods("PATCH")
 	api.HandleFunc("/users/{id}", userController.DeleteUser).Methods("DELETE")
 
 	// Event routes
 	api.HandleFunc("/events", eventController.GetEvents).Methods("GET")
 	api.HandleFunc("/events/types", eventController.GetAvailableEventTypes).Methods("GET")
 	api.HandleFunc("/events/{type}", eventController.GetEventsByType).Methods("GET")
+	api.HandleFunc("/messages", messageController.SendMessage).Methods("POST")
+	api.HandleFunc("/messages/{message_id}/timeline", eventController.GetMessageTimeline).Methods("GET")
 	// api.HandleFunc("/events/{provider}/{event}", eventController.GetProviderEventStatsByType).Methods("GET")
 
 	// ESP routes
+	api.HandleFunc("/providers", espController.GetProviders).Methods("GET")
 	api.HandleFunc("/esps", espController.GetESPs).Methods("GET")
 	api.HandleFunc("/esps", espController.CreateESP).Methods("POST")
 	api.HandleFunc("/esps/{id}", espController.UpdateESP).Methods("PUT")
+	api.HandleFunc("/esps/{id}", espController.PatchESP).Methods("PATCH")
 	api.HandleFunc("/esps/{id}", espController.DeleteESP).Methods("DELETE")
 	// ESP Stats
 	api.HandleFunc("/esps/{provider}/event-stats", espController.GetProviderEventStats).Methods("GET")
+	api.HandleFunc("/esps/{provider}/click-stats", espController.GetProviderClickStats).Methods("GET")
+	api.HandleFunc("/esps/{provider}/event-rates", espController.GetProviderEventRates).Methods("GET")
+
+	// Webhook ingestion
+	api.HandleFunc("/webhooks/stats", webhookController.GetIngestStats).Methods("GET")
+	api.HandleFunc("/webhooks/failures", webhookController.GetWebhookFailures).Methods("GET")
+	api.HandleFunc("/webhooks/failures/replay", webhookController.ReplayWebhookFailures).Methods("POST")
+	api.HandleFunc("/webhooks/failures/{id}/replay", webhookController.ReplayWebhookFailure).Methods("POST")
+
+	// Routing
+	api.HandleFunc("/routing/explain", routingController.ExplainRoute).Methods("GET")
+	api.HandleFunc("/routing/breakers", routingController.GetBreakers).Methods("GET")
+	api.HandleFunc("/reputation", reputationController.GetReputation).Methods("GET")
+	api.HandleFunc("/reputation/adjustments", reputationController.GetWeightAdjustments).Methods("GET")
+
+	// Warm-up schedules
+	api.HandleFunc("/warmups", warmupController.GetWarmups).Methods("GET")
+	api.HandleFunc("/warmups", warmupController.CreateWarmup).Methods("POST")
+	api.HandleFunc("/warmups/{id}", warmupController.GetWarmup).Methods("GET")
+	api.HandleFunc("/warmups/{id}", warmupController.DeleteWarmup).Methods("DELETE")
+	api.HandleFunc("/warmups/{id}/pause", warmupController.PauseWarmup).Methods("POST")
+	api.HandleFunc("/warmups/{id}/resume", warmupController.ResumeWarmup).Methods("POST")
+
+	// Suppression list
+	api.HandleFunc("/suppressions", suppressionController.GetSuppressions).Methods("GET")
+	api.HandleFunc("/suppressions", suppressionController.CreateSuppression).Methods("POST")
+	api.HandleFunc("/suppressions/export", suppressionController.ExportSuppressions).Methods("GET")
+	api.HandleFunc("/suppressions/import", suppressionController.ImportSuppressions).Methods("POST")
+	api.HandleFunc("/suppressions/{id}", suppressionController.GetSuppression).Methods("GET")
+	api.HandleFunc("/suppressions/{id}", suppressionController.UpdateSuppression).Methods("PUT")
+	api.HandleFunc("/suppressions/{id}", suppressionController.DeleteSuppression).Methods("DELETE")
 
 	// User event routes
 	api.HandleFunc("/event-stats", espController.GetProviderEventStats).Methods("GET")
 
 	// Start server
-	log.Println("Server is running on port 8081")
-	log.Fatal(http.ListenAndServe(":8081", r))
+	srv := &http.Server{Addr: ":8081", Handler: r}
+	go func() {
+		log.Println("Server is running on port 8081")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// SMTP submission for apps that can't use the send API
+	smtpConfig, err := smtpd.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Error loading SMTP configuration: %v", err)
+	}
+	var smtpServer *smtpd.Server
+	if smtpConfig.Addr != "" {
+		smtpServer = smtpd.NewServer(db, sender, smtpConfig)
+		go func() {
+			log.Printf("SMTP server is listening on %s", smtpConfig.Addr)
+			if err := smtpServer.ListenAndServe(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Shut down gracefully so queued events are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if smtpServer != nil {
+		smtpServer.Close(30 * time.Second)
+	}
+	if weightAdjuster.Config().Enabled {
+		weightAdjuster.Stop()
+	}
+	warmupScheduler.Stop()
+	ingestQueue.Stop()
 }
 
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
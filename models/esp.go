@@ -3,37 +3,77 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/nzenitram/relay-esp/providers"
 )
 
 type ESP struct {
-	ESPID                    int       `json:"esp_id"`
-	UserID                   int       `json:"user_id"`
-	ProviderName             string    `json:"provider_name"`
-	SendingDomains           []string  `json:"sending_domains"`
-	CreatedAt                time.Time `json:"created_at"`
-	UpdatedAt                time.Time `json:"updated_at"`
-	SendgridVerificationKey  string    `json:"sendgrid_verification_key,omitempty"`
-	SparkpostWebhookUser     string    `json:"sparkpost_webhook_user,omitempty"`
-	SparkpostWebhookPassword string    `json:"sparkpost_webhook_password,omitempty"`
-	SocketlabsSecretKey      string    `json:"socketlabs_secret_key,omitempty"`
-	PostmarkWebhookUser      string    `json:"postmark_webhook_user,omitempty"`
-	PostmarkWebhookPassword  string    `json:"postmark_webhook_password,omitempty"`
-	SocketlabsServerID       string    `json:"socketlabs_server_id,omitempty"`
-	Weight                   int       `json:"weight"`
+	ESPID          int       `json:"esp_id"`
+	UserID         int       `json:"user_id"`
+	ProviderName   string    `json:"provider_name"`
+	SendingDomains []string  `json:"sending_domains"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// Webhook credentials, validated against the provider's credential
+	// schema. They are write-only and never marshalled.
+	Credentials providers.Credentials `json:"credentials,omitempty"`
+	// Masked hints of the stored credentials, by field name
+	CredentialHints map[string]CredentialHint `json:"credential_hints,omitempty"`
+	Weight          int                       `json:"weight"`
+	// Set by the reputation controller; routing uses EffectiveWeight
+	WeightFactor float64    `json:"weight_factor"`
+	Limits       SendLimits `json:"limits"`
+	// Current volume, filled in when listing ESPs
+	Usage *SendUsage `json:"usage,omitempty"`
+}
+
+// EffectiveWeight is the configured weight scaled by the reputation
+// factor. An ESP with a positive weight keeps a weight of at least 1.
+func (e ESP) EffectiveWeight() int {
+	if e.Weight <= 0 {
+		return 0
+	}
+	weight := int(math.Round(float64(e.Weight) * e.WeightFactor))
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// Validate checks the settings a client can write: the weight, the
+// credentials against the provider's schema and the send limits
+func (e *ESP) Validate() error {
+	if e.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if err := providers.ValidateCredentials(e.ProviderName, e.Credentials); err != nil {
+		return err
+	}
+	return e.Limits.Validate(e.SendingDomains)
+}
+
+// MarshalJSON leaves out the credentials so they are never sent to clients
+func (e ESP) MarshalJSON() ([]byte, error) {
+	type Alias ESP
+	alias := Alias(e)
+	alias.Credentials = nil
+	return json.Marshal(alias)
 }
 
 func GetESPsByUserID(db *sql.DB, userID int) ([]ESP, error) {
 	query := `
         SELECT esp_id, user_id, provider_name, sending_domains, 
-               created_at, updated_at, weight
+               created_at, updated_at, weight, weight_factor, send_limits, credentials_meta
         FROM email_service_providers
         WHERE user_id = $1
-        ORDER BY provider_name
+        ORDER BY provider_name, esp_id
     `
 
 	rows, err := db.Query(query, userID)
@@ -45,6 +85,7 @@ func GetESPsByUserID(db *sql.DB, userID int) ([]ESP, error) {
 	var esps []ESP
 	for rows.Next() {
 		var esp ESP
+		var limits, meta []byte
 
 		err := rows.Scan(
 			&esp.ESPID,
@@ -54,10 +95,19 @@ func GetESPsByUserID(db *sql.DB, userID int) ([]ESP, error) {
 			&esp.CreatedAt,
 			&esp.UpdatedAt,
 			&esp.Weight,
+			&esp.WeightFactor,
+			&limits,
+			&meta,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if esp.CredentialHints, err = decodeCredentialHints(meta); err != nil {
+			return nil, err
+		}
+		if esp.Limits, err = decodeSendLimits(limits); err != nil {
+			return nil, err
+		}
 
 		esps = append(esps, esp)
 	}
@@ -69,10 +119,55 @@ func GetESPsByUserID(db *sql.DB, userID int) ([]ESP, error) {
 	return esps, nil
 }
 
+func GetESPByID(db *sql.DB, espID int) (*ESP, error) {
+	esp := &ESP{}
+	query := `
+        SELECT esp_id, user_id, provider_name, sending_domains,
+               created_at, updated_at, weight, weight_factor, send_limits, credentials_meta, credentials,
+               credentials_key_id, credentials_data_key, credentials_ciphertext
+        FROM email_service_providers
+        WHERE esp_id = $1
+    `
+
+	var limits, meta, plaintext, dataKey, ciphertext []byte
+	var keyID sql.NullString
+	err := db.QueryRow(query, espID).Scan(
+		&esp.ESPID,
+		&esp.UserID,
+		&esp.ProviderName,
+		pq.Array(&esp.SendingDomains),
+		&esp.CreatedAt,
+		&esp.UpdatedAt,
+		&esp.Weight,
+		&esp.WeightFactor,
+		&limits,
+		&meta,
+		&plaintext,
+		&keyID,
+		&dataKey,
+		&ciphertext,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if esp.CredentialHints, err = decodeCredentialHints(meta); err != nil {
+		return nil, err
+	}
+	if esp.Limits, err = decodeSendLimits(limits); err != nil {
+		return nil, err
+	}
+	esp.Credentials, err = openCredentials(esp.ESPID, plaintext, keyID, dataKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return esp, nil
+}
+
 func GetESPsByUserIDWithFilters(db *sql.DB, userID int, espID int, providerName string, sendingDomain string) ([]ESP, error) {
 	query := `
         SELECT esp_id, user_id, provider_name, sending_domains, 
-               created_at, updated_at, weight
+               created_at, updated_at, weight, weight_factor, send_limits, credentials_meta
         FROM email_service_providers
         WHERE 1=1
     `
@@ -113,6 +208,7 @@ func GetESPsByUserIDWithFilters(db *sql.DB, userID int, espID int, providerName
 	var esps []ESP
 	for rows.Next() {
 		var esp ESP
+		var limits, meta []byte
 		err := rows.Scan(
 			&esp.ESPID,
 			&esp.UserID,
@@ -121,10 +217,19 @@ func GetESPsByUserIDWithFilters(db *sql.DB, userID int, espID int, providerName
 			&esp.CreatedAt,
 			&esp.UpdatedAt,
 			&esp.Weight,
+			&esp.WeightFactor,
+			&limits,
+			&meta,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if esp.CredentialHints, err = decodeCredentialHints(meta); err != nil {
+			return nil, err
+		}
+		if esp.Limits, err = decodeSendLimits(limits); err != nil {
+			return nil, err
+		}
 		esps = append(esps, esp)
 	}
 
@@ -135,73 +240,129 @@ func GetESPsByUserIDWithFilters(db *sql.DB, userID int, espID int, providerName
 	return esps, nil
 }
 
+// CreateESP inserts the ESP, then seals its credentials, which are bound to
+// the ESP ID the insert assigns
 func CreateESP(db *sql.DB, esp *ESP) error {
+	esp.CredentialHints = newCredentialHints(esp.Credentials, time.Now().UTC())
+	meta, err := json.Marshal(esp.CredentialHints)
+	if err != nil {
+		return fmt.Errorf("error encoding credential hints: %v", err)
+	}
+	limits, err := json.Marshal(esp.Limits)
+	if err != nil {
+		return fmt.Errorf("error encoding send limits: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
 	query := `
         INSERT INTO email_service_providers (
-            user_id, provider_name, sending_domains, sendgrid_verification_key,
-            sparkpost_webhook_user, sparkpost_webhook_password, socketlabs_secret_key,
-            postmark_webhook_user, postmark_webhook_password, socketlabs_server_id, weight
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-        RETURNING esp_id, created_at, updated_at`
+            user_id, provider_name, sending_domains, weight, credentials_meta, send_limits
+        ) VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING esp_id, created_at, updated_at, weight_factor`
 
-	err := db.QueryRow(
+	err = tx.QueryRow(
 		query,
 		esp.UserID,
 		esp.ProviderName,
 		pq.Array(esp.SendingDomains),
-		esp.SendgridVerificationKey,
-		esp.SparkpostWebhookUser,
-		esp.SparkpostWebhookPassword,
-		esp.SocketlabsSecretKey,
-		esp.PostmarkWebhookUser,
-		esp.PostmarkWebhookPassword,
-		esp.SocketlabsServerID,
 		esp.Weight,
-	).Scan(&esp.ESPID, &esp.CreatedAt, &esp.UpdatedAt)
+		string(meta),
+		string(limits),
+	).Scan(&esp.ESPID, &esp.CreatedAt, &esp.UpdatedAt, &esp.WeightFactor)
+	if err != nil {
+		return err
+	}
 
-	return err
+	env, err := sealCredentials(esp.ESPID, esp.Credentials)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        UPDATE email_service_providers
+        SET credentials_key_id = $1, credentials_data_key = $2,
+            credentials_ciphertext = $3
+        WHERE esp_id = $4`, env.KeyID, env.DataKey, env.Ciphertext, esp.ESPID)
+	if err != nil {
+		return fmt.Errorf("error storing credentials: %v", err)
+	}
+
+	return tx.Commit()
 }
 
+// ErrModified means a conditional update found the row changed since it was read
+var ErrModified = errors.New("resource was modified by another request")
+
+// UpdateESP replaces one of the user's ESPs. CredentialHints must already
+// reflect Credentials; see MergeCredentials.
 func UpdateESP(db *sql.DB, esp *ESP) error {
+	return updateESP(db, esp, nil)
+}
+
+// UpdateESPIfUnmodified updates the ESP only if it was last updated at
+// updatedAt, returning ErrModified otherwise
+func UpdateESPIfUnmodified(db *sql.DB, esp *ESP, updatedAt time.Time) error {
+	return updateESP(db, esp, &updatedAt)
+}
+
+func updateESP(db *sql.DB, esp *ESP, ifUpdatedAt *time.Time) error {
+	env, err := sealCredentials(esp.ESPID, esp.Credentials)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(esp.CredentialHints)
+	if err != nil {
+		return fmt.Errorf("error encoding credential hints: %v", err)
+	}
+	limits, err := json.Marshal(esp.Limits)
+	if err != nil {
+		return fmt.Errorf("error encoding send limits: %v", err)
+	}
+
 	query := `
         UPDATE email_service_providers
         SET 
-            user_id = $1,
-            provider_name = $2,
-            sending_domains = $3,
-            sendgrid_verification_key = $4,
-            sparkpost_webhook_user = $5,
-            sparkpost_webhook_password = $6,
-            socketlabs_secret_key = $7,
-            postmark_webhook_user = $8,
-            postmark_webhook_password = $9,
-            socketlabs_server_id = $10,
-            weight = $11,
+            provider_name = $1,
+            sending_domains = $2,
+            weight = $3,
+            credentials_meta = $4,
+            credentials = '{}',
+            credentials_key_id = $5,
+            credentials_data_key = $6,
+            credentials_ciphertext = $7,
+            send_limits = $11,
             updated_at = CURRENT_TIMESTAMP
-        WHERE esp_id = $12
-        RETURNING updated_at`
+        WHERE esp_id = $8 AND user_id = $9
+          AND ($10::timestamptz IS NULL OR updated_at = $10)
+        RETURNING created_at, updated_at`
 
-	err := db.QueryRow(
+	err = db.QueryRow(
 		query,
-		esp.UserID,
 		esp.ProviderName,
 		pq.Array(esp.SendingDomains),
-		esp.SendgridVerificationKey,
-		esp.SparkpostWebhookUser,
-		esp.SparkpostWebhookPassword,
-		esp.SocketlabsSecretKey,
-		esp.PostmarkWebhookUser,
-		esp.PostmarkWebhookPassword,
-		esp.SocketlabsServerID,
 		esp.Weight,
+		string(meta),
+		env.KeyID,
+		env.DataKey,
+		env.Ciphertext,
 		esp.ESPID,
-	).Scan(&esp.UpdatedAt)
+		esp.UserID,
+		ifUpdatedAt,
+		string(limits),
+	).Scan(&esp.CreatedAt, &esp.UpdatedAt)
 
 	if err != nil {
+		if err == sql.ErrNoRows && ifUpdatedAt != nil {
+			return ErrModified
+		}
 		if err == sql.ErrNoRows {
-			fmt.Printf("no ESP found with ID %v", esp.ESPID)
+			return fmt.Errorf("no ESP found with ID %d for user %d", esp.ESPID, esp.UserID)
 		}
-		fmt.Printf("error updating ESP: %v", err)
+		return fmt.Errorf("error updating ESP: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/secrets"
+)
+
+// CredentialHint describes a stored credential field without revealing it
+type CredentialHint struct {
+	Hint      string    `json:"hint"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// maskCredential keeps the last four characters of values long enough that
+// doing so doesn't give most of the value away
+func maskCredential(value string) string {
+	if len(value) < 12 {
+		return "****"
+	}
+	return "****" + value[len(value)-4:]
+}
+
+// newCredentialHints describes every set field of a credential document as
+// updated at the given time
+func newCredentialHints(creds providers.Credentials, updatedAt time.Time) map[string]CredentialHint {
+	hints := map[string]CredentialHint{}
+	for name, value := range creds {
+		if value != "" {
+			hints[name] = CredentialHint{Hint: maskCredential(value), UpdatedAt: updatedAt}
+		}
+	}
+	return hints
+}
+
+func decodeCredentialHints(meta []byte) (map[string]CredentialHint, error) {
+	hints := map[string]CredentialHint{}
+	if len(meta) == 0 {
+		return hints, nil
+	}
+	if err := json.Unmarshal(meta, &hints); err != nil {
+		return nil, fmt.Errorf("error decoding credential hints: %v", err)
+	}
+	return hints, nil
+}
+
+// MergeCredentials applies a credential update on top of the ESP's stored
+// credentials. Fields that are omitted or empty keep their stored value, so
+// clients can update one secret without resending the others.
+func (e *ESP) MergeCredentials(update providers.Credentials) {
+	if e.Credentials == nil {
+		e.Credentials = providers.Credentials{}
+	}
+	if e.CredentialHints == nil {
+		e.CredentialHints = map[string]CredentialHint{}
+	}
+
+	now := time.Now().UTC()
+	for name, value := range update {
+		if value == "" || value == e.Credentials[name] {
+			continue
+		}
+		e.Credentials[name] = value
+		e.CredentialHints[name] = CredentialHint{Hint: maskCredential(value), UpdatedAt: now}
+	}
+}
+
+// RemoveCredential deletes a stored credential field
+func (e *ESP) RemoveCredential(name string) {
+	delete(e.Credentials, name)
+	delete(e.CredentialHints, name)
+}
+
+// credentialsAAD is the additional data an ESP's credentials are sealed
+// with, so they only decrypt in that ESP's row
+func credentialsAAD(espID int) []byte {
+	return []byte(fmt.Sprintf("email_service_providers/%d/credentials", espID))
+}
+
+// sealCredentials encrypts an ESP's credential document with the configured
+// keyring
+func sealCredentials(espID int, creds providers.Credentials) (*secrets.Envelope, error) {
+	keyring, err := secrets.GetKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		creds = providers.Credentials{}
+	}
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding credentials: %v", err)
+	}
+	return keyring.Seal(data, credentialsAAD(espID))
+}
+
+// openCredentials decrypts an ESP's stored credential document. Rows without
+// a key ID haven't been encrypted yet and are read from the plaintext column.
+func openCredentials(espID int, plaintext []byte, keyID sql.NullString, dataKey, ciphertext []byte) (providers.Credentials, error) {
+	creds := providers.Credentials{}
+	if !keyID.Valid {
+		if err := json.Unmarshal(plaintext, &creds); err != nil {
+			return nil, fmt.Errorf("error decoding credentials: %v", err)
+		}
+		return creds, nil
+	}
+
+	keyring, err := secrets.GetKeyring()
+	if err != nil {
+		return nil, err
+	}
+	env := &secrets.Envelope{KeyID: keyID.String, DataKey: dataKey, Ciphertext: ciphertext}
+	data, err := keyring.Open(env, credentialsAAD(espID))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting credentials: %v", err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("error decoding credentials: %v", err)
+	}
+	return creds, nil
+}
+
+// EncryptPlaintextCredentials encrypts ESP credentials still stored in the
+// plaintext column and clears it. It returns the number of rows encrypted.
+func EncryptPlaintextCredentials(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+        SELECT esp_id, credentials, updated_at
+        FROM email_service_providers
+        WHERE credentials_key_id IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	plaintext := map[int][]byte{}
+	updatedAt := map[int]time.Time{}
+	for rows.Next() {
+		var espID int
+		var data []byte
+		var updated time.Time
+		if err := rows.Scan(&espID, &data, &updated); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintext[espID] = data
+		updatedAt[espID] = updated
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for espID, data := range plaintext {
+		creds := providers.Credentials{}
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return 0, fmt.Errorf("error decoding credentials of ESP %d: %v", espID, err)
+		}
+		env, err := sealCredentials(espID, creds)
+		if err != nil {
+			return 0, err
+		}
+		meta, err := json.Marshal(newCredentialHints(creds, updatedAt[espID]))
+		if err != nil {
+			return 0, fmt.Errorf("error encoding credential hints: %v", err)
+		}
+		_, err = db.Exec(`
+            UPDATE email_service_providers
+            SET credentials = '{}', credentials_meta = $1, credentials_ciphertext = $2,
+                credentials_data_key = $3, credentials_key_id = $4
+            WHERE esp_id = $5 AND credentials_key_id IS NULL`,
+			string(meta), env.Ciphertext, env.DataKey, env.KeyID, espID)
+		if err != nil {
+			return 0, fmt.Errorf("error encrypting credentials of ESP %d: %v", espID, err)
+		}
+	}
+
+	return len(plaintext), nil
+}
+
+// RotateCredentialKeys rewraps the data key of every ESP whose credentials
+// aren't under the active master key, and encrypts any plaintext rows. It
+// returns the number of rows updated.
+func RotateCredentialKeys(db *sql.DB) (int, error) {
+	keyring, err := secrets.GetKeyring()
+	if err != nil {
+		return 0, err
+	}
+
+	encrypted, err := EncryptPlaintextCredentials(db)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT esp_id, credentials_key_id, credentials_data_key, credentials_ciphertext
+        FROM email_service_providers
+        WHERE credentials_key_id IS NOT NULL AND credentials_key_id <> $1
+        FOR UPDATE`, keyring.ActiveKeyID())
+	if err != nil {
+		return 0, err
+	}
+
+	envelopes := map[int]*secrets.Envelope{}
+	for rows.Next() {
+		var espID int
+		env := &secrets.Envelope{}
+		if err := rows.Scan(&espID, &env.KeyID, &env.DataKey, &env.Ciphertext); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		envelopes[espID] = env
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for espID, env := range envelopes {
+		rewrapped, err := keyring.Rewrap(env, credentialsAAD(espID))
+		if err != nil {
+			return 0, fmt.Errorf("error rewrapping credentials of ESP %d: %v", espID, err)
+		}
+		_, err = tx.Exec(`
+            UPDATE email_service_providers
+            SET credentials_data_key = $1, credentials_key_id = $2
+            WHERE esp_id = $3`, rewrapped.DataKey, rewrapped.KeyID, espID)
+		if err != nil {
+			return 0, fmt.Errorf("error rewrapping credentials of ESP %d: %v", espID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return encrypted + len(envelopes), nil
+}
+
+// BackfillCredentialHints computes the hints of ESPs whose credentials were
+// encrypted before hints were stored, dating them from the ESP's last update.
+// It returns the number of rows updated.
+func BackfillCredentialHints(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+        SELECT esp_id, updated_at, credentials_key_id, credentials_data_key, credentials_ciphertext
+        FROM email_service_providers
+        WHERE credentials_key_id IS NOT NULL AND credentials_meta = '{}'`)
+	if err != nil {
+		return 0, err
+	}
+
+	hints := map[int]map[string]CredentialHint{}
+	for rows.Next() {
+		var espID int
+		var updatedAt time.Time
+		var keyID sql.NullString
+		var dataKey, ciphertext []byte
+		if err := rows.Scan(&espID, &updatedAt, &keyID, &dataKey, &ciphertext); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		creds, err := openCredentials(espID, nil, keyID, dataKey, ciphertext)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error reading credentials of ESP %d: %v", espID, err)
+		}
+		hints[espID] = newCredentialHints(creds, updatedAt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for espID, h := range hints {
+		if len(h) == 0 {
+			continue
+		}
+		meta, err := json.Marshal(h)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding credential hints: %v", err)
+		}
+		_, err = db.Exec(`
+            UPDATE email_service_providers SET credentials_meta = $1
+            WHERE esp_id = $2 AND credentials_meta = '{}'`, string(meta), espID)
+		if err != nil {
+			return 0, fmt.Errorf("error storing credential hints of ESP %d: %v", espID, err)
+		}
+		updated++
+	}
+	return updated, nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+func TestMaskCredential(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "****"},
+		{"short", "****"},
+		{"elevenchars", "****"},
+		{"SG.abcdefgh1234", "****1234"},
+	}
+	for _, tt := range tests {
+		if got := maskCredential(tt.value); got != tt.want {
+			t.Errorf("maskCredential(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewCredentialHints(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	hints := newCredentialHints(providers.Credentials{"api_key": "key-0123456789abcd", "webhook_key": ""}, now)
+
+	if len(hints) != 1 {
+		t.Fatalf("hints = %v, want only api_key", hints)
+	}
+	if hint := hints["api_key"]; hint.Hint != "****abcd" || !hint.UpdatedAt.Equal(now) {
+		t.Errorf("api_key hint = %+v", hint)
+	}
+}
+
+func TestMergeCredentials(t *testing.T) {
+	stored := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	esp := &ESP{
+		Credentials: providers.Credentials{"api_key": "key-0123456789abcd", "webhook_key": "whsec-0123456789"},
+		CredentialHints: map[string]CredentialHint{
+			"api_key":     {Hint: "****abcd", UpdatedAt: stored},
+			"webhook_key": {Hint: "****6789", UpdatedAt: stored},
+		},
+	}
+
+	esp.MergeCredentials(providers.Credentials{"api_key": "", "webhook_key": "whsec-0123456789", "domain": "mg.example.com"})
+
+	if esp.Credentials["api_key"] != "key-0123456789abcd" {
+		t.Errorf("empty update replaced api_key with %q", esp.Credentials["api_key"])
+	}
+	if !esp.CredentialHints["api_key"].UpdatedAt.Equal(stored) || !esp.CredentialHints["webhook_key"].UpdatedAt.Equal(stored) {
+		t.Errorf("unchanged fields had their hints touched: %+v", esp.CredentialHints)
+	}
+	if esp.Credentials["domain"] != "mg.example.com" {
+		t.Errorf("domain = %q, want it added", esp.Credentials["domain"])
+	}
+	if hint := esp.CredentialHints["domain"]; hint.Hint != "****.com" || !hint.UpdatedAt.After(stored) {
+		t.Errorf("domain hint = %+v", hint)
+	}
+}
+
+func TestMergeCredentialsIntoEmpty(t *testing.T) {
+	esp := &ESP{}
+	esp.MergeCredentials(providers.Credentials{"api_key": "key"})
+
+	if esp.Credentials["api_key"] != "key" || esp.CredentialHints["api_key"].Hint != "****" {
+		t.Errorf("credentials = %v, hints = %v", esp.Credentials, esp.CredentialHints)
+	}
+}
+
+func TestRemoveCredential(t *testing.T) {
+	esp := &ESP{
+		Credentials:     providers.Credentials{"api_key": "key", "domain": "mg.example.com"},
+		CredentialHints: map[string]CredentialHint{"api_key": {Hint: "****"}, "domain": {Hint: "****.com"}},
+	}
+	esp.RemoveCredential("api_key")
+
+	if _, ok := esp.Credentials["api_key"]; ok {
+		t.Error("api_key still stored")
+	}
+	if _, ok := esp.CredentialHints["api_key"]; ok {
+		t.Error("api_key hint still stored")
+	}
+	if esp.Credentials["domain"] != "mg.example.com" {
+		t.Error("domain was removed too")
+	}
+}
@@ -0,0 +1,244 @@
+// models/esp_limits.go
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Usage periods
+const (
+	UsagePeriodDay   = "day"
+	UsagePeriodMonth = "month"
+)
+
+// SendLimit restricts how fast and how much an ESP sends. Zero values are
+// unlimited.
+type SendLimit struct {
+	// Token bucket refill rate and size
+	RatePerSecond float64 `json:"rate_per_second,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+	// Messages per UTC day and calendar month
+	DailyCap   int `json:"daily_cap,omitempty"`
+	MonthlyCap int `json:"monthly_cap,omitempty"`
+}
+
+// SendLimits are an ESP's limits as a whole plus limits for individual
+// sending domains, which apply on top of them
+type SendLimits struct {
+	SendLimit
+	Domains map[string]SendLimit `json:"domains,omitempty"`
+}
+
+// ForDomain returns the limits of a sending domain, ignoring case
+func (l SendLimits) ForDomain(domain string) (SendLimit, bool) {
+	for d, limit := range l.Domains {
+		if strings.EqualFold(d, domain) {
+			return limit, true
+		}
+	}
+	return SendLimit{}, false
+}
+
+// WithDomainDailyCap returns a copy of the limits whose daily cap for the
+// domain is at most dailyCap
+func (l SendLimits) WithDomainDailyCap(domain string, dailyCap int) SendLimits {
+	limit, _ := l.ForDomain(domain)
+	if limit.DailyCap == 0 || dailyCap < limit.DailyCap {
+		limit.DailyCap = dailyCap
+	}
+
+	domains := map[string]SendLimit{}
+	for d, dl := range l.Domains {
+		if !strings.EqualFold(d, domain) {
+			domains[d] = dl
+		}
+	}
+	domains[strings.ToLower(domain)] = limit
+	return SendLimits{SendLimit: l.SendLimit, Domains: domains}
+}
+
+// Validate checks the limits are non-negative and only name domains the
+// ESP sends for
+func (l SendLimits) Validate(sendingDomains []string) error {
+	if err := l.SendLimit.validate(); err != nil {
+		return err
+	}
+	for domain, limit := range l.Domains {
+		if !containsFold(sendingDomains, domain) {
+			return fmt.Errorf("limits for %s, which is not a sending domain of the ESP", domain)
+		}
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("%s: %v", domain, err)
+		}
+	}
+	return nil
+}
+
+func (l SendLimit) validate() error {
+	if l.RatePerSecond < 0 || l.Burst < 0 || l.DailyCap < 0 || l.MonthlyCap < 0 {
+		return fmt.Errorf("send limits must not be negative")
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsageCount is the number of messages sent in the current periods
+type UsageCount struct {
+	Today     int `json:"today"`
+	ThisMonth int `json:"this_month"`
+}
+
+// SendUsage is an ESP's usage as a whole and per sending domain
+type SendUsage struct {
+	UsageCount
+	Domains map[string]UsageCount `json:"domains,omitempty"`
+}
+
+// usagePeriods returns the start of the UTC day and month containing now
+func usagePeriods(now time.Time) (day, month time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
+
+// ReserveSendUsage counts one message against the ESP's and the sending
+// domain's daily and monthly usage. It returns false, counting nothing, if
+// that would exceed any of their caps.
+func ReserveSendUsage(db *sql.DB, esp *ESP, domain string, now time.Time) (bool, error) {
+	domain = strings.ToLower(domain)
+	domainLimit, _ := esp.Limits.ForDomain(domain)
+	day, month := usagePeriods(now)
+
+	type counter struct {
+		domain string
+		period string
+		start  time.Time
+		cap    int
+	}
+	counters := []counter{
+		{"", UsagePeriodDay, day, esp.Limits.DailyCap},
+		{"", UsagePeriodMonth, month, esp.Limits.MonthlyCap},
+	}
+	if domain != "" {
+		counters = append(counters,
+			counter{domain, UsagePeriodDay, day, domainLimit.DailyCap},
+			counter{domain, UsagePeriodMonth, month, domainLimit.MonthlyCap})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO esp_send_usage (esp_id, sending_domain, period, period_start, count)
+        VALUES ($1, $2, $3, $4, 1)
+        ON CONFLICT (esp_id, sending_domain, period, period_start)
+        DO UPDATE SET count = esp_send_usage.count + 1
+        WHERE $5 = 0 OR esp_send_usage.count < $5
+        RETURNING count`
+
+	for _, c := range counters {
+		var count int
+		err := tx.QueryRow(query, esp.ESPID, c.domain, c.period, c.start, c.cap).Scan(&count)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error reserving send usage: %v", err)
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// ReleaseSendUsage gives back a message counted by ReserveSendUsage that
+// wasn't sent after all
+func ReleaseSendUsage(db *sql.DB, espID int, domain string, now time.Time) error {
+	day, month := usagePeriods(now)
+	query := `
+        UPDATE esp_send_usage
+        SET count = GREATEST(count - 1, 0)
+        WHERE esp_id = $1 AND sending_domain IN ('', $2)
+          AND ((period = 'day' AND period_start = $3) OR (period = 'month' AND period_start = $4))`
+
+	_, err := db.Exec(query, espID, strings.ToLower(domain), day, month)
+	return err
+}
+
+// GetESPSendUsage returns the current day's and month's usage of the given
+// ESPs, by ESP ID
+func GetESPSendUsage(db *sql.DB, espIDs []int, now time.Time) (map[int]*SendUsage, error) {
+	day, month := usagePeriods(now)
+	query := `
+        SELECT esp_id, sending_domain, period, count
+        FROM esp_send_usage
+        WHERE esp_id = ANY($1)
+          AND ((period = 'day' AND period_start = $2) OR (period = 'month' AND period_start = $3))`
+
+	rows, err := db.Query(query, pq.Array(espIDs), day, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[int]*SendUsage{}
+	for _, id := range espIDs {
+		usage[id] = &SendUsage{}
+	}
+	for rows.Next() {
+		var espID, count int
+		var domain, period string
+		if err := rows.Scan(&espID, &domain, &period, &count); err != nil {
+			return nil, err
+		}
+
+		u := usage[espID]
+		counts := u.UsageCount
+		if domain != "" {
+			if u.Domains == nil {
+				u.Domains = map[string]UsageCount{}
+			}
+			counts = u.Domains[domain]
+		}
+		if period == UsagePeriodDay {
+			counts.Today = count
+		} else {
+			counts.ThisMonth = count
+		}
+		if domain != "" {
+			u.Domains[domain] = counts
+		} else {
+			u.UsageCount = counts
+		}
+	}
+	return usage, rows.Err()
+}
+
+// decodeSendLimits reads the send_limits column
+func decodeSendLimits(data []byte) (SendLimits, error) {
+	var limits SendLimits
+	if len(data) == 0 {
+		return limits, nil
+	}
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return limits, fmt.Errorf("error decoding send limits: %v", err)
+	}
+	return limits, nil
+}
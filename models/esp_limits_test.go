@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendLimitsForDomain(t *testing.T) {
+	limits := SendLimits{Domains: map[string]SendLimit{"mail.example.com": {DailyCap: 100}}}
+
+	if limit, ok := limits.ForDomain("Mail.Example.COM"); !ok || limit.DailyCap != 100 {
+		t.Errorf("ForDomain ignoring case = %+v, %v", limit, ok)
+	}
+	if limit, ok := limits.ForDomain("other.example.com"); ok || limit != (SendLimit{}) {
+		t.Errorf("ForDomain for unlimited domain = %+v, %v", limit, ok)
+	}
+}
+
+func TestSendLimitsValidate(t *testing.T) {
+	domains := []string{"mail.example.com"}
+	tests := []struct {
+		name    string
+		limits  SendLimits
+		wantErr bool
+	}{
+		{"unlimited", SendLimits{}, false},
+		{"esp and domain limits", SendLimits{
+			SendLimit: SendLimit{RatePerSecond: 10, Burst: 20, DailyCap: 1000, MonthlyCap: 20000},
+			Domains:   map[string]SendLimit{"MAIL.example.com": {DailyCap: 100}},
+		}, false},
+		{"negative rate", SendLimits{SendLimit: SendLimit{RatePerSecond: -1}}, true},
+		{"negative monthly cap", SendLimits{SendLimit: SendLimit{MonthlyCap: -1}}, true},
+		{"negative domain cap", SendLimits{Domains: map[string]SendLimit{"mail.example.com": {DailyCap: -5}}}, true},
+		{"unknown domain", SendLimits{Domains: map[string]SendLimit{"other.example.com": {DailyCap: 5}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Validate(domains)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUsagePeriods(t *testing.T) {
+	// 23:30 on the 31st in UTC-5 is already the 1st of the next month in UTC
+	now := time.Date(2024, 1, 31, 23, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+	day, month := usagePeriods(now)
+
+	if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !day.Equal(want) {
+		t.Errorf("day = %v, want %v", day, want)
+	}
+	if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !month.Equal(want) {
+		t.Errorf("month = %v, want %v", month, want)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/nzenitram/relay-esp/providers"
 )
 
 type Event struct {
@@ -28,6 +30,15 @@ type Event struct {
 	Dropped          bool            `json:"dropped"`
 	DroppedTime      sql.NullInt64   `json:"dropped_time"`
 	DroppedReason    sql.NullString  `json:"dropped_reason"`
+	UniqueClick      bool            `json:"unique_click"`
+	UniqueClickTime  sql.NullInt64   `json:"unique_click_time"`
+	Click            bool            `json:"click"`
+	ClickCount       int             `json:"click_count"`
+	LastClickTime    sql.NullInt64   `json:"last_click_time"`
+	SpamReport       bool            `json:"spam_report"`
+	SpamReportTime   sql.NullInt64   `json:"spam_report_time"`
+	Unsubscribe      bool            `json:"unsubscribe"`
+	UnsubscribeTime  sql.NullInt64   `json:"unsubscribe_time"`
 	Provider         string          `json:"provider"`
 	Metadata         json.RawMessage `json:"metadata"`
 }
@@ -44,6 +55,10 @@ func (e Event) MarshalJSON() ([]byte, error) {
 		LastOpenTime     *int64  `json:"last_open_time"`
 		DroppedTime      *int64  `json:"dropped_time"`
 		DroppedReason    *string `json:"dropped_reason"`
+		UniqueClickTime  *int64  `json:"unique_click_time"`
+		LastClickTime    *int64  `json:"last_click_time"`
+		SpamReportTime   *int64  `json:"spam_report_time"`
+		UnsubscribeTime  *int64  `json:"unsubscribe_time"`
 		Alias
 	}{
 		ProcessedTime:    nullInt64ToPtr(e.ProcessedTime),
@@ -55,6 +70,10 @@ func (e Event) MarshalJSON() ([]byte, error) {
 		LastOpenTime:     nullInt64ToPtr(e.LastOpenTime),
 		DroppedTime:      nullInt64ToPtr(e.DroppedTime),
 		DroppedReason:    nullStringToPtr(e.DroppedReason),
+		UniqueClickTime:  nullInt64ToPtr(e.UniqueClickTime),
+		LastClickTime:    nullInt64ToPtr(e.LastClickTime),
+		SpamReportTime:   nullInt64ToPtr(e.SpamReportTime),
+		UnsubscribeTime:  nullInt64ToPtr(e.UnsubscribeTime),
 		Alias:            (Alias)(e),
 	})
 }
@@ -73,9 +92,36 @@ func nullStringToPtr(s sql.NullString) *string {
 	return nil
 }
 
+// eventColumns lists the events columns in the order scanEvent expects them
+const eventColumns = `
+        e.id, e.message_id, e.processed, e.processed_time, e.delivered, e.delivered_time,
+        e.bounce, e.bounce_type, e.bounce_time, e.deferred, e.deferred_count, e.last_deferral_time,
+        e.unique_open, e.unique_open_time, e.open, e.open_count, e.last_open_time,
+        e.dropped, e.dropped_time, e.dropped_reason,
+        e.unique_click, e.unique_click_time, e.click, e.click_count, e.last_click_time,
+        e.spam_report, e.spam_report_time, e.unsubscribe, e.unsubscribe_time,
+        e.provider, e.metadata`
+
+func scanEvent(rows *sql.Rows) (*Event, error) {
+	var e Event
+	err := rows.Scan(
+		&e.ID, &e.MessageID, &e.Processed, &e.ProcessedTime, &e.Delivered, &e.DeliveredTime,
+		&e.Bounce, &e.BounceType, &e.BounceTime, &e.Deferred, &e.DeferredCount, &e.LastDeferralTime,
+		&e.UniqueOpen, &e.UniqueOpenTime, &e.Open, &e.OpenCount, &e.LastOpenTime,
+		&e.Dropped, &e.DroppedTime, &e.DroppedReason,
+		&e.UniqueClick, &e.UniqueClickTime, &e.Click, &e.ClickCount, &e.LastClickTime,
+		&e.SpamReport, &e.SpamReportTime, &e.Unsubscribe, &e.UnsubscribeTime,
+		&e.Provider, &e.Metadata,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
 func GetEventsByUserID(db *sql.DB, userID int, limit, offset int) ([]Event, error) {
 	query := `
-        SELECT e.* 
+        SELECT ` + eventColumns + `
         FROM events e
         JOIN message_user_associations mua ON e.message_id = mua.message_id
         WHERE mua.user_id = $1
@@ -90,24 +136,33 @@ func GetEventsByUserID(db *sql.DB, userID int, limit, offset int) ([]Event, erro
 
 	var events []Event
 	for rows.Next() {
-		var e Event
-		err := rows.Scan(
-			&e.ID, &e.MessageID, &e.Processed, &e.ProcessedTime, &e.Delivered, &e.DeliveredTime,
-			&e.Bounce, &e.BounceType, &e.BounceTime, &e.Deferred, &e.DeferredCount, &e.LastDeferralTime,
-			&e.UniqueOpen, &e.UniqueOpenTime, &e.Open, &e.OpenCount, &e.LastOpenTime,
-			&e.Dropped, &e.DroppedTime, &e.DroppedReason, &e.Provider, &e.Metadata,
-		)
+		e, err := scanEvent(rows)
 		if err != nil {
 			return nil, err
 		}
-		events = append(events, e)
+		events = append(events, *e)
 	}
 	return events, nil
 }
 
+// eventFlags maps each event type to its boolean column on the events table
+var eventFlags = map[providers.EventType]string{
+	providers.EventProcessed:   "processed",
+	providers.EventDelivered:   "delivered",
+	providers.EventBounce:      "bounce",
+	providers.EventDeferred:    "deferred",
+	providers.EventUniqueOpen:  "unique_open",
+	providers.EventOpen:        "open",
+	providers.EventDropped:     "dropped",
+	providers.EventUniqueClick: "unique_click",
+	providers.EventClick:       "click",
+	providers.EventSpamReport:  "spam_report",
+	providers.EventUnsubscribe: "unsubscribe",
+}
+
 func GetEventsByTypeAndUserID(db *sql.DB, userID int, eventType string, limit, offset int) ([]Event, error) {
 	query := `
-        SELECT e.* 
+        SELECT ` + eventColumns + `
         FROM events e
         JOIN message_user_associations mua ON e.message_id = mua.message_id
         WHERE mua.user_id = $1 AND %s
@@ -115,25 +170,11 @@ func GetEventsByTypeAndUserID(db *sql.DB, userID int, eventType string, limit, o
         LIMIT $2 OFFSET $3
     `
 
-	var condition string
-	switch eventType {
-	case "delivered":
-		condition = "e.delivered = true"
-	case "bounce":
-		condition = "e.bounce = true"
-	case "deferred":
-		condition = "e.deferred = true"
-	case "open":
-		condition = "e.open = true"
-	case "dropped":
-		condition = "e.dropped = true"
-	case "processed":
-		condition = "e.processed = true"
-	case "unique_open":
-		condition = "e.unique_open = true"
-	default:
+	flag, ok := eventFlags[providers.EventType(eventType)]
+	if !ok {
 		return nil, fmt.Errorf("invalid event type")
 	}
+	condition := "e." + flag + " = true"
 
 	query = fmt.Sprintf(query, condition)
 	rows, err := db.Query(query, userID, limit, offset)
@@ -144,68 +185,30 @@ func GetEventsByTypeAndUserID(db *sql.DB, userID int, eventType string, limit, o
 
 	var events []Event
 	for rows.Next() {
-		var e Event
-		err := rows.Scan(
-			&e.ID, &e.MessageID, &e.Processed, &e.ProcessedTime, &e.Delivered, &e.DeliveredTime,
-			&e.Bounce, &e.BounceType, &e.BounceTime, &e.Deferred, &e.DeferredCount, &e.LastDeferralTime,
-			&e.UniqueOpen, &e.UniqueOpenTime, &e.Open, &e.OpenCount, &e.LastOpenTime,
-			&e.Dropped, &e.DroppedTime, &e.DroppedReason, &e.Provider, &e.Metadata,
-		)
+		e, err := scanEvent(rows)
 		if err != nil {
 			return nil, err
 		}
-		events = append(events, e)
+		events = append(events, *e)
 	}
 	return events, nil
 }
 
-func GetAvailableEventTypes(db *sql.DB) ([]string, error) {
-	query := `
-        SELECT 'processed' AS event_type
-        UNION ALL
-        SELECT 'delivered'
-        UNION ALL
-        SELECT 'bounce'
-        UNION ALL
-        SELECT 'deferred'
-        UNION ALL
-        SELECT 'unique_open'
-        UNION ALL
-        SELECT 'open'
-        UNION ALL
-        SELECT 'dropped'
-        ORDER BY event_type
-    `
-
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var eventTypes []string
-	for rows.Next() {
-		var eventType string
-		if err := rows.Scan(&eventType); err != nil {
-			return nil, err
-		}
-		eventTypes = append(eventTypes, eventType)
-	}
-
-	return eventTypes, nil
-}
-
 type EventStats struct {
-	TimeBucket      time.Time
-	Provider        string
-	TotalEvents     int
-	ProcessedCount  int
-	DeliveredCount  int
-	BounceCount     int
-	DeferredCount   int
-	UniqueOpenCount int
-	OpenCount       int
-	DroppedCount    int
+	TimeBucket       time.Time
+	Provider         string
+	TotalEvents      int
+	ProcessedCount   int
+	DeliveredCount   int
+	BounceCount      int
+	DeferredCount    int
+	UniqueOpenCount  int
+	OpenCount        int
+	DroppedCount     int
+	UniqueClickCount int
+	ClickCount       int
+	SpamReportCount  int
+	UnsubscribeCount int
 }
 
 func GetUserEventStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]EventStats, error) {
@@ -217,11 +220,13 @@ func GetUserEventStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]
             CASE
                 WHEN COALESCE(e.processed_time, e.delivered_time, e.bounce_time,
                               e.last_deferral_time, e.unique_open_time, e.last_open_time,
-                              e.dropped_time) BETWEEN $2 AND $3
+                              e.dropped_time, e.last_click_time, e.spam_report_time,
+                              e.unsubscribe_time) BETWEEN $2 AND $3
                 THEN date_trunc('hour', to_timestamp(
                     COALESCE(e.processed_time, e.delivered_time, e.bounce_time,
                              e.last_deferral_time, e.unique_open_time, e.last_open_time,
-                             e.dropped_time, 0)
+                             e.dropped_time, e.last_click_time, e.spam_report_time,
+                             e.unsubscribe_time, 0)
                 ))
                 ELSE NULL
             END AS time_bucket,
@@ -232,7 +237,11 @@ func GetUserEventStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]
             e.deferred,
             e.unique_open,
             e.open,
-            e.dropped
+            e.dropped,
+            e.unique_click,
+            e.click,
+            e.spam_report,
+            e.unsubscribe
         FROM events e
         JOIN message_user_associations mua ON e.message_id = mua.message_id
         WHERE mua.user_id = $1
@@ -247,7 +256,11 @@ func GetUserEventStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]
         SUM(CASE WHEN deferred THEN 1 ELSE 0 END) AS deferred_count,
         SUM(CASE WHEN unique_open THEN 1 ELSE 0 END) AS unique_open_count,
         SUM(CASE WHEN open THEN 1 ELSE 0 END) AS open_count,
-        SUM(CASE WHEN dropped THEN 1 ELSE 0 END) AS dropped_count
+        SUM(CASE WHEN dropped THEN 1 ELSE 0 END) AS dropped_count,
+        SUM(CASE WHEN unique_click THEN 1 ELSE 0 END) AS unique_click_count,
+        SUM(CASE WHEN click THEN 1 ELSE 0 END) AS click_count,
+        SUM(CASE WHEN spam_report THEN 1 ELSE 0 END) AS spam_report_count,
+        SUM(CASE WHEN unsubscribe THEN 1 ELSE 0 END) AS unsubscribe_count
     FROM event_times
     WHERE time_bucket IS NOT NULL
     GROUP BY time_bucket, provider
@@ -273,6 +286,10 @@ func GetUserEventStats(db *sql.DB, userID int, startTime, endTime time.Time) ([]
 			&s.UniqueOpenCount,
 			&s.OpenCount,
 			&s.DroppedCount,
+			&s.UniqueClickCount,
+			&s.ClickCount,
+			&s.SpamReportCount,
+			&s.UnsubscribeCount,
 		)
 		if err != nil {
 			return nil, err
@@ -298,6 +315,9 @@ func GetProviderEventStats(db *sql.DB, userID int, providerName string, startTim
             e.unique_open_time,
             e.last_open_time,
             e.dropped_time,
+            e.last_click_time,
+            e.spam_report_time,
+            e.unsubscribe_time,
             0
         ))) AS time_bucket,
         e.provider,
@@ -308,7 +328,11 @@ func GetProviderEventStats(db *sql.DB, userID int, providerName string, startTim
         SUM(CASE WHEN e.deferred THEN 1 ELSE 0 END) AS deferred_count,
         SUM(CASE WHEN e.unique_open THEN 1 ELSE 0 END) AS unique_open_count,
         SUM(CASE WHEN e.open THEN 1 ELSE 0 END) AS open_count,
-        SUM(CASE WHEN e.dropped THEN 1 ELSE 0 END) AS dropped_count
+        SUM(CASE WHEN e.dropped THEN 1 ELSE 0 END) AS dropped_count,
+        SUM(CASE WHEN e.unique_click THEN 1 ELSE 0 END) AS unique_click_count,
+        SUM(CASE WHEN e.click THEN 1 ELSE 0 END) AS click_count,
+        SUM(CASE WHEN e.spam_report THEN 1 ELSE 0 END) AS spam_report_count,
+        SUM(CASE WHEN e.unsubscribe THEN 1 ELSE 0 END) AS unsubscribe_count
     FROM 
         events e
     JOIN 
@@ -326,6 +350,9 @@ func GetProviderEventStats(db *sql.DB, userID int, providerName string, startTim
             e.unique_open_time,
             e.last_open_time,
             e.dropped_time,
+            e.last_click_time,
+            e.spam_report_time,
+            e.unsubscribe_time,
             0
         ) BETWEEN $3 AND $4
     GROUP BY 
@@ -354,6 +381,10 @@ func GetProviderEventStats(db *sql.DB, userID int, providerName string, startTim
 			&s.UniqueOpenCount,
 			&s.OpenCount,
 			&s.DroppedCount,
+			&s.UniqueClickCount,
+			&s.ClickCount,
+			&s.SpamReportCount,
+			&s.UnsubscribeCount,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("row scan error: %v", err)
@@ -368,6 +399,26 @@ func GetProviderEventStats(db *sql.DB, userID int, providerName string, startTim
 	return stats, nil
 }
 
+// eventTables maps each event type to the time-series table it is recorded in
+var eventTables = map[providers.EventType]string{
+	providers.EventProcessed:   "processed_events",
+	providers.EventDelivered:   "delivered_events",
+	providers.EventBounce:      "bounce_events",
+	providers.EventDeferred:    "deferred_events",
+	providers.EventOpen:        "open_events",
+	providers.EventDropped:     "dropped_events",
+	providers.EventClick:       "click_events",
+	providers.EventUniqueClick: "unique_click_events",
+	providers.EventSpamReport:  "spam_report_events",
+	providers.EventUnsubscribe: "unsubscribe_events",
+}
+
+// EventTable returns the time-series table an event type is recorded in
+func EventTable(eventType string) (string, bool) {
+	tableName, ok := eventTables[providers.EventType(eventType)]
+	return tableName, ok
+}
+
 type ProviderEventStats struct {
 	Provider string    `json:"provider"`
 	Event    string    `json:"event"`
@@ -375,17 +426,7 @@ type ProviderEventStats struct {
 }
 
 func GetProviderEventStatsByType(db *sql.DB, userID int, providerName, eventType string, startTime, endTime time.Time, timeBucket string) (map[string]interface{}, error) {
-	// Define the event types and their corresponding tables
-	eventTables := map[string]string{
-		"processed": "processed_events",
-		"delivered": "delivered_events",
-		"bounce":    "bounce_events",
-		"deferred":  "deferred_events",
-		"open":      "open_events",
-		"dropped":   "dropped_events",
-	}
-
-	tableName, ok := eventTables[eventType]
+	tableName, ok := EventTable(eventType)
 	if !ok {
 		return nil, fmt.Errorf("invalid event type: %s", eventType)
 	}
@@ -436,3 +477,135 @@ func GetProviderEventStatsByType(db *sql.DB, userID int, providerName, eventType
 
 	return result, nil
 }
+
+// LinkClickStats are the clicks on a single URL within a time bucket
+type LinkClickStats struct {
+	TimeBucket       time.Time `json:"time_bucket"`
+	Provider         string    `json:"provider"`
+	URL              string    `json:"url"`
+	Clicks           int       `json:"clicks"`
+	UniqueClicks     int       `json:"unique_clicks"`
+	Delivered        int       `json:"delivered"`
+	ClickThroughRate float64   `json:"click_through_rate"`
+}
+
+// EventRateStats are a provider's count of one event type within a time
+// bucket, relative to the messages delivered in that bucket
+type EventRateStats struct {
+	TimeBucket time.Time `json:"time_bucket"`
+	Provider   string    `json:"provider"`
+	Event      string    `json:"event"`
+	Count      int       `json:"count"`
+	Delivered  int       `json:"delivered"`
+	Rate       float64   `json:"rate"`
+}
+
+// deliveredRate divides a count of messages by the messages delivered in the
+// same bucket. Engagement and complaints trail deliveries, so rates in the
+// most recent buckets run high until deliveries catch up.
+func deliveredRate(count, delivered int) float64 {
+	if delivered == 0 {
+		return 0
+	}
+	return float64(count) / float64(delivered)
+}
+
+func GetLinkClickStats(db *sql.DB, userID int, providerName string, startTime, endTime time.Time, timeBucket string) ([]LinkClickStats, error) {
+	query := `
+    WITH clicks AS (
+        SELECT time_bucket($1, time) AS bucket, provider, url,
+               COUNT(*) AS clicks,
+               COUNT(DISTINCT message_id) AS unique_clicks
+        FROM click_events
+        WHERE user_id = $2 AND provider = $3 AND time BETWEEN $4 AND $5
+        GROUP BY 1, 2, 3
+    ), delivered AS (
+        SELECT time_bucket($1, time) AS bucket, provider,
+               COUNT(DISTINCT message_id) AS delivered
+        FROM delivered_events
+        WHERE user_id = $2 AND provider = $3 AND time BETWEEN $4 AND $5
+        GROUP BY 1, 2
+    )
+    SELECT c.bucket, c.provider, c.url, c.clicks, c.unique_clicks, COALESCE(d.delivered, 0)
+    FROM clicks c
+    LEFT JOIN delivered d ON d.bucket = c.bucket AND d.provider = c.provider
+    ORDER BY c.bucket, c.clicks DESC, c.url
+    `
+
+	rows, err := db.Query(query, timeBucket, userID, providerName, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []LinkClickStats{}
+	for rows.Next() {
+		var s LinkClickStats
+		err := rows.Scan(&s.TimeBucket, &s.Provider, &s.URL, &s.Clicks, &s.UniqueClicks, &s.Delivered)
+		if err != nil {
+			return nil, fmt.Errorf("row scan error: %v", err)
+		}
+		s.ClickThroughRate = deliveredRate(s.UniqueClicks, s.Delivered)
+		stats = append(stats, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return stats, nil
+}
+
+// GetEventRateStats returns, per time bucket, how many delivered messages
+// went on to have the given event, e.g. unique_click for click-through rate
+// or spam_report for complaint rate.
+func GetEventRateStats(db *sql.DB, userID int, providerName, eventType string, startTime, endTime time.Time, timeBucket string) ([]EventRateStats, error) {
+	tableName, ok := EventTable(eventType)
+	if !ok {
+		return nil, fmt.Errorf("invalid event type: %s", eventType)
+	}
+
+	query := fmt.Sprintf(`
+    WITH counted AS (
+        SELECT time_bucket($1, time) AS bucket, provider,
+               COUNT(DISTINCT message_id) AS count
+        FROM %s
+        WHERE user_id = $2 AND provider = $3 AND time BETWEEN $4 AND $5
+        GROUP BY 1, 2
+    ), delivered AS (
+        SELECT time_bucket($1, time) AS bucket, provider,
+               COUNT(DISTINCT message_id) AS delivered
+        FROM delivered_events
+        WHERE user_id = $2 AND provider = $3 AND time BETWEEN $4 AND $5
+        GROUP BY 1, 2
+    )
+    SELECT COALESCE(c.bucket, d.bucket), COALESCE(c.provider, d.provider),
+           COALESCE(c.count, 0), COALESCE(d.delivered, 0)
+    FROM counted c
+    FULL OUTER JOIN delivered d ON d.bucket = c.bucket AND d.provider = c.provider
+    ORDER BY 1
+    `, tableName)
+
+	rows, err := db.Query(query, timeBucket, userID, providerName, startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("query error for %s: %v", eventType, err)
+	}
+	defer rows.Close()
+
+	stats := []EventRateStats{}
+	for rows.Next() {
+		s := EventRateStats{Event: eventType}
+		err := rows.Scan(&s.TimeBucket, &s.Provider, &s.Count, &s.Delivered)
+		if err != nil {
+			return nil, fmt.Errorf("row scan error for %s: %v", eventType, err)
+		}
+		s.Rate = deliveredRate(s.Count, s.Delivered)
+		stats = append(stats, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error for %s: %v", eventType, err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,358 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+// ProviderEvent is a normalized webhook event together with the ESP it was
+// received for.
+type ProviderEvent struct {
+	providers.NormalizedEvent
+	UserID   int    `json:"user_id"`
+	ESPID    int    `json:"esp_id"`
+	Provider string `json:"provider"`
+	// Request the event was parsed from, shared by the events of a request
+	// and spilled separately from them
+	Source *WebhookSource `json:"-"`
+}
+
+// eventRollups holds the SET clause that folds a batch of one event type into
+// the rolled-up events rows. s is the batch aggregated per message, with the
+// first and last event times, the number of events and the latest detail
+// (bounce type or reason).
+var eventRollups = map[providers.EventType]string{
+	providers.EventProcessed: "processed = true, processed_time = s.last_time",
+	providers.EventDelivered: "delivered = true, delivered_time = s.last_time",
+	providers.EventBounce:    "bounce = true, bounce_time = s.last_time, bounce_type = s.detail",
+	providers.EventDeferred:  "deferred = true, deferred_count = deferred_count + s.n, last_deferral_time = s.last_time",
+	providers.EventOpen: `open = true, open_count = open_count + s.n, last_open_time = s.last_time,
+	         unique_open = true, unique_open_time = COALESCE(unique_open_time, s.first_time)`,
+	providers.EventDropped: "dropped = true, dropped_time = s.last_time, dropped_reason = s.detail",
+	providers.EventClick: `click = true, click_count = click_count + s.n, last_click_time = s.last_time,
+	         unique_click = true, unique_click_time = COALESCE(unique_click_time, s.first_time)`,
+	providers.EventSpamReport:  "spam_report = true, spam_report_time = s.last_time",
+	providers.EventUnsubscribe: "unsubscribe = true, unsubscribe_time = s.last_time",
+}
+
+// DedupeWindows holds how long each provider's event IDs are remembered.
+// A retry arriving after the window is recorded again.
+type DedupeWindows struct {
+	Default     time.Duration
+	PerProvider map[string]time.Duration
+}
+
+// For returns the dedupe window for a provider
+func (d DedupeWindows) For(provider string) time.Duration {
+	if window, ok := d.PerProvider[provider]; ok {
+		return window
+	}
+	return d.Default
+}
+
+// RecordEventBatch folds provider events into the rolled-up events rows,
+// appends them to each message's history and the per-type time-series
+// tables, and makes sure each message is associated with the ESP's user, all
+// in one transaction. Events whose provider event ID was already recorded
+// within the dedupe window are dropped and returned as duplicates.
+func RecordEventBatch(db *sql.DB, events []*ProviderEvent, windows DedupeWindows) ([]*ProviderEvent, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	duplicates, err := recordEventBatch(tx, events, windows)
+	if err != nil {
+		return nil, err
+	}
+
+	return duplicates, tx.Commit()
+}
+
+// recordEventBatch writes a batch inside an existing transaction. The
+// append-only tables are written with COPY; the events rows, which have to
+// be upserted, are updated from a COPY'd staging table.
+func recordEventBatch(tx *sql.Tx, events []*ProviderEvent, windows DedupeWindows) ([]*ProviderEvent, error) {
+	for _, pe := range events {
+		if _, ok := eventRollups[pe.Type]; !ok {
+			return nil, fmt.Errorf("invalid event type: %s", pe.Type)
+		}
+	}
+
+	_, err := tx.Exec(`
+        CREATE TEMP TABLE event_staging (
+            seq          INTEGER,
+            event_id     TEXT,
+            dedupe_until TIMESTAMPTZ,
+            message_id TEXT,
+            user_id    INTEGER,
+            esp_id     INTEGER,
+            provider   TEXT,
+            event_type TEXT,
+            event_time BIGINT,
+            detail     TEXT,
+            payload    JSONB
+        ) ON COMMIT DROP`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging table: %v", err)
+	}
+
+	now := time.Now()
+	err = copyRows(tx, "event_staging",
+		[]string{"seq", "event_id", "dedupe_until", "message_id", "user_id", "esp_id", "provider",
+			"event_type", "event_time", "detail", "payload"},
+		events, func(i int, pe *ProviderEvent) []interface{} {
+			detail := pe.Reason
+			if pe.Type == providers.EventBounce {
+				detail = pe.BounceType
+			}
+			return []interface{}{i, providerEventID(pe), now.Add(windows.For(pe.Provider)),
+				pe.MessageID, pe.UserID, pe.ESPID, pe.Provider, string(pe.Type),
+				pe.Timestamp.Unix(), nullIfEmpty(detail), string(eventPayload(pe))}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	events, duplicates, err := dropDuplicateEvents(tx, events)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return duplicates, nil
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO message_user_associations (message_id, user_id, esp_id)
+        SELECT DISTINCT message_id, user_id, esp_id FROM event_staging
+        ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return nil, fmt.Errorf("error associating messages: %v", err)
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO events (
+            message_id, processed, delivered, bounce, deferred, deferred_count,
+            unique_open, open, open_count, dropped, provider, metadata
+        )
+        SELECT DISTINCT ON (message_id)
+               message_id, false, false, false, false, 0, false, false, 0, false, provider, payload
+        FROM event_staging
+        ORDER BY message_id, event_time
+        ON CONFLICT (message_id) DO NOTHING`)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting events: %v", err)
+	}
+
+	// The first click on a message also counts as its unique click. This has
+	// to run before the click counts below are updated.
+	_, err = tx.Exec(fmt.Sprintf(`
+        INSERT INTO %s (time, user_id, provider, message_id)
+        SELECT DISTINCT ON (s.message_id) to_timestamp(s.event_time), s.user_id, s.provider, s.message_id
+        FROM event_staging s
+        JOIN events e ON e.message_id = s.message_id
+        WHERE s.event_type = $1 AND e.click_count = 0
+        ORDER BY s.message_id, s.event_time`, eventTables[providers.EventUniqueClick]),
+		string(providers.EventClick))
+	if err != nil {
+		return nil, fmt.Errorf("error inserting unique clicks: %v", err)
+	}
+
+	for eventType, rollup := range eventRollups {
+		if !hasEventType(events, eventType) {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf(`
+            UPDATE events SET %s
+            FROM (
+                SELECT message_id,
+                       MIN(event_time) AS first_time,
+                       MAX(event_time) AS last_time,
+                       COUNT(*) AS n,
+                       (array_agg(detail ORDER BY event_time DESC))[1] AS detail
+                FROM event_staging
+                WHERE event_type = $1
+                GROUP BY message_id
+            ) s
+            WHERE events.message_id = s.message_id`, rollup), string(eventType))
+		if err != nil {
+			return nil, fmt.Errorf("error updating %s events: %v", eventType, err)
+		}
+	}
+
+	err = copyRows(tx, "message_events",
+		[]string{"message_id", "user_id", "esp_id", "provider", "event_type", "event_time",
+			"recipient", "reason", "bounce_type", "url", "payload"},
+		events, func(_ int, pe *ProviderEvent) []interface{} {
+			return []interface{}{pe.MessageID, pe.UserID, pe.ESPID, pe.Provider, string(pe.Type), pe.Timestamp,
+				nullIfEmpty(pe.Recipient), nullIfEmpty(pe.Reason), nullIfEmpty(pe.BounceType), nullIfEmpty(pe.URL),
+				string(eventPayload(pe))}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for eventType, tableName := range eventTables {
+		var typed []*ProviderEvent
+		for _, pe := range events {
+			if pe.Type == eventType {
+				typed = append(typed, pe)
+			}
+		}
+		if len(typed) == 0 {
+			continue
+		}
+
+		columns := []string{"time", "user_id", "provider", "message_id"}
+		if eventType == providers.EventClick {
+			// Clicks also record the clicked URL
+			columns = append(columns, "url")
+		}
+		err = copyRows(tx, tableName, columns, typed, func(_ int, pe *ProviderEvent) []interface{} {
+			row := []interface{}{pe.Timestamp, pe.UserID, pe.Provider, pe.MessageID}
+			if eventType == providers.EventClick {
+				row = append(row, nullIfEmpty(pe.URL))
+			}
+			return row
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := suppressEventRecipients(tx, events); err != nil {
+		return nil, err
+	}
+
+	return duplicates, nil
+}
+
+// dropDuplicateEvents records the staged events' provider event IDs and
+// removes the staged events whose ID is already known and unexpired, or
+// repeated within the batch. It returns the remaining and dropped events.
+func dropDuplicateEvents(tx *sql.Tx, events []*ProviderEvent) ([]*ProviderEvent, []*ProviderEvent, error) {
+	rows, err := tx.Query(`
+        WITH first_seen AS (
+            SELECT DISTINCT ON (provider, event_id) seq, provider, event_id, dedupe_until
+            FROM event_staging
+            ORDER BY provider, event_id, seq
+        ), fresh AS (
+            INSERT INTO provider_event_ids (provider, event_id, expires_at)
+            SELECT provider, event_id, dedupe_until FROM first_seen
+            ON CONFLICT (provider, event_id) DO UPDATE SET expires_at = EXCLUDED.expires_at
+            WHERE provider_event_ids.expires_at < now()
+            RETURNING provider, event_id
+        )
+        DELETE FROM event_staging s
+        WHERE NOT EXISTS (
+            SELECT 1
+            FROM first_seen f
+            JOIN fresh ON fresh.provider = f.provider AND fresh.event_id = f.event_id
+            WHERE f.seq = s.seq
+        )
+        RETURNING seq`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deduplicating events: %v", err)
+	}
+	defer rows.Close()
+
+	dropped := map[int]bool{}
+	for rows.Next() {
+		var seq int
+		if err := rows.Scan(&seq); err != nil {
+			return nil, nil, err
+		}
+		dropped[seq] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var fresh, duplicates []*ProviderEvent
+	for i, pe := range events {
+		if dropped[i] {
+			duplicates = append(duplicates, pe)
+		} else {
+			fresh = append(fresh, pe)
+		}
+	}
+	return fresh, duplicates, nil
+}
+
+// providerEventID returns the provider's unique ID for an event. Providers
+// that don't send one retry with an identical payload, so the payload hash
+// stands in for it.
+func providerEventID(pe *ProviderEvent) string {
+	if pe.EventID != "" {
+		return pe.EventID
+	}
+	sum := sha256.Sum256(eventPayload(pe))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// PruneProviderEventIDs forgets event IDs whose dedupe window has passed
+func PruneProviderEventIDs(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`DELETE FROM provider_event_ids WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// copyRows streams rows into a table with COPY FROM STDIN
+func copyRows(tx *sql.Tx, table string, columns []string, events []*ProviderEvent, row func(int, *ProviderEvent) []interface{}) error {
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return fmt.Errorf("error preparing copy into %s: %v", table, err)
+	}
+
+	for i, pe := range events {
+		if _, err := stmt.Exec(row(i, pe)...); err != nil {
+			stmt.Close()
+			return fmt.Errorf("error copying into %s: %v", table, err)
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("error flushing copy into %s: %v", table, err)
+	}
+	return stmt.Close()
+}
+
+func hasEventType(events []*ProviderEvent, eventType providers.EventType) bool {
+	for _, pe := range events {
+		if pe.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// eventPayload returns the raw provider payload, or an empty object
+func eventPayload(pe *ProviderEvent) json.RawMessage {
+	if len(strings.TrimSpace(string(pe.Raw))) == 0 {
+		return json.RawMessage("{}")
+	}
+	return pe.Raw
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+func rawEvent(eventID, raw string) *ProviderEvent {
+	return &ProviderEvent{NormalizedEvent: providers.NormalizedEvent{EventID: eventID, Raw: json.RawMessage(raw)}}
+}
+
+func TestProviderEventID(t *testing.T) {
+	withID := rawEvent("evt-1", `{"a":1}`)
+	if got := providerEventID(withID); got != "evt-1" {
+		t.Errorf("providerEventID = %q, want the provider's event ID", got)
+	}
+
+	first := providerEventID(rawEvent("", `{"a":1}`))
+	retry := providerEventID(rawEvent("", `{"a":1}`))
+	other := providerEventID(rawEvent("", `{"a":2}`))
+
+	if !strings.HasPrefix(first, "sha256:") || len(first) != len("sha256:")+64 {
+		t.Errorf("providerEventID = %q, want a sha256 payload hash", first)
+	}
+	if first != retry {
+		t.Errorf("identical payloads hashed to %q and %q", first, retry)
+	}
+	if first == other {
+		t.Errorf("different payloads both hashed to %q", first)
+	}
+}
+
+func TestProviderEventIDEmptyPayload(t *testing.T) {
+	empty := providerEventID(rawEvent("", ""))
+	object := providerEventID(rawEvent("", `{}`))
+	if empty != object {
+		t.Errorf("empty payload hashed to %q, want the empty object's %q", empty, object)
+	}
+}
+
+func TestDedupeWindowsFor(t *testing.T) {
+	windows := DedupeWindows{Default: time.Hour, PerProvider: map[string]time.Duration{"ses": 24 * time.Hour}}
+	if got := windows.For("ses"); got != 24*time.Hour {
+		t.Errorf("For(ses) = %v, want 24h", got)
+	}
+	if got := windows.For("sendgrid"); got != time.Hour {
+		t.Errorf("For(sendgrid) = %v, want the 1h default", got)
+	}
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SpillEvents parks provider events in the ingest_spill table when the
+// in-process queue can't take them. Each source request is stored once.
+func SpillEvents(db *sql.DB, events []*ProviderEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	sourceIDs := map[*WebhookSource]int64{}
+	for _, pe := range events {
+		if pe.Source == nil {
+			continue
+		}
+		if _, ok := sourceIDs[pe.Source]; ok {
+			continue
+		}
+		var id int64
+		err := tx.QueryRow(`
+            INSERT INTO ingest_spill_sources (headers, body) VALUES ($1, $2)
+            RETURNING id`, string(pe.Source.Headers), pe.Source.Body).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("error spilling source request: %v", err)
+		}
+		sourceIDs[pe.Source] = id
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("ingest_spill", "event", "source_id"))
+	if err != nil {
+		return fmt.Errorf("error preparing spill: %v", err)
+	}
+	for _, pe := range events {
+		data, err := json.Marshal(pe)
+		if err != nil {
+			stmt.Close()
+			return fmt.Errorf("error encoding spilled event: %v", err)
+		}
+		var sourceID interface{}
+		if id, ok := sourceIDs[pe.Source]; ok {
+			sourceID = id
+		}
+		if _, err := stmt.Exec(string(data), sourceID); err != nil {
+			stmt.Close()
+			return fmt.Errorf("error spilling event: %v", err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("error flushing spill: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CountSpilledEvents returns how many events are waiting in ingest_spill
+func CountSpilledEvents(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM ingest_spill`).Scan(&count)
+	return count, err
+}
+
+// DrainSpilledEvents writes up to limit spilled events to the event tables
+// and removes them from ingest_spill in the same transaction. It returns the
+// events drained and the ones dropped as duplicates.
+func DrainSpilledEvents(db *sql.DB, limit int, windows DedupeWindows) ([]*ProviderEvent, []*ProviderEvent, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        DELETE FROM ingest_spill
+        WHERE id IN (
+            SELECT id FROM ingest_spill
+            ORDER BY id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING event`, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error claiming spilled events: %v", err)
+	}
+
+	var events []*ProviderEvent
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		pe := &ProviderEvent{}
+		if err := json.Unmarshal(data, pe); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("error decoding spilled event: %v", err)
+		}
+		events = append(events, pe)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(events) == 0 {
+		return nil, nil, nil
+	}
+
+	duplicates, err := recordEventBatch(tx, events, windows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return events, duplicates, nil
+}
+
+// PruneSpillSources removes source requests no spilled event refers to
+// anymore
+func PruneSpillSources(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`
+        DELETE FROM ingest_spill_sources s
+        WHERE NOT EXISTS (SELECT 1 FROM ingest_spill WHERE source_id = s.id)`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
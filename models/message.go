@@ -0,0 +1,19 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AssociateMessage records which user and ESP sent a message, so webhook
+// events for it are attributed to them
+func AssociateMessage(db *sql.DB, messageID string, userID, espID int) error {
+	_, err := db.Exec(`
+        INSERT INTO message_user_associations (message_id, user_id, esp_id)
+        VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING`, messageID, userID, espID)
+	if err != nil {
+		return fmt.Errorf("error associating message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// MessageEvent is one entry of a message's append-only event history
+type MessageEvent struct {
+	ID         int64           `json:"id"`
+	MessageID  string          `json:"message_id"`
+	ESPID      int             `json:"esp_id"`
+	Provider   string          `json:"provider"`
+	EventType  string          `json:"event_type"`
+	EventTime  time.Time       `json:"event_time"`
+	Recipient  *string         `json:"recipient"`
+	Reason     *string         `json:"reason"`
+	BounceType *string         `json:"bounce_type"`
+	URL        *string         `json:"url"`
+	Payload    json.RawMessage `json:"payload"`
+	ReceivedAt time.Time       `json:"received_at"`
+}
+
+// GetMessageTimeline returns every event recorded for a message, oldest first
+func GetMessageTimeline(db *sql.DB, userID int, messageID string) ([]MessageEvent, error) {
+	query := `
+        SELECT id, message_id, esp_id, provider, event_type, event_time,
+               recipient, reason, bounce_type, url, payload, received_at
+        FROM message_events
+        WHERE user_id = $1 AND message_id = $2
+        ORDER BY event_time, id
+    `
+
+	rows, err := db.Query(query, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []MessageEvent{}
+	for rows.Next() {
+		var me MessageEvent
+		err := rows.Scan(
+			&me.ID, &me.MessageID, &me.ESPID, &me.Provider, &me.EventType, &me.EventTime,
+			&me.Recipient, &me.Reason, &me.BounceType, &me.URL, &me.Payload, &me.ReceivedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, me)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,159 @@
+// models/reputation.go
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// WeightAdjustment records a change of an ESP's weight factor by the
+// reputation controller, or a change it would have made in dry-run mode
+type WeightAdjustment struct {
+	ID              int64     `json:"id"`
+	UserID          int       `json:"user_id"`
+	ESPID           int       `json:"esp_id"`
+	PreviousFactor  float64   `json:"previous_factor"`
+	Factor          float64   `json:"factor"`
+	Weight          int       `json:"weight"`
+	EffectiveWeight int       `json:"effective_weight"`
+	Score           float64   `json:"score"`
+	SampleSize      int       `json:"sample_size"`
+	BounceRate      float64   `json:"bounce_rate"`
+	DeferralRate    float64   `json:"deferral_rate"`
+	ComplaintRate   float64   `json:"complaint_rate"`
+	Reason          string    `json:"reason"`
+	DryRun          bool      `json:"dry_run"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// GetESPEventStats totals the user's message events per ESP between
+// startTime and endTime. Each message counts once per event type, as in
+// GetUserEventStats.
+func GetESPEventStats(db *sql.DB, userID int, startTime, endTime time.Time) (map[int]EventStats, error) {
+	query := `
+    SELECT
+        mua.esp_id,
+        MIN(e.provider) AS provider,
+        COUNT(*) AS total_events,
+        SUM(CASE WHEN e.processed THEN 1 ELSE 0 END) AS processed_count,
+        SUM(CASE WHEN e.delivered THEN 1 ELSE 0 END) AS delivered_count,
+        SUM(CASE WHEN e.bounce THEN 1 ELSE 0 END) AS bounce_count,
+        SUM(CASE WHEN e.deferred THEN 1 ELSE 0 END) AS deferred_count,
+        SUM(CASE WHEN e.dropped THEN 1 ELSE 0 END) AS dropped_count,
+        SUM(CASE WHEN e.spam_report THEN 1 ELSE 0 END) AS spam_report_count
+    FROM events e
+    JOIN message_user_associations mua ON e.message_id = mua.message_id
+    WHERE mua.user_id = $1
+        AND COALESCE(e.processed_time, e.delivered_time, e.bounce_time,
+                     e.last_deferral_time, e.unique_open_time, e.last_open_time,
+                     e.dropped_time, e.last_click_time, e.spam_report_time,
+                     e.unsubscribe_time, 0) BETWEEN $2 AND $3
+    GROUP BY mua.esp_id
+    `
+
+	rows, err := db.Query(query, userID, startTime.Unix(), endTime.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+
+	stats := map[int]EventStats{}
+	for rows.Next() {
+		var espID int
+		s := EventStats{TimeBucket: startTime}
+		err := rows.Scan(
+			&espID,
+			&s.Provider,
+			&s.TotalEvents,
+			&s.ProcessedCount,
+			&s.DeliveredCount,
+			&s.BounceCount,
+			&s.DeferredCount,
+			&s.DroppedCount,
+			&s.SpamReportCount,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("row scan error: %v", err)
+		}
+		stats[espID] = s
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return stats, nil
+}
+
+// GetUserIDsWithESPs returns the IDs of users that have at least one ESP
+func GetUserIDsWithESPs(db *sql.DB) ([]int, error) {
+	rows, err := db.Query(`SELECT DISTINCT user_id FROM email_service_providers ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs, rows.Err()
+}
+
+// SetESPWeightFactor updates the reputation factor applied to an ESP's
+// weight. It is not a user edit, so updated_at is left alone.
+func SetESPWeightFactor(db *sql.DB, espID int, factor float64) error {
+	_, err := db.Exec(`UPDATE email_service_providers SET weight_factor = $2 WHERE esp_id = $1`, espID, factor)
+	return err
+}
+
+// CreateWeightAdjustment records an adjustment
+func CreateWeightAdjustment(db *sql.DB, adj *WeightAdjustment) error {
+	query := `
+        INSERT INTO esp_weight_adjustments (
+            user_id, esp_id, previous_factor, factor, weight, effective_weight, score,
+            sample_size, bounce_rate, deferral_rate, complaint_rate, reason, dry_run)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        RETURNING id, created_at`
+
+	return db.QueryRow(query, adj.UserID, adj.ESPID, adj.PreviousFactor, adj.Factor, adj.Weight,
+		adj.EffectiveWeight, adj.Score, adj.SampleSize, adj.BounceRate, adj.DeferralRate,
+		adj.ComplaintRate, adj.Reason, adj.DryRun).
+		Scan(&adj.ID, &adj.CreatedAt)
+}
+
+// GetWeightAdjustments returns the user's most recent adjustments, newest
+// first, optionally for a single ESP
+func GetWeightAdjustments(db *sql.DB, userID, espID, limit int) ([]WeightAdjustment, error) {
+	query := `
+        SELECT id, user_id, esp_id, previous_factor, factor, weight, effective_weight, score,
+               sample_size, bounce_rate, deferral_rate, complaint_rate, reason, dry_run, created_at
+        FROM esp_weight_adjustments
+        WHERE user_id = $1 AND ($2 = 0 OR esp_id = $2)
+        ORDER BY created_at DESC, id DESC
+        LIMIT $3`
+
+	rows, err := db.Query(query, userID, espID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := []WeightAdjustment{}
+	for rows.Next() {
+		var a WeightAdjustment
+		err := rows.Scan(&a.ID, &a.UserID, &a.ESPID, &a.PreviousFactor, &a.Factor, &a.Weight,
+			&a.EffectiveWeight, &a.Score, &a.SampleSize, &a.BounceRate, &a.DeferralRate,
+			&a.ComplaintRate, &a.Reason, &a.DryRun, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, a)
+	}
+	return adjustments, rows.Err()
+}
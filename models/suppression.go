@@ -0,0 +1,365 @@
+// models/suppression.go
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+// Suppression kinds
+const (
+	SuppressionAddress = "address"
+	SuppressionDomain  = "domain"
+)
+
+// Suppression reasons
+const (
+	SuppressionHardBounce  = "hard_bounce"
+	SuppressionComplaint   = "complaint"
+	SuppressionUnsubscribe = "unsubscribe"
+	SuppressionManual      = "manual"
+)
+
+// ErrSuppressionExists means the user already has an unexpired entry for the
+// address or domain
+var ErrSuppressionExists = errors.New("address or domain is already suppressed")
+
+// Suppression stops a user's messages from going to an address, or to every
+// address at a domain
+type Suppression struct {
+	ID     int64  `json:"id"`
+	UserID int    `json:"user_id"`
+	Kind   string `json:"kind"`
+	// Lowercased address or domain
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	// Message whose bounce or complaint added the entry
+	MessageID string     `json:"message_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Normalize lowercases the value and sets the kind from it, so addresses and
+// domains can be given in the same field
+func (s *Suppression) Normalize() {
+	s.Value = strings.ToLower(strings.TrimSpace(s.Value))
+	if strings.Contains(s.Value, "@") {
+		s.Kind = SuppressionAddress
+	} else {
+		s.Kind = SuppressionDomain
+	}
+	if s.Reason == "" {
+		s.Reason = SuppressionManual
+	}
+}
+
+// Validate checks the value is a bare address or domain, the reason is known
+// and any expiry is in the future
+func (s *Suppression) Validate() error {
+	if s.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+	switch s.Kind {
+	case SuppressionAddress:
+		addr, err := mail.ParseAddress(s.Value)
+		if err != nil || addr.Address != s.Value {
+			return fmt.Errorf("invalid address: %s", s.Value)
+		}
+	case SuppressionDomain:
+		if !strings.Contains(s.Value, ".") || strings.ContainsAny(s.Value, " \t<>,;()\"") {
+			return fmt.Errorf("invalid domain: %s", s.Value)
+		}
+	default:
+		return fmt.Errorf("invalid kind: %s", s.Kind)
+	}
+	switch s.Reason {
+	case SuppressionHardBounce, SuppressionComplaint, SuppressionUnsubscribe, SuppressionManual:
+	default:
+		return fmt.Errorf("invalid reason: %s", s.Reason)
+	}
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("expires_at must be in the future")
+	}
+	return nil
+}
+
+// SuppressionFilter narrows a listing of suppressions
+type SuppressionFilter struct {
+	Kind   string
+	Reason string
+	// Whether to list entries whose expiry has passed
+	IncludeExpired bool
+	// Zero means no limit
+	Limit  int
+	Offset int
+}
+
+const suppressionColumns = `
+        id, user_id, kind, value, reason, COALESCE(message_id, ''), expires_at, created_at, updated_at`
+
+func scanSuppression(row rowScanner) (*Suppression, error) {
+	s := &Suppression{}
+	var expiresAt sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Kind, &s.Value, &s.Reason, &s.MessageID, &expiresAt,
+		&s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		s.ExpiresAt = &expiresAt.Time
+	}
+	return s, nil
+}
+
+func querySuppressions(db *sql.DB, query string, args ...interface{}) ([]*Suppression, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suppressions := []*Suppression{}
+	for rows.Next() {
+		s, err := scanSuppression(rows)
+		if err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, s)
+	}
+	return suppressions, rows.Err()
+}
+
+// CreateSuppression adds an entry, replacing an expired one for the same
+// value. It returns ErrSuppressionExists if an unexpired entry exists.
+func CreateSuppression(db *sql.DB, s *Suppression) error {
+	query := `
+        INSERT INTO suppressions (user_id, kind, value, reason, message_id, expires_at)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+        ON CONFLICT (user_id, value) DO UPDATE
+        SET reason = EXCLUDED.reason, message_id = EXCLUDED.message_id, expires_at = EXCLUDED.expires_at,
+            created_at = now(), updated_at = now()
+        WHERE suppressions.expires_at <= now()
+        RETURNING id, created_at, updated_at`
+
+	err := db.QueryRow(query, s.UserID, s.Kind, s.Value, s.Reason, s.MessageID, s.ExpiresAt).
+		Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrSuppressionExists
+	}
+	return err
+}
+
+// ImportSuppressions adds entries in one transaction, replacing existing
+// ones that expire. Permanent entries, such as those added by bounces and
+// complaints, are kept as they are. It returns the number of entries written
+// and the number kept.
+func ImportSuppressions(db *sql.DB, suppressions []*Suppression) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+        INSERT INTO suppressions (user_id, kind, value, reason, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id, value) DO UPDATE
+        SET reason = EXCLUDED.reason, expires_at = EXCLUDED.expires_at, message_id = NULL, updated_at = now()
+        WHERE suppressions.expires_at IS NOT NULL`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error preparing import: %v", err)
+	}
+	defer stmt.Close()
+
+	written := 0
+	for _, s := range suppressions {
+		result, err := stmt.Exec(s.UserID, s.Kind, s.Value, s.Reason, s.ExpiresAt)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error importing %s: %v", s.Value, err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, 0, fmt.Errorf("error getting rows affected: %v", err)
+		}
+		written += int(rows)
+	}
+	return written, len(suppressions) - written, tx.Commit()
+}
+
+// GetSuppressions lists the user's entries, newest first
+func GetSuppressions(db *sql.DB, userID int, filter SuppressionFilter) ([]*Suppression, error) {
+	query := `SELECT ` + suppressionColumns + `
+        FROM suppressions
+        WHERE user_id = $1
+          AND ($2 = '' OR kind = $2)
+          AND ($3 = '' OR reason = $3)
+          AND ($4 OR expires_at IS NULL OR expires_at > now())
+        ORDER BY created_at DESC, id DESC
+        OFFSET $5`
+	args := []interface{}{userID, filter.Kind, filter.Reason, filter.IncludeExpired, filter.Offset}
+	if filter.Limit > 0 {
+		query += ` LIMIT $6`
+		args = append(args, filter.Limit)
+	}
+	return querySuppressions(db, query, args...)
+}
+
+// GetSuppression returns one of the user's entries
+func GetSuppression(db *sql.DB, userID int, id int64) (*Suppression, error) {
+	query := `SELECT ` + suppressionColumns + `
+        FROM suppressions
+        WHERE user_id = $1 AND id = $2`
+	return scanSuppression(db.QueryRow(query, userID, id))
+}
+
+// UpdateSuppression saves an entry's reason and expiry
+func UpdateSuppression(db *sql.DB, s *Suppression) error {
+	query := `
+        UPDATE suppressions
+        SET reason = $3, expires_at = $4, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND user_id = $2
+        RETURNING updated_at`
+
+	return db.QueryRow(query, s.ID, s.UserID, s.Reason, s.ExpiresAt).Scan(&s.UpdatedAt)
+}
+
+// DeleteSuppression removes one of the user's entries
+func DeleteSuppression(db *sql.DB, userID int, id int64) error {
+	result, err := db.Exec(`DELETE FROM suppressions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting suppression: %v", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// FindSuppressions returns the unexpired entries that apply to the given
+// addresses, by lowercased address. An entry for the address itself takes
+// precedence over one for its domain.
+func FindSuppressions(db *sql.DB, userID int, addresses []string) (map[string]*Suppression, error) {
+	if len(addresses) == 0 {
+		return map[string]*Suppression{}, nil
+	}
+
+	query := `SELECT ` + suppressionColumns + `
+        FROM suppressions
+        WHERE user_id = $1 AND value = ANY($2)
+          AND (expires_at IS NULL OR expires_at > now())`
+	suppressions, err := querySuppressions(db, query, userID, pq.Array(suppressionLookupValues(addresses)))
+	if err != nil {
+		return nil, fmt.Errorf("error finding suppressions: %v", err)
+	}
+	return matchSuppressions(addresses, suppressions), nil
+}
+
+// suppressionLookupValues lists the lowercased addresses and their domains,
+// the values an entry suppressing any of the addresses can have
+func suppressionLookupValues(addresses []string) []string {
+	var values []string
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		values = append(values, addr)
+		if at := strings.LastIndex(addr, "@"); at >= 0 {
+			values = append(values, addr[at+1:])
+		}
+	}
+	return values
+}
+
+// matchSuppressions maps each lowercased address to the entry suppressing
+// it, preferring an entry for the address over one for its domain
+func matchSuppressions(addresses []string, suppressions []*Suppression) map[string]*Suppression {
+	byValue := make(map[string]*Suppression, len(suppressions))
+	for _, s := range suppressions {
+		byValue[s.Value] = s
+	}
+
+	found := map[string]*Suppression{}
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		if s, ok := byValue[addr]; ok {
+			found[addr] = s
+		} else if at := strings.LastIndex(addr, "@"); at >= 0 {
+			if s, ok := byValue[addr[at+1:]]; ok {
+				found[addr] = s
+			}
+		}
+	}
+	return found
+}
+
+// eventSuppressionReason returns the reason an event suppresses its
+// recipient: hard bounces and spam complaints do, other events don't
+func eventSuppressionReason(pe *ProviderEvent) (string, bool) {
+	switch {
+	case pe.Type == providers.EventSpamReport:
+		return SuppressionComplaint, true
+	case pe.Type == providers.EventBounce && providers.BounceClass(pe.BounceType) == providers.BounceTypeComplaint:
+		return SuppressionComplaint, true
+	case pe.Type == providers.EventBounce && providers.BounceClass(pe.BounceType) == providers.BounceTypeHard:
+		return SuppressionHardBounce, true
+	}
+	return "", false
+}
+
+// suppressEventRecipients adds the recipients of hard bounces and complaints
+// to their users' suppression lists. Permanent entries are left as they are;
+// expiring ones become permanent.
+func suppressEventRecipients(tx *sql.Tx, events []*ProviderEvent) error {
+	type key struct {
+		userID int
+		value  string
+	}
+	seen := map[key]bool{}
+	var userIDs []int64
+	var values, reasons, messageIDs []string
+	for _, pe := range events {
+		reason, ok := eventSuppressionReason(pe)
+		if !ok {
+			continue
+		}
+		value := strings.ToLower(strings.TrimSpace(pe.Recipient))
+		if addr, err := mail.ParseAddress(value); err == nil {
+			value = strings.ToLower(addr.Address)
+		}
+		k := key{pe.UserID, value}
+		if !strings.Contains(value, "@") || seen[k] {
+			continue
+		}
+		seen[k] = true
+		userIDs = append(userIDs, int64(pe.UserID))
+		values = append(values, value)
+		reasons = append(reasons, reason)
+		messageIDs = append(messageIDs, pe.MessageID)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+        INSERT INTO suppressions (user_id, kind, value, reason, message_id)
+        SELECT u, $5::TEXT, v, r, NULLIF(m, '')
+        FROM unnest($1::INTEGER[], $2::TEXT[], $3::TEXT[], $4::TEXT[]) AS t(u, v, r, m)
+        ON CONFLICT (user_id, value) DO UPDATE
+        SET reason = EXCLUDED.reason, message_id = EXCLUDED.message_id, expires_at = NULL, updated_at = now()
+        WHERE suppressions.expires_at IS NOT NULL`,
+		pq.Array(userIDs), pq.Array(values), pq.Array(reasons), pq.Array(messageIDs), SuppressionAddress)
+	if err != nil {
+		return fmt.Errorf("error suppressing event recipients: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+func TestSuppressionLookupValues(t *testing.T) {
+	got := suppressionLookupValues([]string{"Ann@Example.com", "bob@mail.example.org", "postmaster"})
+	want := []string{"ann@example.com", "example.com", "bob@mail.example.org", "mail.example.org", "postmaster"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("suppressionLookupValues() = %v, want %v", got, want)
+	}
+}
+
+func TestMatchSuppressionsPrecedence(t *testing.T) {
+	address := &Suppression{ID: 1, Kind: SuppressionAddress, Value: "ann@example.com", Reason: SuppressionUnsubscribe}
+	domain := &Suppression{ID: 2, Kind: SuppressionDomain, Value: "example.com", Reason: SuppressionManual}
+	addresses := []string{"Ann@Example.com", "bob@example.com", "carol@example.org"}
+
+	// Rows come back from the database in no particular order
+	for _, suppressions := range [][]*Suppression{{address, domain}, {domain, address}} {
+		found := matchSuppressions(addresses, suppressions)
+
+		if found["ann@example.com"] != address {
+			t.Errorf("ann@example.com matched %+v, want the address entry over the domain's", found["ann@example.com"])
+		}
+		if found["bob@example.com"] != domain {
+			t.Errorf("bob@example.com matched %+v, want the domain entry", found["bob@example.com"])
+		}
+		if s, ok := found["carol@example.org"]; ok {
+			t.Errorf("carol@example.org matched %+v, want no entry", s)
+		}
+		if len(found) != 2 {
+			t.Errorf("found = %v, want 2 entries keyed by lowercased address", found)
+		}
+	}
+}
+
+func TestMatchSuppressionsDomainIsExact(t *testing.T) {
+	domain := &Suppression{ID: 1, Kind: SuppressionDomain, Value: "example.com"}
+	found := matchSuppressions([]string{"ann@mail.example.com", "ann@notexample.com"}, []*Suppression{domain})
+	if len(found) != 0 {
+		t.Errorf("found = %v, want a domain entry not to cover subdomains or suffixes", found)
+	}
+}
+
+func TestSuppressionNormalize(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantValue  string
+		wantKind   string
+		reason     string
+		wantReason string
+	}{
+		{" Ann@Example.COM ", "ann@example.com", SuppressionAddress, "", SuppressionManual},
+		{"Example.com", "example.com", SuppressionDomain, SuppressionComplaint, SuppressionComplaint},
+	}
+	for _, tt := range tests {
+		s := &Suppression{Value: tt.value, Reason: tt.reason}
+		s.Normalize()
+		if s.Value != tt.wantValue || s.Kind != tt.wantKind || s.Reason != tt.wantReason {
+			t.Errorf("Normalize(%q) = %q %q %q, want %q %q %q", tt.value, s.Value, s.Kind, s.Reason, tt.wantValue, tt.wantKind, tt.wantReason)
+		}
+	}
+}
+
+func TestSuppressionValidate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		s       Suppression
+		wantErr bool
+	}{
+		{"address", Suppression{Kind: SuppressionAddress, Value: "ann@example.com", Reason: SuppressionManual}, false},
+		{"domain", Suppression{Kind: SuppressionDomain, Value: "example.com", Reason: SuppressionHardBounce}, false},
+		{"expiring", Suppression{Kind: SuppressionDomain, Value: "example.com", Reason: SuppressionManual, ExpiresAt: &future}, false},
+		{"empty value", Suppression{Kind: SuppressionAddress, Reason: SuppressionManual}, true},
+		{"display name", Suppression{Kind: SuppressionAddress, Value: "ann <ann@example.com>", Reason: SuppressionManual}, true},
+		{"domain without dot", Suppression{Kind: SuppressionDomain, Value: "localhost", Reason: SuppressionManual}, true},
+		{"domain with space", Suppression{Kind: SuppressionDomain, Value: "example .com", Reason: SuppressionManual}, true},
+		{"unknown kind", Suppression{Kind: "ip", Value: "example.com", Reason: SuppressionManual}, true},
+		{"unknown reason", Suppression{Kind: SuppressionDomain, Value: "example.com", Reason: "soft_bounce"}, true},
+		{"expired", Suppression{Kind: SuppressionDomain, Value: "example.com", Reason: SuppressionManual, ExpiresAt: &past}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEventSuppressionReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		eventType  providers.EventType
+		bounceType string
+		want       string
+		suppress   bool
+	}{
+		{"hard bounce", providers.EventBounce, providers.BounceTypeHard, SuppressionHardBounce, true},
+		{"hard bounce with subtype", providers.EventBounce, "hard:NoEmail", SuppressionHardBounce, true},
+		{"complaint bounce", providers.EventBounce, providers.BounceTypeComplaint, SuppressionComplaint, true},
+		{"spam report", providers.EventSpamReport, "", SuppressionComplaint, true},
+		{"soft bounce", providers.EventBounce, "soft:MailboxFull", "", false},
+		{"block bounce", providers.EventBounce, providers.BounceTypeBlock, "", false},
+		{"delivered", providers.EventDelivered, "", "", false},
+		{"unsubscribe", providers.EventUnsubscribe, "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pe := &ProviderEvent{NormalizedEvent: providers.NormalizedEvent{Type: tt.eventType, BounceType: tt.bounceType}}
+			reason, ok := eventSuppressionReason(pe)
+			if reason != tt.want || ok != tt.suppress {
+				t.Errorf("eventSuppressionReason() = %q, %v, want %q, %v", reason, ok, tt.want, tt.suppress)
+			}
+		})
+	}
+}
@@ -62,6 +62,23 @@ func UpdateUser(db *sql.DB, user *User) error {
 		Scan(&user.UpdatedAt)
 }
 
+// UpdateUserIfUnmodified updates the user only if they were last updated at
+// updatedAt, returning ErrModified otherwise
+func UpdateUserIfUnmodified(db *sql.DB, user *User, updatedAt time.Time) error {
+	query := `
+        UPDATE users
+        SET username = $2, email = $3, first_name = $4, last_name = $5, api_key = $6, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND updated_at = $7
+        RETURNING updated_at`
+
+	err := db.QueryRow(query, user.ID, user.Username, user.Email, user.FirstName, user.LastName, user.APIKey, updatedAt).
+		Scan(&user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrModified
+	}
+	return err
+}
+
 func DeleteUser(db *sql.DB, id int) error {
 	query := `DELETE FROM users WHERE id = $1`
 	_, err := db.Exec(query, id)
@@ -98,9 +115,12 @@ func GetUserByEmail(db *sql.DB, email string) (*User, error) {
 
 func GetUserByID(db *sql.DB, id int) (*User, error) {
 	user := &User{}
-	query := `SELECT id, username, email, api_key FROM users WHERE id = $1`
+	query := `SELECT id, username, email, api_key, COALESCE(first_name, ''), COALESCE(last_name, ''),
+                     created_at, updated_at
+              FROM users WHERE id = $1`
 	err := db.QueryRow(query, id).Scan(
-		&user.ID, &user.Username, &user.Email, &user.APIKey)
+		&user.ID, &user.Username, &user.Email, &user.APIKey, &user.FirstName, &user.LastName,
+		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,271 @@
+// models/warmup.go
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Warm-up statuses
+const (
+	WarmupActive    = "active"
+	WarmupPaused    = "paused"
+	WarmupCompleted = "completed"
+)
+
+// ErrWarmupExists means the ESP already has a schedule for the domain
+var ErrWarmupExists = errors.New("warm-up schedule already exists for this ESP and sending domain")
+
+// Warmup ramps the daily volume an ESP sends for a domain. The ceiling of
+// each day comes from DailyLimits if set, otherwise from a curve growing
+// from InitialVolume by GrowthRate per day up to TargetVolume.
+type Warmup struct {
+	ID               int64   `json:"id"`
+	UserID           int     `json:"user_id"`
+	ESPID            int     `json:"esp_id"`
+	SendingDomain    string  `json:"sending_domain"`
+	DailyLimits      []int   `json:"daily_limits,omitempty"`
+	InitialVolume    int     `json:"initial_volume,omitempty"`
+	GrowthRate       float64 `json:"growth_rate,omitempty"`
+	TargetVolume     int     `json:"target_volume,omitempty"`
+	MaxBounceRate    float64 `json:"max_bounce_rate"`
+	MaxComplaintRate float64 `json:"max_complaint_rate"`
+	// Zero-based day of the schedule in effect
+	Day          int       `json:"day"`
+	DayStartedOn time.Time `json:"day_started_on"`
+	Status       string    `json:"status"`
+	PausedReason string    `json:"paused_reason,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// Messages sent for the domain today, filled in by queries that report
+	// progress
+	SentToday int `json:"sent_today"`
+}
+
+// Days is the length of the schedule
+func (w *Warmup) Days() int {
+	if len(w.DailyLimits) > 0 {
+		return len(w.DailyLimits)
+	}
+	if w.InitialVolume <= 0 || w.GrowthRate <= 1 || w.TargetVolume <= w.InitialVolume {
+		return 1
+	}
+	return int(math.Ceil(math.Log(float64(w.TargetVolume)/float64(w.InitialVolume))/math.Log(w.GrowthRate))) + 1
+}
+
+// CeilingForDay returns the volume allowed on a day of the schedule
+func (w *Warmup) CeilingForDay(day int) int {
+	if len(w.DailyLimits) > 0 {
+		if day >= len(w.DailyLimits) {
+			day = len(w.DailyLimits) - 1
+		}
+		return w.DailyLimits[day]
+	}
+	ceiling := float64(w.InitialVolume) * math.Pow(w.GrowthRate, float64(day))
+	return int(math.Min(math.Ceil(ceiling), float64(w.TargetVolume)))
+}
+
+// Ceiling is today's volume ceiling, or -1 once the warm-up has completed
+func (w *Warmup) Ceiling() int {
+	if w.Status == WarmupCompleted {
+		return -1
+	}
+	return w.CeilingForDay(w.Day)
+}
+
+// Pause holds the schedule at its current day
+func (w *Warmup) Pause(reason string) {
+	w.Status = WarmupPaused
+	w.PausedReason = reason
+}
+
+// Resume continues the schedule from its current day, which counts as
+// starting today
+func (w *Warmup) Resume() {
+	w.Status = WarmupActive
+	w.PausedReason = ""
+	w.DayStartedOn = today()
+}
+
+// Validate checks the schedule is either a list of positive daily limits or
+// a growing curve, and that the pause thresholds are rates
+func (w *Warmup) Validate() error {
+	if w.SendingDomain == "" {
+		return fmt.Errorf("sending_domain is required")
+	}
+	if len(w.DailyLimits) > 0 {
+		if w.InitialVolume != 0 || w.GrowthRate != 0 || w.TargetVolume != 0 {
+			return fmt.Errorf("use either daily_limits or a growth curve, not both")
+		}
+		for _, limit := range w.DailyLimits {
+			if limit <= 0 {
+				return fmt.Errorf("daily_limits must be positive")
+			}
+		}
+	} else {
+		if w.InitialVolume <= 0 || w.GrowthRate <= 1 || w.TargetVolume <= w.InitialVolume {
+			return fmt.Errorf("a growth curve needs initial_volume > 0, growth_rate > 1 and target_volume > initial_volume")
+		}
+	}
+	if w.MaxBounceRate <= 0 || w.MaxBounceRate > 1 || w.MaxComplaintRate <= 0 || w.MaxComplaintRate > 1 {
+		return fmt.Errorf("max_bounce_rate and max_complaint_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+const warmupColumns = `
+        w.id, w.user_id, w.esp_id, w.sending_domain, w.daily_limits, w.initial_volume,
+        w.growth_rate, w.target_volume, w.max_bounce_rate, w.max_complaint_rate, w.day,
+        w.day_started_on, w.status, COALESCE(w.paused_reason, ''), w.created_at, w.updated_at,
+        COALESCE(u.count, 0)`
+
+// warmupUsageJoin joins today's send usage of the schedule's domain; $1 is
+// the current UTC date
+const warmupUsageJoin = `
+        LEFT JOIN esp_send_usage u
+          ON u.esp_id = w.esp_id AND u.sending_domain = w.sending_domain
+         AND u.period = 'day' AND u.period_start = $1`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWarmup(row rowScanner) (*Warmup, error) {
+	w := &Warmup{}
+	var limits []int64
+	err := row.Scan(&w.ID, &w.UserID, &w.ESPID, &w.SendingDomain, pq.Array(&limits), &w.InitialVolume,
+		&w.GrowthRate, &w.TargetVolume, &w.MaxBounceRate, &w.MaxComplaintRate, &w.Day,
+		&w.DayStartedOn, &w.Status, &w.PausedReason, &w.CreatedAt, &w.UpdatedAt, &w.SentToday)
+	if err != nil {
+		return nil, err
+	}
+	for _, limit := range limits {
+		w.DailyLimits = append(w.DailyLimits, int(limit))
+	}
+	return w, nil
+}
+
+func queryWarmups(db *sql.DB, query string, args ...interface{}) ([]*Warmup, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warmups := []*Warmup{}
+	for rows.Next() {
+		w, err := scanWarmup(rows)
+		if err != nil {
+			return nil, err
+		}
+		warmups = append(warmups, w)
+	}
+	return warmups, rows.Err()
+}
+
+func today() time.Time {
+	day, _ := usagePeriods(time.Now())
+	return day
+}
+
+// CreateWarmup starts a schedule on day 0 today
+func CreateWarmup(db *sql.DB, w *Warmup) error {
+	w.SendingDomain = strings.ToLower(w.SendingDomain)
+	limits := make([]int64, len(w.DailyLimits))
+	for i, limit := range w.DailyLimits {
+		limits[i] = int64(limit)
+	}
+
+	query := `
+        INSERT INTO warmup_schedules (
+            user_id, esp_id, sending_domain, daily_limits, initial_volume, growth_rate,
+            target_volume, max_bounce_rate, max_complaint_rate, day_started_on)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        RETURNING id, day, day_started_on, status, created_at, updated_at`
+
+	err := db.QueryRow(query, w.UserID, w.ESPID, w.SendingDomain, pq.Array(limits), w.InitialVolume,
+		w.GrowthRate, w.TargetVolume, w.MaxBounceRate, w.MaxComplaintRate, today()).
+		Scan(&w.ID, &w.Day, &w.DayStartedOn, &w.Status, &w.CreatedAt, &w.UpdatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrWarmupExists
+	}
+	return err
+}
+
+// GetWarmupsByUserID returns the user's schedules with today's usage
+func GetWarmupsByUserID(db *sql.DB, userID int) ([]*Warmup, error) {
+	query := `SELECT ` + warmupColumns + `
+        FROM warmup_schedules w` + warmupUsageJoin + `
+        WHERE w.user_id = $2
+        ORDER BY w.esp_id, w.sending_domain`
+	return queryWarmups(db, query, today(), userID)
+}
+
+// GetWarmup returns one of the user's schedules with today's usage
+func GetWarmup(db *sql.DB, userID int, id int64) (*Warmup, error) {
+	query := `SELECT ` + warmupColumns + `
+        FROM warmup_schedules w` + warmupUsageJoin + `
+        WHERE w.user_id = $2 AND w.id = $3`
+	return scanWarmup(db.QueryRow(query, today(), userID, id))
+}
+
+// GetWarmupsForDomain returns the user's unfinished schedules for a sending
+// domain, by ESP ID
+func GetWarmupsForDomain(db *sql.DB, userID int, domain string) (map[int]*Warmup, error) {
+	query := `SELECT ` + warmupColumns + `
+        FROM warmup_schedules w` + warmupUsageJoin + `
+        WHERE w.user_id = $2 AND w.sending_domain = $3 AND w.status <> 'completed'`
+	warmups, err := queryWarmups(db, query, today(), userID, strings.ToLower(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	byESP := make(map[int]*Warmup, len(warmups))
+	for _, w := range warmups {
+		byESP[w.ESPID] = w
+	}
+	return byESP, nil
+}
+
+// GetUnfinishedWarmups returns every active or paused schedule
+func GetUnfinishedWarmups(db *sql.DB) ([]*Warmup, error) {
+	query := `SELECT ` + warmupColumns + `
+        FROM warmup_schedules w` + warmupUsageJoin + `
+        WHERE w.status <> 'completed'
+        ORDER BY w.user_id, w.id`
+	return queryWarmups(db, query, today())
+}
+
+// UpdateWarmupProgress saves the schedule's day, status and pause reason
+func UpdateWarmupProgress(db *sql.DB, w *Warmup) error {
+	query := `
+        UPDATE warmup_schedules
+        SET day = $2, day_started_on = $3, status = $4, paused_reason = NULLIF($5, ''),
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1
+        RETURNING updated_at`
+
+	return db.QueryRow(query, w.ID, w.Day, w.DayStartedOn, w.Status, w.PausedReason).Scan(&w.UpdatedAt)
+}
+
+// DeleteWarmup removes one of the user's schedules
+func DeleteWarmup(db *sql.DB, userID int, id int64) error {
+	result, err := db.Exec(`DELETE FROM warmup_schedules WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("error deleting warm-up schedule: %v", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
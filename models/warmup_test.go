@@ -0,0 +1,144 @@
+package models
+
+import "testing"
+
+func TestWarmupCeilingForDayCurve(t *testing.T) {
+	w := &Warmup{InitialVolume: 100, GrowthRate: 2, TargetVolume: 1000}
+	want := []int{100, 200, 400, 800, 1000, 1000}
+	for day, ceiling := range want {
+		if got := w.CeilingForDay(day); got != ceiling {
+			t.Errorf("CeilingForDay(%d) = %d, want %d", day, got, ceiling)
+		}
+	}
+	if got := w.Days(); got != 5 {
+		t.Errorf("Days() = %d, want 5", got)
+	}
+}
+
+func TestWarmupCeilingForDayRoundsUp(t *testing.T) {
+	w := &Warmup{InitialVolume: 50, GrowthRate: 1.5, TargetVolume: 500}
+	if got := w.CeilingForDay(1); got != 75 {
+		t.Errorf("CeilingForDay(1) = %d, want 75", got)
+	}
+	// 50 * 1.5^2 = 112.5
+	if got := w.CeilingForDay(2); got != 113 {
+		t.Errorf("CeilingForDay(2) = %d, want 113", got)
+	}
+}
+
+func TestWarmupCeilingForDayDailyLimits(t *testing.T) {
+	w := &Warmup{DailyLimits: []int{50, 100, 250}}
+	want := []int{50, 100, 250, 250, 250}
+	for day, ceiling := range want {
+		if got := w.CeilingForDay(day); got != ceiling {
+			t.Errorf("CeilingForDay(%d) = %d, want %d", day, got, ceiling)
+		}
+	}
+	if got := w.Days(); got != 3 {
+		t.Errorf("Days() = %d, want 3", got)
+	}
+}
+
+func TestWarmupCeiling(t *testing.T) {
+	tests := []struct {
+		name   string
+		warmup Warmup
+		want   int
+	}{
+		{"active", Warmup{DailyLimits: []int{50, 100}, Day: 1, Status: WarmupActive}, 100},
+		{"paused holds the current day", Warmup{DailyLimits: []int{50, 100}, Day: 0, Status: WarmupPaused}, 50},
+		{"completed", Warmup{DailyLimits: []int{50, 100}, Day: 1, Status: WarmupCompleted}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.warmup.Ceiling(); got != tt.want {
+				t.Errorf("Ceiling() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmupPauseResume(t *testing.T) {
+	w := &Warmup{Status: WarmupActive}
+	w.Pause("bounce rate 6.0% above 5.0%")
+	if w.Status != WarmupPaused || w.PausedReason == "" {
+		t.Fatalf("after Pause: status %q, reason %q", w.Status, w.PausedReason)
+	}
+
+	w.Resume()
+	if w.Status != WarmupActive || w.PausedReason != "" {
+		t.Errorf("after Resume: status %q, reason %q", w.Status, w.PausedReason)
+	}
+	if !w.DayStartedOn.Equal(today()) {
+		t.Errorf("DayStartedOn = %v, want today", w.DayStartedOn)
+	}
+}
+
+func TestWarmupValidate(t *testing.T) {
+	valid := func(w Warmup) Warmup {
+		w.SendingDomain = "mail.example.com"
+		w.MaxBounceRate = 0.05
+		w.MaxComplaintRate = 0.001
+		return w
+	}
+	tests := []struct {
+		name    string
+		warmup  Warmup
+		wantErr bool
+	}{
+		{"daily limits", valid(Warmup{DailyLimits: []int{50, 100}}), false},
+		{"growth curve", valid(Warmup{InitialVolume: 100, GrowthRate: 1.5, TargetVolume: 10000}), false},
+		{"no sending domain", Warmup{DailyLimits: []int{50}, MaxBounceRate: 0.05, MaxComplaintRate: 0.001}, true},
+		{"both schedules", valid(Warmup{DailyLimits: []int{50}, InitialVolume: 100}), true},
+		{"zero daily limit", valid(Warmup{DailyLimits: []int{50, 0}}), true},
+		{"no schedule", valid(Warmup{}), true},
+		{"curve not growing", valid(Warmup{InitialVolume: 100, GrowthRate: 1, TargetVolume: 1000}), true},
+		{"target below initial", valid(Warmup{InitialVolume: 100, GrowthRate: 2, TargetVolume: 50}), true},
+		{"bounce rate above 1", Warmup{SendingDomain: "mail.example.com", DailyLimits: []int{50}, MaxBounceRate: 5, MaxComplaintRate: 0.001}, true},
+		{"no complaint rate", Warmup{SendingDomain: "mail.example.com", DailyLimits: []int{50}, MaxBounceRate: 0.05}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.warmup.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendLimitsWithDomainDailyCap(t *testing.T) {
+	limits := SendLimits{
+		SendLimit: SendLimit{DailyCap: 10000},
+		Domains: map[string]SendLimit{
+			"Mail.Example.com": {DailyCap: 500, MonthlyCap: 9000},
+			"news.example.com": {DailyCap: 200},
+		},
+	}
+
+	capped := limits.WithDomainDailyCap("mail.example.com", 100)
+	if limit, _ := capped.ForDomain("mail.example.com"); limit.DailyCap != 100 || limit.MonthlyCap != 9000 {
+		t.Errorf("capped domain limit = %+v, want daily cap 100 and the monthly cap kept", limit)
+	}
+	if len(capped.Domains) != 2 {
+		t.Errorf("capped domains = %v, want the domain once regardless of case", capped.Domains)
+	}
+	if limit, _ := capped.ForDomain("news.example.com"); limit.DailyCap != 200 {
+		t.Errorf("other domain limit = %+v, want it unchanged", limit)
+	}
+	if capped.DailyCap != 10000 {
+		t.Errorf("ESP daily cap = %d, want it unchanged", capped.DailyCap)
+	}
+	if limit, _ := limits.ForDomain("mail.example.com"); limit.DailyCap != 500 {
+		t.Errorf("original limits modified: %+v", limit)
+	}
+
+	if limit, _ := limits.WithDomainDailyCap("mail.example.com", 1000).ForDomain("mail.example.com"); limit.DailyCap != 500 {
+		t.Errorf("warm-up above the configured cap raised it to %d", limit.DailyCap)
+	}
+	if limit, _ := limits.WithDomainDailyCap("other.example.com", 50).ForDomain("other.example.com"); limit.DailyCap != 50 {
+		t.Errorf("uncapped domain daily cap = %d, want 50", limit.DailyCap)
+	}
+}
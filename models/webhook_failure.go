@@ -0,0 +1,273 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stages at which a webhook can fail
+const (
+	// The request body couldn't be mapped onto events
+	FailureStageParse = "parse"
+	// A normalized event couldn't be written to the event tables
+	FailureStageWrite = "write"
+)
+
+// WebhookFailure is a dead-lettered webhook payload or event
+type WebhookFailure struct {
+	ID       int64           `json:"id"`
+	UserID   int             `json:"user_id"`
+	ESPID    int             `json:"esp_id"`
+	Provider string          `json:"provider"`
+	Stage    string          `json:"stage"`
+	Error    string          `json:"error"`
+	Headers  json.RawMessage `json:"headers"`
+	// Request body, with credentials redacted
+	Payload         string     `json:"payload"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ReplayCount     int        `json:"replay_count"`
+	ReplayedAt      *time.Time `json:"replayed_at"`
+	LastReplayError *string    `json:"last_replay_error"`
+}
+
+// WebhookFailureFilter narrows the failures returned by GetWebhookFailures.
+// Zero values match everything.
+type WebhookFailureFilter struct {
+	ESPID    int
+	Provider string
+	Start    time.Time
+	End      time.Time
+	// Only failures that haven't been replayed successfully
+	PendingOnly bool
+	Limit       int
+}
+
+// Headers that carry credentials and are never stored
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+// failureHeaders encodes request headers for storage, minus credentials
+func failureHeaders(header http.Header) json.RawMessage {
+	kept := http.Header{}
+	for name, values := range header {
+		if !redactedHeaders[http.CanonicalHeaderKey(name)] {
+			kept[name] = values
+		}
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return data
+}
+
+// WebhookSource is a webhook request as it is stored: headers minus
+// credentials, and the body with any credentials redacted by the adapter
+type WebhookSource struct {
+	Headers json.RawMessage
+	Body    string
+}
+
+// NewWebhookSource keeps a request so its events can be dead-lettered as the
+// original payload
+func NewWebhookSource(header http.Header, body []byte) *WebhookSource {
+	return &WebhookSource{Headers: failureHeaders(header), Body: textPayload(string(body))}
+}
+
+// CreateParseFailure dead-letters a webhook body the provider's adapter
+// couldn't parse
+func CreateParseFailure(db *sql.DB, esp *ESP, provider string, header http.Header, body []byte, cause error) (int64, error) {
+	return createWebhookFailure(db, esp.UserID, esp.ESPID, provider, FailureStageParse,
+		cause.Error(), failureHeaders(header), string(body))
+}
+
+// CreateWriteFailure dead-letters the request an event that couldn't be
+// written came from. Replaying it parses the request again.
+func CreateWriteFailure(db *sql.DB, pe *ProviderEvent, cause error) (int64, error) {
+	if pe.Source == nil {
+		return 0, fmt.Errorf("event has no source request")
+	}
+	return createWebhookFailure(db, pe.UserID, pe.ESPID, pe.Provider, FailureStageWrite,
+		cause.Error(), pe.Source.Headers, pe.Source.Body)
+}
+
+func createWebhookFailure(db *sql.DB, userID, espID int, provider, stage, cause string, headers json.RawMessage, payload string) (int64, error) {
+	var id int64
+	err := db.QueryRow(`
+        INSERT INTO webhook_failures (user_id, esp_id, provider, stage, error, headers, payload)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id`,
+		userID, espID, provider, stage, cause, string(headers), textPayload(payload),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error storing webhook failure: %v", err)
+	}
+	return id, nil
+}
+
+// textPayload makes a request body storable in a TEXT column
+func textPayload(payload string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(payload, "\uFFFD"), "\x00", "")
+}
+
+// DeadLetterSpilledEvent moves the oldest spilled event into webhook_failures
+// so an event that can't be written doesn't block the rest of the spill. It
+// reports whether there was an event to move.
+func DeadLetterSpilledEvent(db *sql.DB, cause error) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	var sourceID sql.NullInt64
+	err = tx.QueryRow(`
+        DELETE FROM ingest_spill
+        WHERE id = (
+            SELECT id FROM ingest_spill
+            ORDER BY id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING event, source_id`).Scan(&data, &sourceID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error claiming spilled event: %v", err)
+	}
+
+	// Keep undecodable rows too, with whatever IDs we can recover
+	pe := &ProviderEvent{}
+	json.Unmarshal(data, pe)
+
+	// The request is dead-lettered rather than the event, so replay parses
+	// it again. Rows spilled before requests were kept only have the event.
+	headers, payload := "{}", string(data)
+	if sourceID.Valid {
+		err = tx.QueryRow(`SELECT headers, body FROM ingest_spill_sources WHERE id = $1`,
+			sourceID.Int64).Scan(&headers, &payload)
+		if err != nil {
+			return false, fmt.Errorf("error loading spilled event's request: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO webhook_failures (user_id, esp_id, provider, stage, error, headers, payload)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		pe.UserID, pe.ESPID, pe.Provider, FailureStageWrite, cause.Error(), headers, payload)
+	if err != nil {
+		return false, fmt.Errorf("error storing webhook failure: %v", err)
+	}
+
+	return true, tx.Commit()
+}
+
+const webhookFailureColumns = `
+        id, user_id, esp_id, provider, stage, error, headers, payload,
+        created_at, replay_count, replayed_at, last_replay_error`
+
+func scanWebhookFailure(scanner interface{ Scan(...interface{}) error }) (WebhookFailure, error) {
+	var f WebhookFailure
+	var headers []byte
+	err := scanner.Scan(
+		&f.ID, &f.UserID, &f.ESPID, &f.Provider, &f.Stage, &f.Error, &headers, &f.Payload,
+		&f.CreatedAt, &f.ReplayCount, &f.ReplayedAt, &f.LastReplayError,
+	)
+	f.Headers = headers
+	return f, err
+}
+
+// GetWebhookFailures returns a user's dead-lettered webhooks, oldest first
+func GetWebhookFailures(db *sql.DB, userID int, filter WebhookFailureFilter) ([]WebhookFailure, error) {
+	query := `SELECT` + webhookFailureColumns + `
+        FROM webhook_failures
+        WHERE user_id = $1`
+	args := []interface{}{userID}
+
+	if filter.ESPID != 0 {
+		args = append(args, filter.ESPID)
+		query += fmt.Sprintf(" AND esp_id = $%d", len(args))
+	}
+	if filter.Provider != "" {
+		args = append(args, filter.Provider)
+		query += fmt.Sprintf(" AND LOWER(provider) = LOWER($%d)", len(args))
+	}
+	if !filter.Start.IsZero() {
+		args = append(args, filter.Start)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.End.IsZero() {
+		args = append(args, filter.End)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.PendingOnly {
+		query += " AND replayed_at IS NULL"
+	}
+	query += " ORDER BY created_at, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []WebhookFailure{}
+	for rows.Next() {
+		f, err := scanWebhookFailure(rows)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+// GetWebhookFailure returns one of a user's dead-lettered webhooks
+func GetWebhookFailure(db *sql.DB, userID int, id int64) (*WebhookFailure, error) {
+	row := db.QueryRow(`SELECT`+webhookFailureColumns+`
+        FROM webhook_failures
+        WHERE user_id = $1 AND id = $2`, userID, id)
+	f, err := scanWebhookFailure(row)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// RecordWebhookFailureReplay stores the outcome of a replay. A successful
+// replay marks the failure as replayed.
+func RecordWebhookFailureReplay(db *sql.DB, id int64, replayErr error) error {
+	var err error
+	if replayErr == nil {
+		_, err = db.Exec(`
+            UPDATE webhook_failures
+            SET replay_count = replay_count + 1, replayed_at = now(), last_replay_error = NULL
+            WHERE id = $1`, id)
+	} else {
+		_, err = db.Exec(`
+            UPDATE webhook_failures
+            SET replay_count = replay_count + 1, last_replay_error = $2
+            WHERE id = $1`, id, replayErr.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("error recording replay: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNewWebhookSource(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Basic aG9va3M6czNjcmV0")
+	header.Set("Cookie", "session=1")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Twilio-Email-Event-Webhook-Signature", "sig")
+
+	source := NewWebhookSource(header, []byte("[{\"event\":\"open\x00\"}]\xff"))
+
+	var kept http.Header
+	if err := json.Unmarshal(source.Headers, &kept); err != nil {
+		t.Fatalf("decoding headers: %v", err)
+	}
+	if kept.Get("Authorization") != "" || kept.Get("Cookie") != "" {
+		t.Errorf("credentials kept: %v", kept)
+	}
+	if kept.Get("Content-Type") != "application/json" || kept.Get("X-Twilio-Email-Event-Webhook-Signature") != "sig" {
+		t.Errorf("headers the adapter parses with were dropped: %v", kept)
+	}
+	if want := "[{\"event\":\"open\"}]�"; source.Body != want {
+		t.Errorf("body = %q, want %q", source.Body, want)
+	}
+}
+
+func TestCreateWriteFailureNeedsSource(t *testing.T) {
+	pe := &ProviderEvent{UserID: 1, ESPID: 2, Provider: "sendgrid"}
+	if _, err := CreateWriteFailure(nil, pe, errors.New("connection reset")); err == nil {
+		t.Error("dead-lettered an event without its request")
+	}
+}
@@ -0,0 +1,178 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// How far a signed Mailgun timestamp may drift from our clock
+const mailgunTimestampTolerance = 10 * time.Minute
+
+// Mailgun receives Mailgun webhooks signed with the account's HTTP webhook
+// signing key
+type Mailgun struct{}
+
+// mailgunWebhook is the body of a Mailgun webhook. Mailgun posts a single
+// event per request.
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData json.RawMessage `json:"event-data"`
+}
+
+type mailgunEvent struct {
+	ID        string  `json:"id"`
+	Event     string  `json:"event"`
+	Timestamp float64 `json:"timestamp"`
+	Recipient string  `json:"recipient"`
+	Severity  string  `json:"severity"`
+	Reason    string  `json:"reason"`
+	URL       string  `json:"url"`
+	Message   struct {
+		Headers struct {
+			MessageID string `json:"message-id"`
+		} `json:"headers"`
+	} `json:"message"`
+	DeliveryStatus struct {
+		Code        int    `json:"code"`
+		Message     string `json:"message"`
+		Description string `json:"description"`
+	} `json:"delivery-status"`
+}
+
+func (Mailgun) Name() string { return "mailgun" }
+
+func (Mailgun) EventTypes() []EventType {
+	return []EventType{EventProcessed, EventDelivered, EventBounce, EventDeferred, EventDropped, EventOpen, EventUniqueOpen, EventClick, EventUniqueClick, EventSpamReport, EventUnsubscribe}
+}
+
+func (Mailgun) CredentialFields() []CredentialField {
+	return []CredentialField{
+		{Name: "webhook_signing_key", Description: "HTTP webhook signing key", Required: true, Secret: true},
+		{Name: "api_key", Description: "Private API key, for sending", Secret: true},
+		{Name: "domain", Description: "Mailgun sending domain; defaults to the From domain"},
+	}
+}
+
+// VerifyWebhook checks the signature Mailgun includes in each body, an
+// HMAC-SHA256 of the timestamp followed by the token, keyed with the ESP's
+// webhook signing key.
+func (Mailgun) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	signingKey := creds["webhook_signing_key"]
+	if signingKey == "" {
+		return ErrMissingCredentials
+	}
+
+	var wh mailgunWebhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return ErrUnauthorized
+	}
+	sig := wh.Signature
+	if sig.Timestamp == "" || sig.Token == "" || sig.Signature == "" {
+		return ErrUnauthorized
+	}
+	if err := checkTimestamp(sig.Timestamp, mailgunTimestampTolerance); err != nil {
+		return err
+	}
+
+	signature, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(sig.Timestamp + sig.Token))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (Mailgun) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	var wh mailgunWebhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return nil, err
+	}
+	if len(wh.EventData) == 0 {
+		return nil, fmt.Errorf("missing event-data")
+	}
+
+	var me mailgunEvent
+	if err := json.Unmarshal(wh.EventData, &me); err != nil {
+		return nil, err
+	}
+
+	ev := NormalizedEvent{
+		EventID:   me.ID,
+		MessageID: me.Message.Headers.MessageID,
+		Recipient: me.Recipient,
+		Reason:    me.DeliveryStatus.Description,
+		// Only the event is stored, not the signature
+		Raw: wh.EventData,
+	}
+	if ev.Reason == "" {
+		ev.Reason = me.DeliveryStatus.Message
+	}
+
+	switch me.Event {
+	case "accepted":
+		ev.Type = EventProcessed
+	case "delivered":
+		ev.Type = EventDelivered
+	case "failed":
+		if me.Severity == "temporary" {
+			ev.Type = EventDeferred
+			break
+		}
+		ev.Type, ev.BounceType = mailgunFailure(me.Reason)
+		if ev.Type == EventDropped {
+			ev.Reason = me.Reason
+		}
+	case "opened":
+		ev.Type = EventOpen
+	case "clicked":
+		ev.Type = EventClick
+		ev.URL = me.URL
+	case "complained":
+		ev.Type = EventSpamReport
+	case "unsubscribed":
+		ev.Type = EventUnsubscribe
+	default:
+		return nil, nil
+	}
+
+	if ev.MessageID == "" {
+		return nil, fmt.Errorf("missing message-id")
+	}
+	if me.Timestamp <= 0 {
+		return nil, fmt.Errorf("missing timestamp")
+	}
+	sec, frac := math.Modf(me.Timestamp)
+	ev.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+
+	return []NormalizedEvent{ev}, nil
+}
+
+// mailgunFailure classifies a permanent failure by its reason. Messages to
+// suppressed recipients were never attempted, so they are drops.
+func mailgunFailure(reason string) (EventType, string) {
+	switch reason {
+	case "suppress-bounce", "suppress-complaint", "suppress-unsubscribe":
+		return EventDropped, ""
+	case "espblock":
+		return EventBounce, BounceTypeBlock
+	case "old":
+		// Gave up after retrying temporary failures
+		return EventBounce, BounceTypeSoft
+	default:
+		return EventBounce, BounceTypeHard
+	}
+}
@@ -0,0 +1,88 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// DefaultEndpoint is Mailgun's US region; EU accounts use
+// https://api.eu.mailgun.net
+func (Mailgun) DefaultEndpoint(creds Credentials) string { return "https://api.mailgun.net" }
+
+// Send posts the message to the Messages API of the ESP's sending domain,
+// defaulting to the From domain. Mailgun's message ID is returned without
+// its angle brackets, as webhooks report it.
+func (Mailgun) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	apiKey := creds["api_key"]
+	if apiKey == "" {
+		return "", ErrMissingCredentials
+	}
+	domain := creds["domain"]
+	if domain == "" {
+		domain = msg.From.Domain()
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := [][2]string{{"from", msg.From.String()}, {"subject", msg.Subject}}
+	for _, a := range msg.To {
+		fields = append(fields, [2]string{"to", a.String()})
+	}
+	for _, a := range msg.CC {
+		fields = append(fields, [2]string{"cc", a.String()})
+	}
+	for _, a := range msg.BCC {
+		fields = append(fields, [2]string{"bcc", a.String()})
+	}
+	if msg.Text != "" {
+		fields = append(fields, [2]string{"text", msg.Text})
+	}
+	if msg.HTML != "" {
+		fields = append(fields, [2]string{"html", msg.HTML})
+	}
+	for name, value := range msg.Headers {
+		fields = append(fields, [2]string{"h:" + name, value})
+	}
+	for name, value := range msg.Metadata {
+		fields = append(fields, [2]string{"v:" + name, value})
+	}
+	for _, f := range fields {
+		if err := form.WriteField(f[0], f[1]); err != nil {
+			return "", err
+		}
+	}
+	for _, a := range msg.Attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", multipart.FileContentDisposition("attachment", a.Filename))
+		header.Set("Content-Type", attachmentType(a))
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		part.Write(a.Content)
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	u := strings.TrimSuffix(endpoint, "/") + "/v3/" + url.PathEscape(domain) + "/messages"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", apiKey)
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if _, err := doSend(client, req, "mailgun", &result); err != nil {
+		return "", err
+	}
+	return strings.Trim(result.ID, "<>"), nil
+}
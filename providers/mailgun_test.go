@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedMailgunBody builds a Mailgun webhook body signed with key at the
+// given time
+func signedMailgunBody(t *testing.T, key string, at time.Time) []byte {
+	t.Helper()
+	var wh mailgunWebhook
+	wh.Signature.Timestamp = strconv.FormatInt(at.Unix(), 10)
+	wh.Signature.Token = "0123456789abcdef"
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(wh.Signature.Timestamp + wh.Signature.Token))
+	wh.Signature.Signature = hex.EncodeToString(mac.Sum(nil))
+	wh.EventData = json.RawMessage(`{"id":"ev1","event":"opened","timestamp":1700000000.5,"recipient":"a@example.org","message":{"headers":{"message-id":"m1"}}}`)
+
+	body, err := json.Marshal(wh)
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	return body
+}
+
+func TestMailgunVerifyWebhook(t *testing.T) {
+	creds := Credentials{"webhook_signing_key": "key-1"}
+	tests := []struct {
+		name  string
+		body  []byte
+		creds Credentials
+		want  error
+	}{
+		{"valid", signedMailgunBody(t, "key-1", time.Now()), creds, nil},
+		{"other key", signedMailgunBody(t, "key-2", time.Now()), creds, ErrInvalidSignature},
+		{"stale", signedMailgunBody(t, "key-1", time.Now().Add(-time.Hour)), creds, ErrStaleTimestamp},
+		{"unsigned", []byte(`{"event-data":{}}`), creds, ErrUnauthorized},
+		{"unconfigured", signedMailgunBody(t, "key-1", time.Now()), Credentials{}, ErrMissingCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (Mailgun{}).VerifyWebhook(nil, tt.body, tt.creds); !errors.Is(err, tt.want) {
+				t.Errorf("VerifyWebhook = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMailgunEventTypesCoverRecordedOpens(t *testing.T) {
+	events, err := Mailgun{}.ParseWebhook(nil, signedMailgunBody(t, "key-1", time.Now()))
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != EventOpen || events[0].MessageID != "m1" {
+		t.Fatalf("events = %+v", events)
+	}
+	// Opens are also recorded as unique_open
+	if !hasEventType(Mailgun{}, EventUniqueOpen) {
+		t.Errorf("EventTypes() = %v, missing %s", Mailgun{}.EventTypes(), EventUniqueOpen)
+	}
+}
+
+func hasEventType(a Adapter, eventType EventType) bool {
+	for _, t := range a.EventTypes() {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidMessage wraps validation errors of outgoing messages
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Address is an email address with an optional display name. In JSON it
+// may be written as an object or as a string like "Name <user@example.com>".
+type Address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := mail.ParseAddress(s)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", s)
+		}
+		a.Email, a.Name = parsed.Address, parsed.Name
+		return nil
+	}
+
+	type plain Address
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+// String formats the address for a message header
+func (a Address) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Domain returns the part of the address after the @
+func (a Address) Domain() string {
+	at := strings.LastIndex(a.Email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(a.Email[at+1:])
+}
+
+// Attachment is a file sent with a message. Content is base64 in JSON.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// Message is a provider-neutral outgoing email
+type Message struct {
+	From        Address           `json:"from"`
+	To          []Address         `json:"to"`
+	CC          []Address         `json:"cc,omitempty"`
+	BCC         []Address         `json:"bcc,omitempty"`
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	// Passed to the provider so it comes back on webhook events where supported
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Headers that buildMIME writes itself, so custom headers can't set them
+var reservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Subject": true, "Date": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// Validate checks the message has everything every provider requires
+func (m *Message) Validate() error {
+	if err := m.ValidateEnvelope(); err != nil {
+		return err
+	}
+	if m.Subject == "" {
+		return fmt.Errorf("%w: subject is required", ErrInvalidMessage)
+	}
+	if m.Text == "" && m.HTML == "" {
+		return fmt.Errorf("%w: text or html content is required", ErrInvalidMessage)
+	}
+	for _, a := range m.Attachments {
+		if a.Filename == "" {
+			return fmt.Errorf("%w: attachments need a filename", ErrInvalidMessage)
+		}
+	}
+	return nil
+}
+
+// ValidateEnvelope checks the sender, the recipients and that custom
+// headers can be written safely, without requiring any content. It is
+// enough for mail parsed from MIME, which may have no subject or body.
+func (m *Message) ValidateEnvelope() error {
+	if _, err := mail.ParseAddress(m.From.Email); err != nil {
+		return fmt.Errorf("%w: from address is required", ErrInvalidMessage)
+	}
+	if len(m.To)+len(m.CC)+len(m.BCC) == 0 {
+		return fmt.Errorf("%w: at least one recipient is required", ErrInvalidMessage)
+	}
+	for _, list := range [][]Address{m.To, m.CC, m.BCC} {
+		for _, a := range list {
+			if _, err := mail.ParseAddress(a.Email); err != nil {
+				return fmt.Errorf("%w: invalid recipient %q", ErrInvalidMessage, a.Email)
+			}
+		}
+	}
+	for name, value := range m.Headers {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return fmt.Errorf("%w: invalid header name %q", ErrInvalidMessage, name)
+		}
+		if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("%w: header %q is set from the message fields", ErrInvalidMessage, name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%w: header %q contains a line break", ErrInvalidMessage, name)
+		}
+	}
+	return nil
+}
+
+// Recipients returns every envelope recipient of the message
+func (m *Message) Recipients() []Address {
+	all := make([]Address, 0, len(m.To)+len(m.CC)+len(m.BCC))
+	all = append(all, m.To...)
+	all = append(all, m.CC...)
+	return append(all, m.BCC...)
+}
+
+// Sender is implemented by adapters that can submit messages through the
+// provider's send API
+type Sender interface {
+	// DefaultEndpoint is the base URL of the provider's send API
+	DefaultEndpoint(creds Credentials) string
+	// Send submits the message to the API at endpoint and returns the
+	// message ID the provider's webhooks will report
+	Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error)
+}
+
+// SMTPRelayer is implemented by adapters whose provider also accepts mail
+// over SMTP, logging in with the ESP's API credentials
+type SMTPRelayer interface {
+	// SMTPRelay returns the provider's SMTP submission address ("host:port")
+	// and the username and password to authenticate with
+	SMTPRelay(creds Credentials) (addr, username, password string, err error)
+}
+
+// SendError is a provider API rejecting a message
+type SendError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%s send failed with status %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the provider might accept the message later
+func (e *SendError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// doSend performs an API request and decodes a successful JSON response
+// into out, if given. Non-2xx responses become SendErrors.
+func doSend(client *http.Client, req *http.Request, provider string, out interface{}) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s send failed: %v", provider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s send failed: %v", provider, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &SendError{Provider: provider, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if out != nil && len(body) > 0 {
+		if err := json.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("%s send returned an invalid response: %v", provider, err)
+		}
+	}
+	return resp, nil
+}
+
+// newJSONRequest builds a POST request with a JSON body
+func newJSONRequest(ctx context.Context, url string, payload interface{}) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// attachmentType returns the attachment's content type, guessing from the
+// filename when it isn't set
+func attachmentType(a Attachment) string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(a.Filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func joinAddresses(addrs []Address) string {
+	formatted := make([]string, len(addrs))
+	for i, a := range addrs {
+		formatted[i] = a.String()
+	}
+	return strings.Join(formatted, ", ")
+}
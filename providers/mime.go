@@ -0,0 +1,206 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildMIME renders a message as RFC 5322 MIME for providers that take raw
+// messages. BCC recipients are left out of the headers.
+func buildMIME(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	headers := [][2]string{
+		{"From", msg.From.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().UTC().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+	}
+	if len(msg.To) > 0 {
+		headers = append(headers, [2]string{"To", joinAddresses(msg.To)})
+	}
+	if len(msg.CC) > 0 {
+		headers = append(headers, [2]string{"Cc", joinAddresses(msg.CC)})
+	}
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, [2]string{textproto.CanonicalMIMEHeaderKey(name), msg.Headers[name]})
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixed.Boundary())
+
+	var altBody bytes.Buffer
+	alt := multipart.NewWriter(&altBody)
+	for _, part := range [][2]string{{"text/plain", msg.Text}, {"text/html", msg.HTML}} {
+		if part[1] == "" {
+			continue
+		}
+		w, err := alt.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(part[1]))
+		qp.Close()
+	}
+	alt.Close()
+
+	w, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alt.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Write(altBody.Bytes())
+
+	for _, a := range msg.Attachments {
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachmentType(a)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Content)
+		for len(encoded) > 76 {
+			fmt.Fprintf(w, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(w, "%s\r\n", encoded)
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Headers that ParseMIME maps onto Message fields or that describe the
+// message structure, rather than copying them into Message.Headers
+var structuralHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Subject": true,
+	"Date": true, "Message-Id": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+	"Received": true, "Return-Path": true,
+}
+
+// ParseMIME reads an RFC 5322 message into a Message. The first text/plain
+// and text/html parts become the bodies and parts with a filename become
+// attachments. Recipients come from the To and Cc headers.
+func ParseMIME(raw []byte) (*Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	msg := &Message{Headers: map[string]string{}}
+	from, err := m.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return nil, fmt.Errorf("%w: invalid From header", ErrInvalidMessage)
+	}
+	msg.From = Address{Email: from[0].Address, Name: from[0].Name}
+	for _, h := range []struct {
+		name string
+		list *[]Address
+	}{{"To", &msg.To}, {"Cc", &msg.CC}} {
+		addrs, err := m.Header.AddressList(h.name)
+		if err != nil && err != mail.ErrHeaderNotPresent {
+			return nil, fmt.Errorf("%w: invalid %s header", ErrInvalidMessage, h.name)
+		}
+		for _, a := range addrs {
+			*h.list = append(*h.list, Address{Email: a.Address, Name: a.Name})
+		}
+	}
+
+	var decoder mime.WordDecoder
+	msg.Subject = m.Header.Get("Subject")
+	if subject, err := decoder.DecodeHeader(msg.Subject); err == nil {
+		msg.Subject = subject
+	}
+	for name, values := range m.Header {
+		if !structuralHeaders[textproto.CanonicalMIMEHeaderKey(name)] && len(values) > 0 {
+			msg.Headers[name] = values[0]
+		}
+	}
+
+	if err := parsePart(msg, textproto.MIMEHeader(m.Header), m.Body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return msg, nil
+}
+
+// parsePart walks a MIME part, recursing into multiparts
+func parsePart(msg *Message, header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := parsePart(msg, part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	_, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case filename != "":
+		msg.Attachments = append(msg.Attachments, Attachment{Filename: filename, ContentType: mediaType, Content: content})
+	case mediaType == "text/plain" && msg.Text == "":
+		msg.Text = string(content)
+	case mediaType == "text/html" && msg.HTML == "":
+		msg.HTML = string(content)
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
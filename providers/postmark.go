@@ -0,0 +1,125 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Postmark receives Postmark webhooks authenticated with basic auth
+type Postmark struct{}
+
+// postmarkRecord covers the fields we use from every Postmark webhook record
+// type. Postmark posts a single record per request.
+type postmarkRecord struct {
+	RecordType        string `json:"RecordType"`
+	MessageID         string `json:"MessageID"`
+	Recipient         string `json:"Recipient"`
+	Email             string `json:"Email"`
+	Type              string `json:"Type"`
+	TypeCode          int    `json:"TypeCode"`
+	Description       string `json:"Description"`
+	DeliveredAt       string `json:"DeliveredAt"`
+	BouncedAt         string `json:"BouncedAt"`
+	ReceivedAt        string `json:"ReceivedAt"`
+	ChangedAt         string `json:"ChangedAt"`
+	SuppressSending   bool   `json:"SuppressSending"`
+	SuppressionReason string `json:"SuppressionReason"`
+	OriginalLink      string `json:"OriginalLink"`
+}
+
+func (Postmark) Name() string { return "postmark" }
+
+func (Postmark) EventTypes() []EventType {
+	return []EventType{EventDelivered, EventBounce, EventOpen, EventUniqueOpen, EventDropped, EventClick, EventUniqueClick, EventSpamReport, EventUnsubscribe}
+}
+
+func (Postmark) CredentialFields() []CredentialField {
+	return append(basicAuthFields[:len(basicAuthFields):len(basicAuthFields)],
+		CredentialField{Name: "server_token", Description: "Server API token, for sending", Secret: true})
+}
+
+func (Postmark) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	return checkBasicAuth(r, creds["webhook_user"], creds["webhook_password"])
+}
+
+func (Postmark) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	var pr postmarkRecord
+	if err := json.Unmarshal(body, &pr); err != nil {
+		return nil, err
+	}
+
+	ev := NormalizedEvent{
+		MessageID: pr.MessageID,
+		Recipient: pr.Recipient,
+		Raw:       body,
+	}
+	if ev.Recipient == "" {
+		ev.Recipient = pr.Email
+	}
+
+	var at string
+	switch pr.RecordType {
+	case "Delivery":
+		ev.Type = EventDelivered
+		at = pr.DeliveredAt
+	case "Bounce":
+		ev.Type = EventBounce
+		ev.BounceType = postmarkBounceType(pr.TypeCode)
+		ev.Reason = pr.Description
+		at = pr.BouncedAt
+	case "SpamComplaint":
+		ev.Type = EventSpamReport
+		ev.Reason = pr.Description
+		at = pr.BouncedAt
+	case "Open":
+		ev.Type = EventOpen
+		at = pr.ReceivedAt
+	case "Click":
+		ev.Type = EventClick
+		ev.URL = pr.OriginalLink
+		at = pr.ReceivedAt
+	case "SubscriptionChange":
+		// Only suppressions affect delivery; reactivations are ignored
+		if !pr.SuppressSending {
+			return nil, nil
+		}
+		// Recipients unsubscribing show up as manual suppressions
+		if pr.SuppressionReason == "ManualSuppression" {
+			ev.Type = EventUnsubscribe
+		} else {
+			ev.Type = EventDropped
+		}
+		ev.Reason = pr.SuppressionReason
+		at = pr.ChangedAt
+	default:
+		return nil, nil
+	}
+
+	if ev.MessageID == "" {
+		return nil, fmt.Errorf("missing MessageID")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", at)
+	}
+	ev.Timestamp = timestamp
+
+	return []NormalizedEvent{ev}, nil
+}
+
+// postmarkBounceType classifies a Postmark bounce TypeCode
+func postmarkBounceType(typeCode int) string {
+	switch typeCode {
+	case 1, 16, 100000, 100002: // HardBounce, Unsubscribe, BadEmailAddress, ManuallyDeactivated
+		return BounceTypeHard
+	case 512, 100001: // SpamNotification, SpamComplaint
+		return BounceTypeComplaint
+	case 1024, 8192, 100006, 100009: // OpenRelayTest, VirusNotification, Blocked, DMARCPolicy
+		return BounceTypeBlock
+	default:
+		return BounceTypeSoft
+	}
+}
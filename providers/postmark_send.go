@@ -0,0 +1,93 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type postmarkEmail struct {
+	From        string               `json:"From"`
+	To          string               `json:"To,omitempty"`
+	Cc          string               `json:"Cc,omitempty"`
+	Bcc         string               `json:"Bcc,omitempty"`
+	Subject     string               `json:"Subject"`
+	TextBody    string               `json:"TextBody,omitempty"`
+	HtmlBody    string               `json:"HtmlBody,omitempty"`
+	Headers     []postmarkHeader     `json:"Headers,omitempty"`
+	Attachments []postmarkAttachment `json:"Attachments,omitempty"`
+	Metadata    map[string]string    `json:"Metadata,omitempty"`
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+}
+
+// SMTPRelay logs in to Postmark's SMTP service with the server token as
+// both username and password
+func (Postmark) SMTPRelay(creds Credentials) (string, string, string, error) {
+	if creds["server_token"] == "" {
+		return "", "", "", ErrMissingCredentials
+	}
+	return "smtp.postmarkapp.com:587", creds["server_token"], creds["server_token"], nil
+}
+
+func (Postmark) DefaultEndpoint(creds Credentials) string { return "https://api.postmarkapp.com" }
+
+// Send submits the message to the Email API with the server token
+func (Postmark) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	token := creds["server_token"]
+	if token == "" {
+		return "", ErrMissingCredentials
+	}
+
+	payload := postmarkEmail{
+		From:     msg.From.String(),
+		To:       joinAddresses(msg.To),
+		Cc:       joinAddresses(msg.CC),
+		Bcc:      joinAddresses(msg.BCC),
+		Subject:  msg.Subject,
+		TextBody: msg.Text,
+		HtmlBody: msg.HTML,
+		Metadata: msg.Metadata,
+	}
+	for name, value := range msg.Headers {
+		payload.Headers = append(payload.Headers, postmarkHeader{Name: name, Value: value})
+	}
+	for _, a := range msg.Attachments {
+		payload.Attachments = append(payload.Attachments, postmarkAttachment{
+			Name:        a.Filename,
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			ContentType: attachmentType(a),
+		})
+	}
+
+	req, err := newJSONRequest(ctx, strings.TrimSuffix(endpoint, "/")+"/email", payload)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", token)
+
+	var result struct {
+		ErrorCode int    `json:"ErrorCode"`
+		Message   string `json:"Message"`
+		MessageID string `json:"MessageID"`
+	}
+	if _, err := doSend(client, req, "postmark", &result); err != nil {
+		return "", err
+	}
+	if result.ErrorCode != 0 {
+		return "", fmt.Errorf("postmark send failed with error code %d: %s", result.ErrorCode, result.Message)
+	}
+	return result.MessageID, nil
+}
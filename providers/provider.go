@@ -0,0 +1,276 @@
+// Package providers holds one adapter per supported ESP. Each adapter knows
+// how to authenticate that provider's webhooks and translate its payloads
+// into NormalizedEvents, and is registered at startup so the rest of the
+// service can ask the registry which providers and event types exist.
+package providers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is one of our canonical event types
+type EventType string
+
+const (
+	EventProcessed  EventType = "processed"
+	EventDelivered  EventType = "delivered"
+	EventBounce     EventType = "bounce"
+	EventDeferred   EventType = "deferred"
+	EventUniqueOpen EventType = "unique_open"
+	EventOpen       EventType = "open"
+	EventDropped    EventType = "dropped"
+	// The first click on a message is also recorded as its unique click
+	EventUniqueClick EventType = "unique_click"
+	EventClick       EventType = "click"
+	// Feedback-loop complaints
+	EventSpamReport  EventType = "spam_report"
+	EventUnsubscribe EventType = "unsubscribe"
+)
+
+// Normalized bounce types. Providers that report a subtype append it after
+// a colon, e.g. "hard:NoEmail"; see BounceClass.
+const (
+	BounceTypeHard  = "hard"
+	BounceTypeSoft  = "soft"
+	BounceTypeBlock = "block"
+	// Some providers report spam complaints as a kind of bounce
+	BounceTypeComplaint = "complaint"
+)
+
+// BounceClass returns the normalized bounce type of a bounce type that may
+// carry a provider subtype
+func BounceClass(bounceType string) string {
+	class, _, _ := strings.Cut(bounceType, ":")
+	return class
+}
+
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrMissingCredentials = errors.New("webhook credentials not configured")
+	ErrInvalidSignature   = errors.New("invalid webhook signature")
+	ErrStaleTimestamp     = errors.New("webhook timestamp outside of tolerance")
+)
+
+// NormalizedEvent is a single provider event mapped onto our schema
+type NormalizedEvent struct {
+	// The provider's unique ID for the event, when it sends one
+	EventID    string          `json:"event_id,omitempty"`
+	Type       EventType       `json:"type"`
+	MessageID  string          `json:"message_id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Recipient  string          `json:"recipient"`
+	Reason     string          `json:"reason,omitempty"`
+	BounceType string          `json:"bounce_type,omitempty"`
+	URL        string          `json:"url,omitempty"`
+	Raw        json.RawMessage `json:"raw"`
+}
+
+// Credentials are the webhook secrets stored on an ESP, keyed by the field
+// names in the provider's credential schema
+type Credentials map[string]string
+
+// CredentialField describes one field of a provider's credential document
+type CredentialField struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	// Secret fields hold passwords and keys rather than identifiers
+	Secret bool `json:"secret"`
+}
+
+// Adapter is implemented by every supported ESP
+type Adapter interface {
+	// Name is the provider name stored on ESPs, e.g. "sendgrid"
+	Name() string
+	// EventTypes lists the event types the provider's webhooks can produce
+	EventTypes() []EventType
+	// CredentialFields declares the credential document stored on the
+	// provider's ESPs
+	CredentialFields() []CredentialField
+	// VerifyWebhook authenticates a webhook request against the ESP's credentials
+	VerifyWebhook(r *http.Request, body []byte, creds Credentials) error
+	// ParseWebhook maps a webhook body onto normalized events, skipping
+	// provider events we don't track
+	ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error)
+}
+
+// Handshaker is implemented by adapters whose webhook setup sends a
+// validation request that must be answered with a specific body, or
+// confirmed out of band.
+type Handshaker interface {
+	// Handshake reports whether the (already verified) request is a
+	// validation request and, if so, the body to respond with. An error
+	// means the handshake couldn't be completed.
+	Handshake(r *http.Request, body []byte, creds Credentials) ([]byte, bool, error)
+}
+
+// Redactor is implemented by adapters whose webhook bodies carry
+// credentials, so the bodies can be stored without them
+type Redactor interface {
+	// RedactWebhook returns the body with its credentials blanked out. It
+	// must cope with bodies ParseWebhook rejects, and keep the rest of the
+	// body parseable.
+	RedactWebhook(r *http.Request, body []byte) []byte
+}
+
+// RedactWebhook strips credentials from a webhook body before it is stored,
+// if the adapter sends any in the body
+func RedactWebhook(a Adapter, r *http.Request, body []byte) []byte {
+	if redactor, ok := a.(Redactor); ok {
+		return redactor.RedactWebhook(r, body)
+	}
+	return body
+}
+
+var (
+	mu       sync.RWMutex
+	adapters = map[string]Adapter{}
+)
+
+// Register makes an adapter available by name. It panics if an adapter with
+// the same name is already registered.
+func Register(a Adapter) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := strings.ToLower(a.Name())
+	if _, dup := adapters[name]; dup {
+		panic("providers: Register called twice for provider " + name)
+	}
+	adapters[name] = a
+}
+
+// Get returns the adapter registered for a provider name, ignoring case
+func Get(name string) (Adapter, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	a, ok := adapters[strings.ToLower(name)]
+	return a, ok
+}
+
+// Names returns the sorted names of all registered providers
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(adapters))
+	for name := range adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EventTypes returns the sorted union of the event types of all registered
+// providers
+func EventTypes() []EventType {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	seen := map[EventType]bool{}
+	var types []EventType
+	for _, a := range adapters {
+		for _, t := range a.EventTypes() {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// IsValidEventType reports whether any registered provider produces the event type
+func IsValidEventType(eventType string) bool {
+	for _, t := range EventTypes() {
+		if string(t) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateCredentials checks an ESP's credential document against its
+// provider's schema: every required field must be set and no unknown fields
+// are allowed
+func ValidateCredentials(provider string, creds Credentials) error {
+	a, ok := Get(provider)
+	if !ok {
+		return fmt.Errorf("unknown provider: %s", provider)
+	}
+
+	known := map[string]bool{}
+	for _, field := range a.CredentialFields() {
+		known[field.Name] = true
+		if field.Required && creds[field.Name] == "" {
+			return fmt.Errorf("missing %s credential: %s", a.Name(), field.Name)
+		}
+	}
+	for name := range creds {
+		if !known[name] {
+			return fmt.Errorf("unknown %s credential: %s", a.Name(), name)
+		}
+	}
+	return nil
+}
+
+// checkTimestamp rejects unix timestamps that are further than tolerance
+// away from the current time, to limit replayed requests.
+func checkTimestamp(timestamp string, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	return checkTime(time.Unix(ts, 0), tolerance)
+}
+
+// checkTime rejects times further than tolerance away from the current time
+func checkTime(t time.Time, tolerance time.Duration) error {
+	diff := time.Since(t)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return ErrStaleTimestamp
+	}
+
+	return nil
+}
+
+// basicAuthFields is the credential schema of providers that authenticate
+// webhooks with basic auth
+var basicAuthFields = []CredentialField{
+	{Name: "webhook_user", Description: "Webhook basic auth user", Required: true},
+	{Name: "webhook_password", Description: "Webhook basic auth password", Required: true, Secret: true},
+}
+
+// checkBasicAuth compares the request's basic auth credentials with the ones
+// configured on the ESP. An ESP without credentials rejects every request.
+func checkBasicAuth(r *http.Request, user, password string) error {
+	if user == "" || password == "" {
+		return ErrMissingCredentials
+	}
+
+	reqUser, reqPassword, ok := r.BasicAuth()
+	if !ok {
+		return ErrUnauthorized
+	}
+
+	userMatch := subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) == 1
+	if !userMatch || !passwordMatch {
+		return ErrUnauthorized
+	}
+	return nil
+}
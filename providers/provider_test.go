@@ -0,0 +1,63 @@
+package providers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClickEventsCarryLink(t *testing.T) {
+	const link = "https://example.org/pricing?utm_source=mail"
+	tests := []struct {
+		name        string
+		adapter     Adapter
+		contentType string
+		body        string
+	}{
+		{
+			name:    "sendgrid",
+			adapter: SendGrid{},
+			body:    `[{"event":"click","sg_message_id":"m1.filter","email":"a@example.org","timestamp":1700000000,"url":"` + link + `"}]`,
+		},
+		{
+			name:    "sparkpost",
+			adapter: SparkPost{},
+			body:    `[{"msys":{"track_event":{"type":"click","transmission_id":"m1","rcpt_to":"a@example.org","timestamp":"1700000000","target_link_url":"` + link + `"}}}]`,
+		},
+		{
+			name:    "postmark",
+			adapter: Postmark{},
+			body:    `{"RecordType":"Click","MessageID":"m1","Recipient":"a@example.org","ReceivedAt":"2023-11-14T22:13:20Z","OriginalLink":"` + link + `"}`,
+		},
+		{
+			name:        "socketlabs",
+			adapter:     SocketLabs{},
+			contentType: "application/json",
+			body:        `{"Type":"Tracking","TrackingType":0,"MessageId":"m1","Address":"a@example.org","DateTime":"2023-11-14T22:13:20Z","Url":"` + link + `"}`,
+		},
+		{
+			name:    "mailgun",
+			adapter: Mailgun{},
+			body:    `{"event-data":{"event":"clicked","timestamp":1700000000,"recipient":"a@example.org","url":"` + link + `","message":{"headers":{"message-id":"m1"}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			events, err := tt.adapter.ParseWebhook(r, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("ParseWebhook: %v", err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			ev := events[0]
+			if ev.Type != EventClick || ev.URL != link || ev.MessageID != "m1" || ev.Recipient != "a@example.org" {
+				t.Errorf("event = %+v", ev)
+			}
+			if !hasEventType(tt.adapter, EventClick) || !hasEventType(tt.adapter, EventUniqueClick) {
+				t.Errorf("EventTypes() = %v, missing click types", tt.adapter.EventTypes())
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package providers
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How far a signed SendGrid timestamp may drift from our clock
+const sendgridTimestampTolerance = 10 * time.Minute
+
+// SendGrid receives the signed SendGrid Event Webhook
+type SendGrid struct{}
+
+// sendgridEvent is a single entry of a SendGrid Event Webhook batch
+type sendgridEvent struct {
+	Email       string `json:"email"`
+	Timestamp   int64  `json:"timestamp"`
+	Event       string `json:"event"`
+	SGEventID   string `json:"sg_event_id"`
+	SGMessageID string `json:"sg_message_id"`
+	Reason      string `json:"reason"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+}
+
+// sendgridEventTypes maps SendGrid event names onto our event types
+var sendgridEventTypes = map[string]EventType{
+	"processed":         EventProcessed,
+	"delivered":         EventDelivered,
+	"deferred":          EventDeferred,
+	"bounce":            EventBounce,
+	"dropped":           EventDropped,
+	"open":              EventOpen,
+	"click":             EventClick,
+	"spamreport":        EventSpamReport,
+	"unsubscribe":       EventUnsubscribe,
+	"group_unsubscribe": EventUnsubscribe,
+}
+
+func (SendGrid) Name() string { return "sendgrid" }
+
+func (SendGrid) EventTypes() []EventType {
+	return []EventType{EventProcessed, EventDelivered, EventDeferred, EventBounce, EventDropped, EventOpen, EventUniqueOpen, EventClick, EventUniqueClick, EventSpamReport, EventUnsubscribe}
+}
+
+func (SendGrid) CredentialFields() []CredentialField {
+	return []CredentialField{
+		{Name: "verification_key", Description: "Base64 encoded public key of the signed Event Webhook", Required: true},
+		{Name: "api_key", Description: "API key with Mail Send access, for sending", Secret: true},
+	}
+}
+
+// VerifyWebhook checks the ECDSA signature SendGrid attaches to each request.
+// The verification key is the base64 encoded public key shown in the
+// SendGrid settings, and the signed payload is the timestamp header followed
+// by the raw request body.
+func (SendGrid) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	verificationKey := creds["verification_key"]
+	if verificationKey == "" {
+		return ErrMissingCredentials
+	}
+
+	signature := r.Header.Get("X-Twilio-Email-Event-Webhook-Signature")
+	timestamp := r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp")
+	if signature == "" || timestamp == "" {
+		return ErrUnauthorized
+	}
+	if err := checkTimestamp(timestamp, sendgridTimestampTolerance); err != nil {
+		return err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(verificationKey)
+	if err != nil {
+		return ErrMissingCredentials
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return ErrMissingCredentials
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrMissingCredentials
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(publicKey, hash[:], sig) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func (SendGrid) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+
+	var events []NormalizedEvent
+	for _, raw := range batch {
+		var se sendgridEvent
+		if err := json.Unmarshal(raw, &se); err != nil {
+			return nil, err
+		}
+
+		eventType, ok := sendgridEventTypes[se.Event]
+		if !ok || se.SGMessageID == "" {
+			continue
+		}
+
+		ev := NormalizedEvent{
+			EventID: se.SGEventID,
+			Type:    eventType,
+			// sg_message_id is the X-Message-Id returned on send plus a filter suffix
+			MessageID: strings.SplitN(se.SGMessageID, ".", 2)[0],
+			Timestamp: time.Unix(se.Timestamp, 0),
+			Recipient: se.Email,
+			Reason:    se.Reason,
+			URL:       se.URL,
+			Raw:       raw,
+		}
+		if eventType == EventBounce {
+			// SendGrid reports hard bounces as "bounce" and rejections as "blocked"
+			ev.BounceType = BounceTypeHard
+			if se.Type == "blocked" {
+				ev.BounceType = BounceTypeBlock
+			}
+		}
+		events = append(events, ev)
+	}
+
+	return events, nil
+}
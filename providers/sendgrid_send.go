@@ -0,0 +1,127 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendgridMail struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendgridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+	CustomArgs       map[string]string         `json:"custom_args,omitempty"`
+}
+
+type sendgridPersonalization struct {
+	To  []sendgridAddress `json:"to,omitempty"`
+	CC  []sendgridAddress `json:"cc,omitempty"`
+	BCC []sendgridAddress `json:"bcc,omitempty"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content  string `json:"content"`
+	Filename string `json:"filename"`
+	Type     string `json:"type,omitempty"`
+}
+
+func sendgridAddresses(addrs []Address) []sendgridAddress {
+	out := make([]sendgridAddress, len(addrs))
+	for i, a := range addrs {
+		out[i] = sendgridAddress{Email: a.Email, Name: a.Name}
+	}
+	return out
+}
+
+// sendgridPersonalizations addresses the message. SendGrid requires a "to"
+// in every personalization, so without To recipients the first CC takes its
+// place, and BCC-only messages get one personalization per recipient so
+// they still can't see each other.
+func sendgridPersonalizations(msg *Message) []sendgridPersonalization {
+	switch {
+	case len(msg.To) > 0:
+		return []sendgridPersonalization{{
+			To:  sendgridAddresses(msg.To),
+			CC:  sendgridAddresses(msg.CC),
+			BCC: sendgridAddresses(msg.BCC),
+		}}
+	case len(msg.CC) > 0:
+		return []sendgridPersonalization{{
+			To:  sendgridAddresses(msg.CC[:1]),
+			CC:  sendgridAddresses(msg.CC[1:]),
+			BCC: sendgridAddresses(msg.BCC),
+		}}
+	}
+	personalizations := make([]sendgridPersonalization, len(msg.BCC))
+	for i, a := range msg.BCC {
+		personalizations[i] = sendgridPersonalization{To: sendgridAddresses([]Address{a})}
+	}
+	return personalizations
+}
+
+// SMTPRelay logs in to SendGrid's SMTP service with the API key
+func (SendGrid) SMTPRelay(creds Credentials) (string, string, string, error) {
+	if creds["api_key"] == "" {
+		return "", "", "", ErrMissingCredentials
+	}
+	return "smtp.sendgrid.net:587", "apikey", creds["api_key"], nil
+}
+
+func (SendGrid) DefaultEndpoint(creds Credentials) string { return "https://api.sendgrid.com" }
+
+// Send submits the message to the v3 Mail Send API. The X-Message-Id
+// response header is the prefix of the sg_message_id on webhook events.
+func (SendGrid) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	apiKey := creds["api_key"]
+	if apiKey == "" {
+		return "", ErrMissingCredentials
+	}
+
+	payload := sendgridMail{
+		Personalizations: sendgridPersonalizations(msg),
+		From:             sendgridAddress{Email: msg.From.Email, Name: msg.From.Name},
+		Subject:          msg.Subject,
+		Headers:          msg.Headers,
+		CustomArgs:       msg.Metadata,
+	}
+	// SendGrid requires text/plain before text/html
+	if msg.Text != "" {
+		payload.Content = append(payload.Content, sendgridContent{Type: "text/plain", Value: msg.Text})
+	}
+	if msg.HTML != "" {
+		payload.Content = append(payload.Content, sendgridContent{Type: "text/html", Value: msg.HTML})
+	}
+	for _, a := range msg.Attachments {
+		payload.Attachments = append(payload.Attachments, sendgridAttachment{
+			Content:  base64.StdEncoding.EncodeToString(a.Content),
+			Filename: a.Filename,
+			Type:     a.ContentType,
+		})
+	}
+
+	req, err := newJSONRequest(ctx, strings.TrimSuffix(endpoint, "/")+"/v3/mail/send", payload)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := doSend(client, req, "sendgrid", nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Message-Id"), nil
+}
@@ -0,0 +1,69 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendGridSendBCCOnly(t *testing.T) {
+	var payload sendgridMail
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		w.Header().Set("X-Message-Id", "abc123")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	msg := &Message{
+		From:    Address{Email: "news@example.com"},
+		BCC:     []Address{{Email: "alice@example.org"}, {Email: "bob@example.org"}},
+		Subject: "Hello",
+		Text:    "Hi",
+	}
+	id, err := SendGrid{}.Send(context.Background(), server.Client(), server.URL, Credentials{"api_key": "key"}, msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if id != "abc123" {
+		t.Errorf("message ID = %q, want abc123", id)
+	}
+
+	if len(payload.Personalizations) != 2 {
+		t.Fatalf("got %d personalizations, want 2", len(payload.Personalizations))
+	}
+	for i, want := range []string{"alice@example.org", "bob@example.org"} {
+		p := payload.Personalizations[i]
+		if len(p.To) != 1 || p.To[0].Email != want {
+			t.Errorf("personalization %d to = %+v, want %s", i, p.To, want)
+		}
+		if len(p.CC) != 0 || len(p.BCC) != 0 {
+			t.Errorf("personalization %d has cc %+v and bcc %+v, want none", i, p.CC, p.BCC)
+		}
+	}
+}
+
+func TestSendGridPersonalizationsCCOnly(t *testing.T) {
+	msg := &Message{
+		CC:  []Address{{Email: "alice@example.org"}, {Email: "bob@example.org"}},
+		BCC: []Address{{Email: "carol@example.org"}},
+	}
+	personalizations := sendgridPersonalizations(msg)
+	if len(personalizations) != 1 {
+		t.Fatalf("got %d personalizations, want 1", len(personalizations))
+	}
+	p := personalizations[0]
+	if len(p.To) != 1 || p.To[0].Email != "alice@example.org" {
+		t.Errorf("to = %+v, want alice@example.org", p.To)
+	}
+	if len(p.CC) != 1 || p.CC[0].Email != "bob@example.org" {
+		t.Errorf("cc = %+v, want bob@example.org", p.CC)
+	}
+	if len(p.BCC) != 1 || p.BCC[0].Email != "carol@example.org" {
+		t.Errorf("bcc = %+v, want carol@example.org", p.BCC)
+	}
+}
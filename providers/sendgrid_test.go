@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedSendGridRequest signs body like SendGrid's Signed Event Webhook and
+// returns the request with the ESP credentials that verify it
+func signedSendGridRequest(t *testing.T, body []byte, at time.Time) (*http.Request, Credentials, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("encoding public key: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	r.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	return r, Credentials{"verification_key": base64.StdEncoding.EncodeToString(der)}, key
+}
+
+func TestSendGridVerifyWebhook(t *testing.T) {
+	body := []byte(`[{"event":"delivered","sg_message_id":"abc.1","timestamp":1700000000}]`)
+
+	t.Run("valid", func(t *testing.T) {
+		r, creds, _ := signedSendGridRequest(t, body, time.Now())
+		if err := (SendGrid{}).VerifyWebhook(r, body, creds); err != nil {
+			t.Errorf("VerifyWebhook: %v", err)
+		}
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		r, creds, _ := signedSendGridRequest(t, body, time.Now())
+		tampered := []byte(`[{"event":"bounce","sg_message_id":"abc.1","timestamp":1700000000}]`)
+		if err := (SendGrid{}).VerifyWebhook(r, tampered, creds); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("err = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("stale timestamp", func(t *testing.T) {
+		r, creds, _ := signedSendGridRequest(t, body, time.Now().Add(-time.Hour))
+		if err := (SendGrid{}).VerifyWebhook(r, body, creds); !errors.Is(err, ErrStaleTimestamp) {
+			t.Errorf("err = %v, want ErrStaleTimestamp", err)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		_, creds, _ := signedSendGridRequest(t, body, time.Now())
+		r, _ := http.NewRequest(http.MethodPost, "/", nil)
+		if err := (SendGrid{}).VerifyWebhook(r, body, creds); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("err = %v, want ErrUnauthorized", err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		r, _, _ := signedSendGridRequest(t, body, time.Now())
+		if err := (SendGrid{}).VerifyWebhook(r, body, Credentials{}); !errors.Is(err, ErrMissingCredentials) {
+			t.Errorf("err = %v, want ErrMissingCredentials", err)
+		}
+	})
+}
+
+func TestCheckBasicAuth(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.SetBasicAuth("hooks", "s3cret")
+
+	if err := checkBasicAuth(r, "hooks", "s3cret"); err != nil {
+		t.Errorf("matching credentials: %v", err)
+	}
+	if err := checkBasicAuth(r, "hooks", "other"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("wrong password: err = %v, want ErrUnauthorized", err)
+	}
+	if err := checkBasicAuth(r, "", ""); !errors.Is(err, ErrMissingCredentials) {
+		t.Errorf("unconfigured: err = %v, want ErrMissingCredentials", err)
+	}
+	unauthenticated, _ := http.NewRequest(http.MethodPost, "/", nil)
+	if err := checkBasicAuth(unauthenticated, "hooks", "s3cret"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("no auth: err = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,460 @@
+package providers
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How far a signed SNS message's timestamp may drift from our clock
+const snsTimestampTolerance = 10 * time.Minute
+
+// SES receives Amazon SES event notifications delivered by SNS over HTTPS.
+// SNS messages are verified against the signing certificate they name, and
+// must come from the topic configured on the ESP.
+type SES struct {
+	// Certs resolves SNS signing certificates
+	Certs CertSource
+	// Client confirms SNS subscriptions
+	Client *http.Client
+}
+
+// NewSES returns an SES adapter that verifies messages with certs
+func NewSES(certs CertSource) *SES {
+	return &SES{
+		Certs:  certs,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// CertSource resolves the certificate an SNS message was signed with
+type CertSource interface {
+	Certificate(certURL string) (*x509.Certificate, error)
+}
+
+// SNS signing certificates and subscription URLs are only trusted from
+// SNS's own endpoints
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+func checkSNSURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || !snsHostPattern.MatchString(u.Hostname()) {
+		return fmt.Errorf("untrusted SNS URL: %s", rawURL)
+	}
+	return nil
+}
+
+// SNSCertFetcher downloads SNS signing certificates from SNS and caches them
+type SNSCertFetcher struct {
+	Client *http.Client
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func NewSNSCertFetcher() *SNSCertFetcher {
+	return &SNSCertFetcher{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		certs:  map[string]*x509.Certificate{},
+	}
+}
+
+func (f *SNSCertFetcher) Certificate(certURL string) (*x509.Certificate, error) {
+	if err := checkSNSURL(certURL); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	cert, ok := f.certs[certURL]
+	f.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	resp, err := f.Client.Get(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching SNS certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching SNS certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching SNS certificate: %v", err)
+	}
+	cert, err = parseCertPEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.certs[certURL] = cert
+	f.mu.Unlock()
+	return cert, nil
+}
+
+// StaticCert verifies every SNS message with one certificate, regardless of
+// the URL it names. It stands in for SNS in local testing.
+type StaticCert struct {
+	Cert *x509.Certificate
+}
+
+// LoadCertFile reads a PEM encoded certificate for use as a StaticCert
+func LoadCertFile(path string) (StaticCert, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return StaticCert{}, err
+	}
+	cert, err := parseCertPEM(data)
+	if err != nil {
+		return StaticCert{}, err
+	}
+	return StaticCert{Cert: cert}, nil
+}
+
+func (s StaticCert) Certificate(certURL string) (*x509.Certificate, error) {
+	return s.Cert, nil
+}
+
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// snsMessage is the SNS HTTP envelope
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// stringToSign builds the canonical string SNS signs, which depends on the
+// message type
+func (m *snsMessage) stringToSign() string {
+	fields := [][2]string{{"Message", m.Message}, {"MessageId", m.MessageID}}
+	if m.Type == "Notification" {
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", m.Timestamp})
+	} else {
+		fields = append(fields,
+			[2]string{"SubscribeURL", m.SubscribeURL},
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"Token", m.Token})
+	}
+	fields = append(fields, [2]string{"TopicArn", m.TopicArn}, [2]string{"Type", m.Type})
+
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return b.String()
+}
+
+// sesEvent covers both SES event publishing records (eventType) and the
+// older SES notifications (notificationType)
+type sesEvent struct {
+	EventType        string `json:"eventType"`
+	NotificationType string `json:"notificationType"`
+	Mail             struct {
+		MessageID   string   `json:"messageId"`
+		Timestamp   string   `json:"timestamp"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Bounce *struct {
+		BounceType        string         `json:"bounceType"`
+		BounceSubType     string         `json:"bounceSubType"`
+		BouncedRecipients []sesRecipient `json:"bouncedRecipients"`
+		Timestamp         string         `json:"timestamp"`
+	} `json:"bounce"`
+	Complaint *struct {
+		ComplainedRecipients  []sesRecipient `json:"complainedRecipients"`
+		ComplaintFeedbackType string         `json:"complaintFeedbackType"`
+		Timestamp             string         `json:"timestamp"`
+	} `json:"complaint"`
+	Delivery *struct {
+		Recipients []string `json:"recipients"`
+		Timestamp  string   `json:"timestamp"`
+	} `json:"delivery"`
+	DeliveryDelay *struct {
+		DelayType         string         `json:"delayType"`
+		DelayedRecipients []sesRecipient `json:"delayedRecipients"`
+		Timestamp         string         `json:"timestamp"`
+	} `json:"deliveryDelay"`
+	Open *struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"open"`
+	Click *struct {
+		Link      string `json:"link"`
+		Timestamp string `json:"timestamp"`
+	} `json:"click"`
+}
+
+type sesRecipient struct {
+	EmailAddress   string `json:"emailAddress"`
+	DiagnosticCode string `json:"diagnosticCode"`
+}
+
+func (*SES) Name() string { return "ses" }
+
+func (*SES) EventTypes() []EventType {
+	return []EventType{EventProcessed, EventDelivered, EventBounce, EventDeferred, EventOpen, EventUniqueOpen, EventClick, EventUniqueClick, EventSpamReport}
+}
+
+func (*SES) CredentialFields() []CredentialField {
+	return []CredentialField{
+		{Name: "topic_arn", Description: "ARN of the SNS topic SES publishes events to", Required: true},
+		{Name: "region", Description: "AWS region to send from, e.g. us-east-1"},
+		{Name: "access_key_id", Description: "IAM access key ID allowed to send, for sending"},
+		{Name: "secret_access_key", Description: "IAM secret access key, for sending", Secret: true},
+	}
+}
+
+// VerifyWebhook checks the SNS signature, that the message comes from the
+// topic configured as the ESP's topic_arn, and that it was sent recently
+func (s *SES) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	topicArn := creds["topic_arn"]
+	if topicArn == "" {
+		return ErrMissingCredentials
+	}
+
+	var m snsMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ErrUnauthorized
+	}
+	if m.TopicArn != topicArn {
+		return ErrUnauthorized
+	}
+	timestamp, err := time.Parse(time.RFC3339, m.Timestamp)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	if err := checkTime(timestamp, snsTimestampTolerance); err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	var algorithm x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		algorithm = x509.SHA1WithRSA
+	case "2":
+		algorithm = x509.SHA256WithRSA
+	default:
+		return ErrInvalidSignature
+	}
+
+	cert, err := s.Certs.Certificate(m.SigningCertURL)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if err := cert.CheckSignature(algorithm, []byte(m.stringToSign()), signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Handshake confirms SNS subscriptions by visiting the SubscribeURL, and
+// acknowledges unsubscribe confirmations
+func (s *SES) Handshake(r *http.Request, body []byte, creds Credentials) ([]byte, bool, error) {
+	var m snsMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, false, nil
+	}
+
+	switch m.Type {
+	case "SubscriptionConfirmation":
+		if err := checkSNSURL(m.SubscribeURL); err != nil {
+			return nil, true, err
+		}
+		resp, err := s.Client.Get(m.SubscribeURL)
+		if err != nil {
+			return nil, true, fmt.Errorf("error confirming SNS subscription: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, true, fmt.Errorf("error confirming SNS subscription: %s", resp.Status)
+		}
+		return nil, true, nil
+	case "UnsubscribeConfirmation":
+		return nil, true, nil
+	}
+	return nil, false, nil
+}
+
+func (*SES) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	var m snsMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	if m.Type != "Notification" {
+		return nil, nil
+	}
+
+	var se sesEvent
+	if err := json.Unmarshal([]byte(m.Message), &se); err != nil {
+		return nil, fmt.Errorf("invalid SES message: %v", err)
+	}
+	if se.Mail.MessageID == "" {
+		return nil, fmt.Errorf("missing mail.messageId")
+	}
+
+	eventType := se.EventType
+	if eventType == "" {
+		eventType = se.NotificationType
+	}
+
+	// SES reports some events once for several recipients; each recipient
+	// becomes its own event, keyed by the SNS message ID and the recipient
+	var events []NormalizedEvent
+	add := func(t EventType, recipient, at string, fill func(*NormalizedEvent)) error {
+		timestamp, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %s", at)
+		}
+		ev := NormalizedEvent{
+			EventID:   m.MessageID + ":" + recipient,
+			Type:      t,
+			MessageID: se.Mail.MessageID,
+			Timestamp: timestamp,
+			Recipient: recipient,
+			Raw:       json.RawMessage(m.Message),
+		}
+		if fill != nil {
+			fill(&ev)
+		}
+		events = append(events, ev)
+		return nil
+	}
+
+	var firstRecipient string
+	if len(se.Mail.Destination) > 0 {
+		firstRecipient = se.Mail.Destination[0]
+	}
+
+	var err error
+	switch eventType {
+	case "Send":
+		err = add(EventProcessed, firstRecipient, se.Mail.Timestamp, nil)
+	case "Delivery":
+		if se.Delivery == nil {
+			return nil, fmt.Errorf("missing delivery")
+		}
+		for _, rcpt := range se.Delivery.Recipients {
+			if err = add(EventDelivered, rcpt, se.Delivery.Timestamp, nil); err != nil {
+				break
+			}
+		}
+	case "Bounce":
+		if se.Bounce == nil {
+			return nil, fmt.Errorf("missing bounce")
+		}
+		bounceType := sesBounceType(se.Bounce.BounceType, se.Bounce.BounceSubType)
+		for _, rcpt := range se.Bounce.BouncedRecipients {
+			reason := rcpt.DiagnosticCode
+			if reason == "" {
+				reason = se.Bounce.BounceType + "/" + se.Bounce.BounceSubType
+			}
+			err = add(EventBounce, rcpt.EmailAddress, se.Bounce.Timestamp, func(ev *NormalizedEvent) {
+				ev.BounceType = bounceType
+				ev.Reason = reason
+			})
+			if err != nil {
+				break
+			}
+		}
+	case "Complaint":
+		if se.Complaint == nil {
+			return nil, fmt.Errorf("missing complaint")
+		}
+		for _, rcpt := range se.Complaint.ComplainedRecipients {
+			err = add(EventSpamReport, rcpt.EmailAddress, se.Complaint.Timestamp, func(ev *NormalizedEvent) {
+				ev.Reason = se.Complaint.ComplaintFeedbackType
+			})
+			if err != nil {
+				break
+			}
+		}
+	case "DeliveryDelay":
+		if se.DeliveryDelay == nil {
+			return nil, fmt.Errorf("missing deliveryDelay")
+		}
+		for _, rcpt := range se.DeliveryDelay.DelayedRecipients {
+			reason := rcpt.DiagnosticCode
+			if reason == "" {
+				reason = se.DeliveryDelay.DelayType
+			}
+			err = add(EventDeferred, rcpt.EmailAddress, se.DeliveryDelay.Timestamp, func(ev *NormalizedEvent) {
+				ev.Reason = reason
+			})
+			if err != nil {
+				break
+			}
+		}
+	case "Open":
+		if se.Open == nil {
+			return nil, fmt.Errorf("missing open")
+		}
+		err = add(EventOpen, firstRecipient, se.Open.Timestamp, nil)
+	case "Click":
+		if se.Click == nil {
+			return nil, fmt.Errorf("missing click")
+		}
+		err = add(EventClick, firstRecipient, se.Click.Timestamp, func(ev *NormalizedEvent) {
+			ev.URL = se.Click.Link
+		})
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// sesBounceType classifies an SES bounce by its type and subtype, keeping
+// the subtype, e.g. "hard:NoEmail"
+func sesBounceType(bounceType, subType string) string {
+	class := BounceTypeSoft
+	switch bounceType {
+	case "Permanent":
+		class = BounceTypeHard
+	case "Transient":
+		switch subType {
+		case "ContentRejected", "AttachmentRejected":
+			class = BounceTypeBlock
+		}
+	}
+	if subType == "" {
+		return class
+	}
+	return class + ":" + subType
+}
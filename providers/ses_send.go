@@ -0,0 +1,172 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type sesSendEmail struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses  []string `json:"ToAddresses,omitempty"`
+		CcAddresses  []string `json:"CcAddresses,omitempty"`
+		BccAddresses []string `json:"BccAddresses,omitempty"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+	EmailTags []sesTag `json:"EmailTags,omitempty"`
+}
+
+type sesTag struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+func sesAddresses(addrs []Address) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
+
+// Longest tag name or value SES accepts
+const maxSESTagLength = 256
+
+// sesTags turns metadata into message tags. SES rejects the whole message
+// if a tag has characters other than letters, digits and _-.@, so others
+// are replaced with underscores and long names and values are cut short.
+func sesTags(metadata map[string]string) []sesTag {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tags []sesTag
+	seen := map[string]bool{}
+	for _, name := range names {
+		tag := sesTag{Name: sesTagText(name), Value: sesTagText(metadata[name])}
+		if tag.Name == "" || tag.Value == "" || seen[tag.Name] {
+			continue
+		}
+		seen[tag.Name] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func sesTagText(s string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '-', r == '.', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+	if len(mapped) > maxSESTagLength {
+		mapped = mapped[:maxSESTagLength]
+	}
+	return mapped
+}
+
+func (*SES) DefaultEndpoint(creds Credentials) string {
+	return "https://email." + creds["region"] + ".amazonaws.com"
+}
+
+// Send submits the message as a raw MIME message to the SES v2 SendEmail
+// API, signed with the ESP's access key. Metadata becomes message tags.
+func (*SES) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	accessKey, secretKey, region := creds["access_key_id"], creds["secret_access_key"], creds["region"]
+	if accessKey == "" || secretKey == "" || region == "" {
+		return "", ErrMissingCredentials
+	}
+
+	raw, err := buildMIME(msg)
+	if err != nil {
+		return "", err
+	}
+
+	var payload sesSendEmail
+	payload.FromEmailAddress = msg.From.String()
+	payload.Destination.ToAddresses = sesAddresses(msg.To)
+	payload.Destination.CcAddresses = sesAddresses(msg.CC)
+	payload.Destination.BccAddresses = sesAddresses(msg.BCC)
+	payload.Content.Raw.Data = raw
+	payload.EmailTags = sesTags(msg.Metadata)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(endpoint, "/")+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signSigV4(req, body, accessKey, secretKey, region, "ses", time.Now().UTC())
+
+	var result struct {
+		MessageID string `json:"MessageId"`
+	}
+	if _, err := doSend(client, req, "ses", &result); err != nil {
+		return "", err
+	}
+	return result.MessageID, nil
+}
+
+// signSigV4 adds an AWS Signature Version 4 Authorization header to a
+// request without a query string
+func signSigV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := sha256.Sum256(body)
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
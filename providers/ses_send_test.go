@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSESTags(t *testing.T) {
+	tags := sesTags(map[string]string{
+		"campaign":     "spring sale/2024",
+		"order id":     "1234",
+		"order_id":     "5678",
+		"user@example": "a.b-c_d",
+		"long":         strings.Repeat("x", 300),
+		"empty":        "",
+	})
+
+	want := []sesTag{
+		{Name: "campaign", Value: "spring_sale_2024"},
+		{Name: "long", Value: strings.Repeat("x", maxSESTagLength)},
+		{Name: "order_id", Value: "1234"},
+		{Name: "user@example", Value: "a.b-c_d"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("sesTags = %+v, want %+v", tags, want)
+	}
+}
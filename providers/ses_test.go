@@ -0,0 +1,292 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTopicArn = "arn:aws:sns:us-east-1:123456789012:ses-events"
+
+var (
+	snsKeyOnce sync.Once
+	snsKey     *rsa.PrivateKey
+	snsCert    *x509.Certificate
+)
+
+// standInCert generates a self-signed certificate standing in for SNS's
+// signing certificate
+func standInCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	snsKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf("creating certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("parsing certificate: %v", err)
+		}
+		snsKey, snsCert = key, cert
+	})
+	if snsKey == nil {
+		t.Fatal("no stand-in certificate")
+	}
+	return snsKey, snsCert
+}
+
+// signSNS signs the message with the stand-in key using its signature version
+func signSNS(t *testing.T, m *snsMessage) []byte {
+	t.Helper()
+	key, _ := standInCert(t)
+
+	var hash crypto.Hash
+	var digest []byte
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA1, sum[:]
+	default:
+		sum := sha256.Sum256([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA256, sum[:]
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	return body
+}
+
+func testSES(t *testing.T) *SES {
+	_, cert := standInCert(t)
+	return NewSES(StaticCert{Cert: cert})
+}
+
+func notification(version, message string) *snsMessage {
+	return &snsMessage{
+		Type:             "Notification",
+		MessageID:        "sns-1",
+		TopicArn:         testTopicArn,
+		Message:          message,
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: version,
+		SigningCertURL:   "https://sns.us-east-1.amazonaws.com/cert.pem",
+	}
+}
+
+func TestSESVerifyWebhook(t *testing.T) {
+	ses := testSES(t)
+	creds := Credentials{"topic_arn": testTopicArn}
+
+	for _, version := range []string{"1", "2"} {
+		t.Run("version "+version, func(t *testing.T) {
+			body := signSNS(t, notification(version, `{"eventType":"Send"}`))
+			if err := ses.VerifyWebhook(nil, body, creds); err != nil {
+				t.Errorf("VerifyWebhook: %v", err)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		m := notification("2", `{"eventType":"Send"}`)
+		signSNS(t, m)
+		m.Message = `{"eventType":"Bounce"}`
+		body, _ := json.Marshal(m)
+		if err := ses.VerifyWebhook(nil, body, creds); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("err = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		m := notification("2", `{"eventType":"Send"}`)
+		m.Timestamp = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		body := signSNS(t, m)
+		if err := ses.VerifyWebhook(nil, body, creds); !errors.Is(err, ErrStaleTimestamp) {
+			t.Errorf("err = %v, want ErrStaleTimestamp", err)
+		}
+	})
+
+	t.Run("unknown signature version", func(t *testing.T) {
+		m := notification("2", `{"eventType":"Send"}`)
+		signSNS(t, m)
+		m.SignatureVersion = "3"
+		body, _ := json.Marshal(m)
+		if err := ses.VerifyWebhook(nil, body, creds); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("err = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("topic mismatch", func(t *testing.T) {
+		m := notification("2", `{"eventType":"Send"}`)
+		m.TopicArn = "arn:aws:sns:us-east-1:123456789012:other"
+		body := signSNS(t, m)
+		if err := ses.VerifyWebhook(nil, body, creds); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("err = %v, want ErrUnauthorized", err)
+		}
+	})
+
+	t.Run("missing topic", func(t *testing.T) {
+		body := signSNS(t, notification("2", `{"eventType":"Send"}`))
+		if err := ses.VerifyWebhook(nil, body, Credentials{}); !errors.Is(err, ErrMissingCredentials) {
+			t.Errorf("err = %v, want ErrMissingCredentials", err)
+		}
+	})
+}
+
+// roundTripFunc lets tests answer HTTP requests without a network
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestSESSubscriptionConfirmation(t *testing.T) {
+	ses := testSES(t)
+	var visited string
+	ses.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		visited = r.URL.String()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	})}
+
+	subscribeURL := "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=abc"
+	m := &snsMessage{
+		Type:             "SubscriptionConfirmation",
+		MessageID:        "sns-2",
+		Token:            "abc",
+		TopicArn:         testTopicArn,
+		Message:          "You have chosen to subscribe to the topic",
+		SubscribeURL:     subscribeURL,
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "1",
+		SigningCertURL:   "https://sns.us-east-1.amazonaws.com/cert.pem",
+	}
+	body := signSNS(t, m)
+
+	creds := Credentials{"topic_arn": testTopicArn}
+	if err := ses.VerifyWebhook(nil, body, creds); err != nil {
+		t.Fatalf("VerifyWebhook: %v", err)
+	}
+	_, handled, err := ses.Handshake(nil, body, creds)
+	if err != nil || !handled {
+		t.Fatalf("Handshake = %v, %v; want handled", handled, err)
+	}
+	if visited != subscribeURL {
+		t.Errorf("visited %q, want %q", visited, subscribeURL)
+	}
+
+	events, err := ses.ParseWebhook(nil, body)
+	if err != nil || len(events) != 0 {
+		t.Errorf("ParseWebhook = %v, %v; want no events", events, err)
+	}
+
+	// Subscription URLs outside SNS are never visited
+	visited = ""
+	m.SubscribeURL = "https://example.com/confirm"
+	body = signSNS(t, m)
+	if _, handled, err := ses.Handshake(nil, body, creds); err == nil || !handled {
+		t.Errorf("Handshake with untrusted URL = %v, %v; want an error", handled, err)
+	}
+	if visited != "" {
+		t.Errorf("visited untrusted URL %q", visited)
+	}
+}
+
+func TestSESBounceType(t *testing.T) {
+	tests := []struct {
+		bounceType, subType, want string
+	}{
+		{"Permanent", "General", "hard:General"},
+		{"Permanent", "NoEmail", "hard:NoEmail"},
+		{"Permanent", "Suppressed", "hard:Suppressed"},
+		{"Transient", "General", "soft:General"},
+		{"Transient", "MailboxFull", "soft:MailboxFull"},
+		{"Transient", "ContentRejected", "block:ContentRejected"},
+		{"Transient", "AttachmentRejected", "block:AttachmentRejected"},
+		{"Undetermined", "Undetermined", "soft:Undetermined"},
+		{"Permanent", "", BounceTypeHard},
+	}
+	for _, tt := range tests {
+		got := sesBounceType(tt.bounceType, tt.subType)
+		if got != tt.want {
+			t.Errorf("sesBounceType(%s, %s) = %s, want %s", tt.bounceType, tt.subType, got, tt.want)
+		}
+		if class, _, _ := strings.Cut(tt.want, ":"); BounceClass(got) != class {
+			t.Errorf("BounceClass(%s) = %s, want %s", got, BounceClass(got), class)
+		}
+	}
+}
+
+func TestSESParseBounce(t *testing.T) {
+	message := `{
+		"eventType": "Bounce",
+		"mail": {"messageId": "ses-msg-1", "timestamp": "2024-01-02T03:04:00.000Z", "destination": ["a@example.org", "b@example.org"]},
+		"bounce": {
+			"bounceType": "Permanent",
+			"bounceSubType": "NoEmail",
+			"timestamp": "2024-01-02T03:04:05.000Z",
+			"bouncedRecipients": [
+				{"emailAddress": "a@example.org", "diagnosticCode": "550 5.1.1 user unknown"},
+				{"emailAddress": "b@example.org"}
+			]
+		}
+	}`
+	body := signSNS(t, notification("2", message))
+
+	events, err := testSES(t).ParseWebhook(nil, body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for i, want := range []struct{ recipient, reason string }{
+		{"a@example.org", "550 5.1.1 user unknown"},
+		{"b@example.org", "Permanent/NoEmail"},
+	} {
+		ev := events[i]
+		if ev.Type != EventBounce || ev.BounceType != "hard:NoEmail" || ev.MessageID != "ses-msg-1" {
+			t.Errorf("event %d = %+v", i, ev)
+		}
+		if ev.Recipient != want.recipient || ev.Reason != want.reason {
+			t.Errorf("event %d recipient %s reason %q, want %s %q", i, ev.Recipient, ev.Reason, want.recipient, want.reason)
+		}
+		if ev.EventID != "sns-1:"+want.recipient {
+			t.Errorf("event %d ID = %s", i, ev.EventID)
+		}
+	}
+}
+
+func TestSESEventTypesCoverRecordedOpens(t *testing.T) {
+	// Opens are also recorded as unique_open
+	if !hasEventType(testSES(t), EventUniqueOpen) {
+		t.Errorf("EventTypes() = %v, missing %s", testSES(t).EventTypes(), EventUniqueOpen)
+	}
+}
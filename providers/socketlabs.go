@@ -0,0 +1,212 @@
+package providers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SocketLabs receives the SocketLabs Event Webhook. Every post, including
+// the validation handshake, carries the server ID and secret key.
+type SocketLabs struct{}
+
+type socketlabsEvent struct {
+	Type         string      `json:"Type"`
+	DateTime     string      `json:"DateTime"`
+	MessageID    string      `json:"MessageId"`
+	Address      string      `json:"Address"`
+	ServerID     json.Number `json:"ServerId"`
+	SecretKey    string      `json:"SecretKey"`
+	FailureType  string      `json:"FailureType"`
+	FailureCode  json.Number `json:"FailureCode"`
+	Reason       string      `json:"Reason"`
+	TrackingType json.Number `json:"TrackingType"`
+	URL          string      `json:"Url"`
+}
+
+// SocketLabs tracking types
+const (
+	socketlabsTrackingClick       = "0"
+	socketlabsTrackingOpen        = "1"
+	socketlabsTrackingUnsubscribe = "2"
+)
+
+func (SocketLabs) Name() string { return "socketlabs" }
+
+func (SocketLabs) EventTypes() []EventType {
+	return []EventType{EventDelivered, EventBounce, EventDeferred, EventOpen, EventUniqueOpen, EventClick, EventUniqueClick, EventSpamReport, EventUnsubscribe}
+}
+
+func (SocketLabs) CredentialFields() []CredentialField {
+	return []CredentialField{
+		{Name: "server_id", Description: "SocketLabs server ID", Required: true},
+		{Name: "secret_key", Description: "Event Webhook secret key", Required: true, Secret: true},
+		{Name: "validation_key", Description: "Event Webhook validation key, answered to the validation post"},
+		{Name: "api_key", Description: "Injection API key, for sending", Secret: true},
+	}
+}
+
+// VerifyWebhook rejects posts that don't come from the server configured on
+// the ESP
+func (SocketLabs) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	serverID := creds["server_id"]
+	secretKey := creds["secret_key"]
+	if serverID == "" || secretKey == "" {
+		return ErrMissingCredentials
+	}
+
+	se, _, err := parseSocketLabsEvent(r, body)
+	if err != nil {
+		return ErrUnauthorized
+	}
+
+	if se.ServerID.String() != serverID ||
+		subtle.ConstantTimeCompare([]byte(se.SecretKey), []byte(secretKey)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Handshake answers the validation post SocketLabs sends when the webhook is
+// configured, which expects the endpoint's validation key echoed back to
+// confirm the URL.
+func (SocketLabs) Handshake(r *http.Request, body []byte, creds Credentials) ([]byte, bool, error) {
+	se, _, err := parseSocketLabsEvent(r, body)
+	if err != nil || se.Type != "Validation" {
+		return nil, false, nil
+	}
+	if creds["validation_key"] == "" {
+		return nil, false, fmt.Errorf("%w: validation_key", ErrMissingCredentials)
+	}
+	return []byte(creds["validation_key"]), true, nil
+}
+
+func (SocketLabs) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	se, raw, err := parseSocketLabsEvent(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := NormalizedEvent{
+		MessageID: se.MessageID,
+		Recipient: se.Address,
+		Raw:       raw,
+	}
+
+	switch se.Type {
+	case "Delivered":
+		ev.Type = EventDelivered
+	case "Failed":
+		ev.Type = EventBounce
+		ev.BounceType = socketlabsBounceType(se.FailureType)
+		ev.Reason = se.Reason
+	case "Deferred":
+		ev.Type = EventDeferred
+		ev.Reason = se.Reason
+	case "Complaint":
+		ev.Type = EventSpamReport
+	case "Tracking":
+		switch se.TrackingType.String() {
+		case socketlabsTrackingOpen:
+			ev.Type = EventOpen
+		case socketlabsTrackingClick:
+			ev.Type = EventClick
+			ev.URL = se.URL
+		case socketlabsTrackingUnsubscribe:
+			ev.Type = EventUnsubscribe
+		default:
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+
+	if ev.MessageID == "" {
+		return nil, fmt.Errorf("missing MessageId")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, se.DateTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", se.DateTime)
+	}
+	ev.Timestamp = timestamp
+
+	return []NormalizedEvent{ev}, nil
+}
+
+// parseSocketLabsEvent decodes a post in either the JSON format or the legacy
+// form-encoded format, returning the event and its JSON representation.
+func parseSocketLabsEvent(r *http.Request, body []byte) (*socketlabsEvent, json.RawMessage, error) {
+	se := &socketlabsEvent{}
+	fields := map[string]interface{}{}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := json.Unmarshal(body, se); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for key := range form {
+			fields[key] = form.Get(key)
+		}
+		*se = socketlabsEvent{
+			Type:         form.Get("Type"),
+			DateTime:     form.Get("DateTime"),
+			MessageID:    form.Get("MessageId"),
+			Address:      form.Get("Address"),
+			ServerID:     json.Number(form.Get("ServerId")),
+			SecretKey:    form.Get("SecretKey"),
+			FailureType:  form.Get("FailureType"),
+			FailureCode:  json.Number(form.Get("FailureCode")),
+			Reason:       form.Get("Reason"),
+			TrackingType: json.Number(form.Get("TrackingType")),
+			URL:          form.Get("Url"),
+		}
+	}
+
+	// Keep the secret out of the payload we store
+	delete(fields, "SecretKey")
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return se, raw, nil
+}
+
+// SecretKey fields in JSON and form-encoded posts, matched textually so
+// malformed bodies are redacted too
+var (
+	socketlabsJSONSecret = regexp.MustCompile(`("SecretKey"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	socketlabsFormSecret = regexp.MustCompile(`((?:^|&)SecretKey=)[^&]*`)
+)
+
+// RedactWebhook blanks the secret key every SocketLabs post carries
+func (SocketLabs) RedactWebhook(r *http.Request, body []byte) []byte {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return socketlabsFormSecret.ReplaceAll(body, []byte("${1}"))
+	}
+	return socketlabsJSONSecret.ReplaceAll(body, []byte(`${1}""`))
+}
+
+// socketlabsBounceType classifies a SocketLabs failure type
+func socketlabsBounceType(failureType string) string {
+	failureType = strings.ToLower(failureType)
+	switch {
+	case strings.Contains(failureType, "block"):
+		return BounceTypeBlock
+	case strings.Contains(failureType, "hard"), strings.Contains(failureType, "permanent"):
+		return BounceTypeHard
+	default:
+		return BounceTypeSoft
+	}
+}
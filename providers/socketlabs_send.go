@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type socketlabsInjection struct {
+	ServerID int                 `json:"serverId"`
+	Messages []socketlabsMessage `json:"Messages"`
+}
+
+type socketlabsMessage struct {
+	To            []socketlabsAddress    `json:"To"`
+	Cc            []socketlabsAddress    `json:"Cc,omitempty"`
+	Bcc           []socketlabsAddress    `json:"Bcc,omitempty"`
+	From          socketlabsAddress      `json:"From"`
+	Subject       string                 `json:"Subject"`
+	TextBody      string                 `json:"TextBody,omitempty"`
+	HtmlBody      string                 `json:"HtmlBody,omitempty"`
+	MessageID     string                 `json:"MessageId"`
+	CustomHeaders []socketlabsHeader     `json:"CustomHeaders,omitempty"`
+	Attachments   []socketlabsAttachment `json:"Attachments,omitempty"`
+	Metadata      []socketlabsHeader     `json:"Metadata,omitempty"`
+}
+
+type socketlabsAddress struct {
+	EmailAddress string `json:"EmailAddress"`
+	FriendlyName string `json:"FriendlyName,omitempty"`
+}
+
+type socketlabsHeader struct {
+	Name  string `json:"Name,omitempty"`
+	Key   string `json:"Key,omitempty"`
+	Value string `json:"Value"`
+}
+
+type socketlabsAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+}
+
+func socketlabsAddresses(addrs []Address) []socketlabsAddress {
+	out := make([]socketlabsAddress, len(addrs))
+	for i, a := range addrs {
+		out[i] = socketlabsAddress{EmailAddress: a.Email, FriendlyName: a.Name}
+	}
+	return out
+}
+
+func (SocketLabs) DefaultEndpoint(creds Credentials) string {
+	return "https://inject.api.socketlabs.com"
+}
+
+// Send submits the message to the Injection API. SocketLabs reports the
+// MessageId we assign on its webhook events, so we generate one.
+func (SocketLabs) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	apiKey := creds["api_key"]
+	serverID, err := strconv.Atoi(creds["server_id"])
+	if apiKey == "" || err != nil {
+		return "", ErrMissingCredentials
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	messageID := hex.EncodeToString(id)
+
+	m := socketlabsMessage{
+		To:        socketlabsAddresses(msg.To),
+		Cc:        socketlabsAddresses(msg.CC),
+		Bcc:       socketlabsAddresses(msg.BCC),
+		From:      socketlabsAddress{EmailAddress: msg.From.Email, FriendlyName: msg.From.Name},
+		Subject:   msg.Subject,
+		TextBody:  msg.Text,
+		HtmlBody:  msg.HTML,
+		MessageID: messageID,
+	}
+	for name, value := range msg.Headers {
+		m.CustomHeaders = append(m.CustomHeaders, socketlabsHeader{Name: name, Value: value})
+	}
+	for key, value := range msg.Metadata {
+		m.Metadata = append(m.Metadata, socketlabsHeader{Key: key, Value: value})
+	}
+	for _, a := range msg.Attachments {
+		m.Attachments = append(m.Attachments, socketlabsAttachment{
+			Name:        a.Filename,
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			ContentType: attachmentType(a),
+		})
+	}
+
+	payload := socketlabsInjection{ServerID: serverID, Messages: []socketlabsMessage{m}}
+	req, err := newJSONRequest(ctx, strings.TrimSuffix(endpoint, "/")+"/api/v1/email", payload)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	var result struct {
+		ErrorCode string `json:"ErrorCode"`
+	}
+	if _, err := doSend(client, req, "socketlabs", &result); err != nil {
+		return "", err
+	}
+	if result.ErrorCode != "" && result.ErrorCode != "Success" {
+		return "", fmt.Errorf("socketlabs send failed: %s", result.ErrorCode)
+	}
+	return messageID, nil
+}
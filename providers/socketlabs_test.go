@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSocketLabsRedactWebhook(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"Type":"Delivered","SecretKey":"s3cr\"et","ServerId":1}`,
+			want:        `{"Type":"Delivered","SecretKey":"","ServerId":1}`,
+		},
+		{
+			name:        "malformed json",
+			contentType: "application/json",
+			body:        `{"Type":"Delivered", "SecretKey" : "s3cret", "MessageId":`,
+			want:        `{"Type":"Delivered", "SecretKey" : "", "MessageId":`,
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "SecretKey=s3cret&Type=Delivered&XSecretKey=keep",
+			want:        "SecretKey=&Type=Delivered&XSecretKey=keep",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			got := string(RedactWebhook(SocketLabs{}, r, []byte(tt.body)))
+			if got != tt.want {
+				t.Errorf("RedactWebhook = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSocketLabsRedactedBodyStillParses(t *testing.T) {
+	body := `{"Type":"Delivered","DateTime":"2024-01-02T03:04:05Z","MessageId":"m1","Address":"a@example.org","ServerId":1,"SecretKey":"s3cret"}`
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Content-Type", "application/json")
+
+	redacted := RedactWebhook(SocketLabs{}, r, []byte(body))
+	if strings.Contains(string(redacted), "s3cret") {
+		t.Fatalf("secret still in %s", redacted)
+	}
+	events, err := SocketLabs{}.ParseWebhook(r, redacted)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != EventDelivered || events[0].MessageID != "m1" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestSocketLabsHandshakeEchoesValidationKey(t *testing.T) {
+	body := []byte(`{"Type":"Validation","ServerId":1,"SecretKey":"s3cret"}`)
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Content-Type", "application/json")
+
+	creds := Credentials{"server_id": "1", "secret_key": "s3cret", "validation_key": "v-key"}
+	response, ok, err := SocketLabs{}.Handshake(r, body, creds)
+	if err != nil || !ok || string(response) != "v-key" {
+		t.Errorf("Handshake = %q, %v, %v; want v-key", response, ok, err)
+	}
+
+	delete(creds, "validation_key")
+	if _, _, err := (SocketLabs{}).Handshake(r, body, creds); err == nil {
+		t.Error("Handshake without a validation key succeeded")
+	}
+}
+
+func TestSocketLabsVerifyWebhook(t *testing.T) {
+	creds := Credentials{"server_id": "1234", "secret_key": "s3cret"}
+	tests := []struct {
+		name  string
+		body  string
+		creds Credentials
+		want  error
+	}{
+		{"matching", `{"Type":"Delivered","ServerId":1234,"SecretKey":"s3cret"}`, creds, nil},
+		{"wrong secret", `{"Type":"Delivered","ServerId":1234,"SecretKey":"guess"}`, creds, ErrUnauthorized},
+		{"wrong server", `{"Type":"Delivered","ServerId":99,"SecretKey":"s3cret"}`, creds, ErrUnauthorized},
+		{"no secret", `{"Type":"Delivered","ServerId":1234}`, creds, ErrUnauthorized},
+		{"malformed", `{"Type":`, creds, ErrUnauthorized},
+		{"unconfigured", `{"Type":"Delivered","ServerId":1234,"SecretKey":"s3cret"}`, Credentials{"server_id": "1234"}, ErrMissingCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Content-Type", "application/json")
+			err := SocketLabs{}.VerifyWebhook(r, []byte(tt.body), tt.creds)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("VerifyWebhook = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
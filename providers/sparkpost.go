@@ -0,0 +1,132 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SparkPost receives SparkPost webhooks authenticated with basic auth
+type SparkPost struct{}
+
+// sparkpostEnvelope is a single entry of a SparkPost webhook batch. Each
+// entry wraps exactly one event under the key for its event class.
+type sparkpostEnvelope struct {
+	Msys map[string]json.RawMessage `json:"msys"`
+}
+
+type sparkpostEvent struct {
+	Type           string `json:"type"`
+	EventID        string `json:"event_id"`
+	MessageID      string `json:"message_id"`
+	TransmissionID string `json:"transmission_id"`
+	Timestamp      string `json:"timestamp"`
+	RcptTo         string `json:"rcpt_to"`
+	BounceClass    string `json:"bounce_class"`
+	Reason         string `json:"reason"`
+	RawReason      string `json:"raw_reason"`
+	TargetLinkURL  string `json:"target_link_url"`
+}
+
+// sparkpostEventTypes maps SparkPost event names onto our event types.
+// SparkPost reports a message's first open as both initial_open and open, so
+// only open is recorded; initial_open and amp_initial_open are ignored.
+var sparkpostEventTypes = map[string]EventType{
+	"injection":            EventProcessed,
+	"delivery":             EventDelivered,
+	"bounce":               EventBounce,
+	"out_of_band":          EventBounce,
+	"delay":                EventDeferred,
+	"policy_rejection":     EventDropped,
+	"generation_failure":   EventDropped,
+	"generation_rejection": EventDropped,
+	"open":                 EventOpen,
+	"amp_open":             EventOpen,
+	"click":                EventClick,
+	"amp_click":            EventClick,
+	"spam_complaint":       EventSpamReport,
+	"list_unsubscribe":     EventUnsubscribe,
+	"link_unsubscribe":     EventUnsubscribe,
+}
+
+func (SparkPost) Name() string { return "sparkpost" }
+
+func (SparkPost) EventTypes() []EventType {
+	return []EventType{EventProcessed, EventDelivered, EventBounce, EventDeferred, EventDropped, EventOpen, EventUniqueOpen, EventClick, EventUniqueClick, EventSpamReport, EventUnsubscribe}
+}
+
+func (SparkPost) CredentialFields() []CredentialField {
+	return append(basicAuthFields[:len(basicAuthFields):len(basicAuthFields)],
+		CredentialField{Name: "api_key", Description: "API key with Transmissions access, for sending", Secret: true})
+}
+
+func (SparkPost) VerifyWebhook(r *http.Request, body []byte, creds Credentials) error {
+	return checkBasicAuth(r, creds["webhook_user"], creds["webhook_password"])
+}
+
+func (SparkPost) ParseWebhook(r *http.Request, body []byte) ([]NormalizedEvent, error) {
+	var batch []sparkpostEnvelope
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+
+	var events []NormalizedEvent
+	for _, envelope := range batch {
+		// SparkPost sends an empty msys object when testing the webhook
+		for _, raw := range envelope.Msys {
+			var se sparkpostEvent
+			if err := json.Unmarshal(raw, &se); err != nil {
+				return nil, err
+			}
+
+			eventType, ok := sparkpostEventTypes[se.Type]
+			if !ok {
+				continue
+			}
+
+			// Sends are tracked by transmission ID, which every event carries
+			messageID := se.TransmissionID
+			if messageID == "" {
+				messageID = se.MessageID
+			}
+			if messageID == "" {
+				continue
+			}
+
+			timestamp, err := strconv.ParseInt(se.Timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q: %v", se.Timestamp, err)
+			}
+			ev := NormalizedEvent{
+				EventID:   se.EventID,
+				Type:      eventType,
+				MessageID: messageID,
+				Timestamp: time.Unix(timestamp, 0),
+				Recipient: se.RcptTo,
+				Reason:    se.Reason,
+				URL:       se.TargetLinkURL,
+				Raw:       raw,
+			}
+			if eventType == EventBounce {
+				ev.BounceType = sparkpostBounceType(se.BounceClass)
+			}
+			events = append(events, ev)
+		}
+	}
+
+	return events, nil
+}
+
+// sparkpostBounceType classifies a SparkPost bounce class code
+func sparkpostBounceType(bounceClass string) string {
+	switch bounceClass {
+	case "10", "25", "30", "90":
+		return BounceTypeHard
+	case "50", "51", "52", "53", "54":
+		return BounceTypeBlock
+	default:
+		return BounceTypeSoft
+	}
+}
@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+type sparkpostTransmission struct {
+	Recipients []sparkpostRecipient `json:"recipients"`
+	Content    sparkpostContent     `json:"content"`
+	Metadata   map[string]string    `json:"metadata,omitempty"`
+}
+
+type sparkpostRecipient struct {
+	Address sparkpostAddress `json:"address"`
+}
+
+type sparkpostAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+	// The To header shown to CC and BCC recipients
+	HeaderTo string `json:"header_to,omitempty"`
+}
+
+type sparkpostContent struct {
+	From        sparkpostAddress      `json:"from"`
+	Subject     string                `json:"subject"`
+	Text        string                `json:"text,omitempty"`
+	HTML        string                `json:"html,omitempty"`
+	Headers     map[string]string     `json:"headers,omitempty"`
+	Attachments []sparkpostAttachment `json:"attachments,omitempty"`
+}
+
+type sparkpostAttachment struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+func (SparkPost) DefaultEndpoint(creds Credentials) string { return "https://api.sparkpost.com" }
+
+// Send creates a transmission. Its ID is the transmission_id on webhook
+// events.
+func (SparkPost) Send(ctx context.Context, client *http.Client, endpoint string, creds Credentials, msg *Message) (string, error) {
+	apiKey := creds["api_key"]
+	if apiKey == "" {
+		return "", ErrMissingCredentials
+	}
+
+	headerTo := joinAddresses(msg.To)
+	payload := sparkpostTransmission{
+		Content: sparkpostContent{
+			From:    sparkpostAddress{Email: msg.From.Email, Name: msg.From.Name},
+			Subject: msg.Subject,
+			Text:    msg.Text,
+			HTML:    msg.HTML,
+			Headers: map[string]string{},
+		},
+		Metadata: msg.Metadata,
+	}
+	for name, value := range msg.Headers {
+		payload.Content.Headers[name] = value
+	}
+	if len(msg.CC) > 0 {
+		payload.Content.Headers["CC"] = joinAddresses(msg.CC)
+	}
+	for _, a := range msg.Recipients() {
+		payload.Recipients = append(payload.Recipients, sparkpostRecipient{
+			Address: sparkpostAddress{Email: a.Email, Name: a.Name, HeaderTo: headerTo},
+		})
+	}
+	for _, a := range msg.Attachments {
+		payload.Content.Attachments = append(payload.Content.Attachments, sparkpostAttachment{
+			Name: a.Filename,
+			Type: attachmentType(a),
+			Data: base64.StdEncoding.EncodeToString(a.Content),
+		})
+	}
+
+	req, err := newJSONRequest(ctx, strings.TrimSuffix(endpoint, "/")+"/api/v1/transmissions", payload)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", apiKey)
+
+	var result struct {
+		Results struct {
+			ID string `json:"id"`
+		} `json:"results"`
+	}
+	if _, err := doSend(client, req, "sparkpost", &result); err != nil {
+		return "", err
+	}
+	return result.Results.ID, nil
+}
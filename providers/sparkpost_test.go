@@ -0,0 +1,38 @@
+package providers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSparkPostParseWebhookCountsFirstOpenOnce(t *testing.T) {
+	body := []byte(`[
+		{"msys": {"track_event": {"type": "initial_open", "event_id": "e1", "transmission_id": "t1", "timestamp": "1700000000", "rcpt_to": "a@example.org"}}},
+		{"msys": {"track_event": {"type": "open", "event_id": "e2", "transmission_id": "t1", "timestamp": "1700000000", "rcpt_to": "a@example.org"}}},
+		{"msys": {"track_event": {"type": "amp_initial_open", "event_id": "e3", "transmission_id": "t1", "timestamp": "1700000001", "rcpt_to": "a@example.org"}}},
+		{"msys": {"track_event": {"type": "amp_open", "event_id": "e4", "transmission_id": "t1", "timestamp": "1700000001", "rcpt_to": "a@example.org"}}}
+	]`)
+
+	events, err := SparkPost{}.ParseWebhook(nil, body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if len(events) != 2 || events[0].EventID != "e2" || events[1].EventID != "e4" {
+		t.Fatalf("events = %+v, want the open and amp_open events", events)
+	}
+	for _, ev := range events {
+		if ev.Type != EventOpen || ev.MessageID != "t1" {
+			t.Errorf("event = %+v", ev)
+		}
+	}
+	if !events[0].Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("timestamp = %v", events[0].Timestamp)
+	}
+}
+
+func TestSparkPostParseWebhookRejectsBadTimestamp(t *testing.T) {
+	body := []byte(`[{"msys": {"message_event": {"type": "delivery", "transmission_id": "t1", "timestamp": "yesterday", "rcpt_to": "a@example.org"}}}]`)
+	if events, err := (SparkPost{}).ParseWebhook(nil, body); err == nil {
+		t.Errorf("ParseWebhook = %+v, want an error", events)
+	}
+}
@@ -0,0 +1,291 @@
+// Package reputation periodically scores each ESP on its recent bounce,
+// deferral and complaint rates and shifts routing weight away from ESPs that
+// score below the user's other ESPs. The configured weight is left alone;
+// the controller sets a factor that routing multiplies it by.
+package reputation
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+// Config controls how scores are computed and how far weights may move
+type Config struct {
+	// Run the controller in the background
+	Enabled bool
+	// Record the adjustments the controller would make without applying them
+	DryRun   bool
+	Interval time.Duration
+	// How far back events are scored
+	Lookback time.Duration
+	// Messages an ESP needs in the lookback window to be scored
+	MinSample int
+	// Rates at which an ESP's score has fallen to 0.5
+	MaxBounceRate    float64
+	MaxDeferralRate  float64
+	MaxComplaintRate float64
+	// Bounds of the factor applied to configured weights
+	MinFactor float64
+	MaxFactor float64
+	// Largest change of a factor in one run
+	MaxStep float64
+}
+
+// ConfigFromEnv reads the REPUTATION_* environment variables, falling back
+// to defaults for any that are unset or invalid
+func ConfigFromEnv() Config {
+	return Config{
+		Enabled:          os.Getenv("REPUTATION_ENABLED") == "true",
+		DryRun:           os.Getenv("REPUTATION_DRY_RUN") == "true",
+		Interval:         time.Duration(envInt("REPUTATION_INTERVAL_MINUTES", 15)) * time.Minute,
+		Lookback:         time.Duration(envInt("REPUTATION_LOOKBACK_HOURS", 24)) * time.Hour,
+		MinSample:        envInt("REPUTATION_MIN_SAMPLE", 100),
+		MaxBounceRate:    envFloat("REPUTATION_MAX_BOUNCE_RATE", 0.05),
+		MaxDeferralRate:  envFloat("REPUTATION_MAX_DEFERRAL_RATE", 0.10),
+		MaxComplaintRate: envFloat("REPUTATION_MAX_COMPLAINT_RATE", 0.001),
+		MinFactor:        envFloat("REPUTATION_MIN_FACTOR", 0.1),
+		MaxFactor:        envFloat("REPUTATION_MAX_FACTOR", 2),
+		MaxStep:          envFloat("REPUTATION_MAX_STEP", 0.25),
+	}
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Assessment is the controller's view of one ESP
+type Assessment struct {
+	ESPID         int     `json:"esp_id"`
+	Provider      string  `json:"provider"`
+	Weight        int     `json:"weight"`
+	SampleSize    int     `json:"sample_size"`
+	BounceRate    float64 `json:"bounce_rate"`
+	DeferralRate  float64 `json:"deferral_rate"`
+	ComplaintRate float64 `json:"complaint_rate"`
+	// Health from 0 to 1; unset for ESPs without enough volume
+	Score         *float64 `json:"score,omitempty"`
+	CurrentFactor float64  `json:"current_factor"`
+	Factor        float64  `json:"factor"`
+	// Weight routing would use with the new factor
+	EffectiveWeight int    `json:"effective_weight"`
+	Changed         bool   `json:"changed"`
+	Reason          string `json:"reason"`
+}
+
+// Controller adjusts ESP weight factors on a timer
+type Controller struct {
+	db  *sql.DB
+	cfg Config
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewController(db *sql.DB, cfg Config) *Controller {
+	return &Controller{db: db, cfg: cfg, done: make(chan struct{})}
+}
+
+// Config returns the controller's settings
+func (c *Controller) Config() Config {
+	return c.cfg
+}
+
+// Start runs the controller every Interval until Stop is called
+func (c *Controller) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := c.RunOnce(); err != nil {
+					log.Printf("Error adjusting ESP weights: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the current run to finish and stops the controller
+func (c *Controller) Stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// RunOnce assesses every user's ESPs and records the resulting adjustments,
+// applying them unless the controller is in dry-run mode
+func (c *Controller) RunOnce() error {
+	userIDs, err := models.GetUserIDsWithESPs(c.db)
+	if err != nil {
+		return fmt.Errorf("error loading users: %v", err)
+	}
+
+	for _, userID := range userIDs {
+		if err := c.adjust(userID); err != nil {
+			log.Printf("Error adjusting ESP weights for user %d: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) adjust(userID int) error {
+	assessments, err := c.Assess(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range assessments {
+		if !a.Changed {
+			continue
+		}
+
+		adj := &models.WeightAdjustment{
+			UserID:          userID,
+			ESPID:           a.ESPID,
+			PreviousFactor:  a.CurrentFactor,
+			Factor:          a.Factor,
+			Weight:          a.Weight,
+			EffectiveWeight: a.EffectiveWeight,
+			SampleSize:      a.SampleSize,
+			BounceRate:      a.BounceRate,
+			DeferralRate:    a.DeferralRate,
+			ComplaintRate:   a.ComplaintRate,
+			Reason:          a.Reason,
+			DryRun:          c.cfg.DryRun,
+		}
+		if a.Score != nil {
+			adj.Score = *a.Score
+		}
+
+		if !c.cfg.DryRun {
+			if err := models.SetESPWeightFactor(c.db, a.ESPID, a.Factor); err != nil {
+				return fmt.Errorf("error updating ESP %d: %v", a.ESPID, err)
+			}
+		}
+		if err := models.CreateWeightAdjustment(c.db, adj); err != nil {
+			return fmt.Errorf("error recording adjustment of ESP %d: %v", a.ESPID, err)
+		}
+		log.Printf("Reputation: ESP %d weight factor %.2f -> %.2f (dry run: %t): %s",
+			a.ESPID, a.CurrentFactor, a.Factor, c.cfg.DryRun, a.Reason)
+	}
+	return nil
+}
+
+// Assess scores the user's ESPs on their recent events and works out the
+// factor each should get, without changing anything
+func (c *Controller) Assess(userID int) ([]Assessment, error) {
+	esps, err := models.GetESPsByUserID(c.db, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ESPs: %v", err)
+	}
+	end := time.Now()
+	stats, err := models.GetESPEventStats(c.db, userID, end.Add(-c.cfg.Lookback), end)
+	if err != nil {
+		return nil, fmt.Errorf("error loading event stats: %v", err)
+	}
+
+	assessments := make([]Assessment, 0, len(esps))
+	var scoreSum float64
+	scored := 0
+	for _, esp := range esps {
+		a := Assessment{
+			ESPID:         esp.ESPID,
+			Provider:      esp.ProviderName,
+			Weight:        esp.Weight,
+			CurrentFactor: esp.WeightFactor,
+		}
+		if s, ok := stats[esp.ESPID]; ok && s.TotalEvents > 0 {
+			a.SampleSize = s.TotalEvents
+			a.BounceRate = float64(s.BounceCount) / float64(s.TotalEvents)
+			a.DeferralRate = float64(s.DeferredCount) / float64(s.TotalEvents)
+			a.ComplaintRate = float64(s.SpamReportCount) / float64(s.TotalEvents)
+		}
+		if esp.Weight > 0 && a.SampleSize >= c.cfg.MinSample {
+			score := c.score(&a)
+			a.Score = &score
+			scoreSum += score
+			scored++
+		}
+		assessments = append(assessments, a)
+	}
+
+	for i := range assessments {
+		a := &assessments[i]
+		target := 1.0
+		switch {
+		case a.Weight <= 0:
+			a.Factor = a.CurrentFactor
+			a.Reason = "weight is zero"
+			a.EffectiveWeight = 0
+			continue
+		case a.Score == nil:
+			a.Reason = fmt.Sprintf("not enough recent volume (%d of %d messages); moving toward 1", a.SampleSize, c.cfg.MinSample)
+		default:
+			mean := scoreSum / float64(scored)
+			if mean > 0 {
+				target = *a.Score / mean
+			}
+			a.Reason += fmt.Sprintf("; score %.2f vs average %.2f", *a.Score, mean)
+		}
+
+		target = math.Max(c.cfg.MinFactor, math.Min(c.cfg.MaxFactor, target))
+		step := math.Max(-c.cfg.MaxStep, math.Min(c.cfg.MaxStep, target-a.CurrentFactor))
+		a.Factor = math.Round((a.CurrentFactor+step)*100) / 100
+		a.Changed = math.Abs(a.Factor-a.CurrentFactor) >= 0.005
+		if !a.Changed {
+			a.Factor = a.CurrentFactor
+		}
+		a.EffectiveWeight = models.ESP{Weight: a.Weight, WeightFactor: a.Factor}.EffectiveWeight()
+	}
+	return assessments, nil
+}
+
+// score rates an ESP from 1 (no bounces, deferrals or complaints) down to 0
+// at twice the limit of its worst rate, and explains it in a.Reason
+func (c *Controller) score(a *Assessment) float64 {
+	worst, reason := 0.0, "rates within limits"
+	for _, m := range []struct {
+		name  string
+		rate  float64
+		limit float64
+	}{
+		{"bounce", a.BounceRate, c.cfg.MaxBounceRate},
+		{"deferral", a.DeferralRate, c.cfg.MaxDeferralRate},
+		{"complaint", a.ComplaintRate, c.cfg.MaxComplaintRate},
+	} {
+		ratio := m.rate / m.limit
+		if ratio > worst {
+			worst = ratio
+			if ratio > 1 {
+				reason = fmt.Sprintf("%s rate %.2f%% above limit %.2f%%", m.name, m.rate*100, m.limit*100)
+			}
+		}
+	}
+	a.Reason = reason
+	return math.Max(0, 1-worst/2)
+}
@@ -0,0 +1,271 @@
+package routing
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// Number of buckets the error window is divided into
+const breakerBuckets = 10
+
+// BreakerConfig controls when an ESP's circuit breaker trips
+type BreakerConfig struct {
+	// Failures within Window that trip the breaker
+	FailureThreshold int
+	// Minimum share of failed sends within Window to trip; 0 trips on the
+	// threshold alone
+	FailureRate float64
+	Window      time.Duration
+	// How long a tripped breaker stays open before letting a probe through
+	Cooldown time.Duration
+}
+
+// BreakerStatus is a snapshot of one ESP's breaker
+type BreakerStatus struct {
+	ESPID    int    `json:"esp_id"`
+	Provider string `json:"provider,omitempty"`
+	State    string `json:"state"`
+	// Sends within the error window
+	Successes int `json:"recent_successes"`
+	Failures  int `json:"recent_failures"`
+	// Times the breaker has tripped since startup
+	Trips         int        `json:"trips"`
+	OpenedAt      *time.Time `json:"opened_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+type bucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// breaker tracks one ESP
+type breaker struct {
+	state    string
+	buckets  [breakerBuckets]bucket
+	openedAt time.Time
+	// A half-open breaker lets one probe through at a time; this is the
+	// probe's number, or 0 when none is in progress
+	probe         uint64
+	trips         int
+	lastError     string
+	lastFailureAt time.Time
+}
+
+// Breakers holds a circuit breaker per ESP. Send failures that suggest the
+// provider is down (5xx responses, timeouts) trip an ESP's breaker, which
+// keeps the router away from it until the cool-down has passed and a probe
+// send succeeds.
+type Breakers struct {
+	cfg BreakerConfig
+
+	mu        sync.Mutex
+	breakers  map[int]*breaker
+	lastProbe uint64
+}
+
+// Permit is a send allowed by Allow, whose outcome is given to Record or
+// Release
+type Permit struct {
+	ESPID int
+	// Number of the half-open probe the send is, 0 for ordinary sends
+	probe uint64
+}
+
+func NewBreakers(cfg BreakerConfig) *Breakers {
+	return &Breakers{cfg: cfg, breakers: map[int]*breaker{}}
+}
+
+func (b *Breakers) get(espID int) *breaker {
+	br, ok := b.breakers[espID]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.breakers[espID] = br
+	}
+	return br
+}
+
+// state reports the ESP's current state, treating an open breaker whose
+// cool-down has passed as half-open
+func (b *Breakers) state(br *breaker, now time.Time) string {
+	if br.state == BreakerOpen && now.Sub(br.openedAt) >= b.cfg.Cooldown {
+		return BreakerHalfOpen
+	}
+	return br.state
+}
+
+// available reports whether the router may choose the ESP, without
+// reserving a half-open probe. If not, it returns the reason.
+func (b *Breakers) available(espID int) (bool, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.breakers[espID]
+	if !ok {
+		return true, ""
+	}
+	switch b.state(br, time.Now()) {
+	case BreakerOpen:
+		return false, "circuit breaker open"
+	case BreakerHalfOpen:
+		if br.probe != 0 {
+			return false, "circuit breaker half-open, probe in progress"
+		}
+	}
+	return true, ""
+}
+
+// Allow reports whether a message may be sent through the ESP now. For a
+// half-open breaker it reserves the single probe, which must be released by
+// Record or Release with the returned permit.
+func (b *Breakers) Allow(espID int) (Permit, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	permit := Permit{ESPID: espID}
+	br := b.get(espID)
+	switch b.state(br, time.Now()) {
+	case BreakerOpen:
+		return permit, false
+	case BreakerHalfOpen:
+		if br.probe != 0 {
+			return permit, false
+		}
+		b.lastProbe++
+		br.state = BreakerHalfOpen
+		br.probe = b.lastProbe
+		permit.probe = br.probe
+	}
+	return permit, true
+}
+
+// Record reports the outcome of a send allowed by Allow. err is the send
+// error if the provider failed, nil if it succeeded. Only the probe's
+// outcome moves a half-open breaker; sends that started before the breaker
+// tripped are only counted.
+func (b *Breakers) Record(p Permit, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	br := b.get(p.ESPID)
+	if err != nil {
+		br.lastError = err.Error()
+		br.lastFailureAt = now
+	}
+
+	if br.state == BreakerHalfOpen && p.probe != 0 && p.probe == br.probe {
+		br.probe = 0
+		if err != nil {
+			b.trip(br, now)
+		} else {
+			br.state = BreakerClosed
+			br.buckets = [breakerBuckets]bucket{}
+		}
+		return
+	}
+
+	bk := b.bucket(br, now)
+	if err == nil {
+		bk.successes++
+		return
+	}
+	bk.failures++
+
+	if br.state != BreakerClosed {
+		return
+	}
+	successes, failures := b.counts(br, now)
+	if failures < b.cfg.FailureThreshold {
+		return
+	}
+	if b.cfg.FailureRate > 0 && float64(failures)/float64(successes+failures) < b.cfg.FailureRate {
+		return
+	}
+	b.trip(br, now)
+}
+
+// Release returns a half-open probe without recording an outcome, for sends
+// that failed for reasons unrelated to the provider's health
+func (b *Breakers) Release(p Permit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if br, ok := b.breakers[p.ESPID]; ok && p.probe != 0 && br.probe == p.probe {
+		br.probe = 0
+	}
+}
+
+func (b *Breakers) trip(br *breaker, now time.Time) {
+	br.state = BreakerOpen
+	br.openedAt = now
+	br.trips++
+}
+
+// bucketSize is the span of time covered by each bucket of the window
+func (b *Breakers) bucketSize() time.Duration {
+	size := b.cfg.Window / breakerBuckets
+	if size <= 0 {
+		size = time.Second
+	}
+	return size
+}
+
+// bucket returns the window bucket for now, clearing it if it last held an
+// older span
+func (b *Breakers) bucket(br *breaker, now time.Time) *bucket {
+	start := now.Truncate(b.bucketSize())
+	bk := &br.buckets[(start.UnixNano()/int64(b.bucketSize()))%breakerBuckets]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// counts sums the buckets inside the window
+func (b *Breakers) counts(br *breaker, now time.Time) (successes, failures int) {
+	oldest := now.Truncate(b.bucketSize()).Add(-b.bucketSize() * (breakerBuckets - 1))
+	for _, bk := range br.buckets {
+		if !bk.start.Before(oldest) {
+			successes += bk.successes
+			failures += bk.failures
+		}
+	}
+	return successes, failures
+}
+
+// Status returns a snapshot of the ESP's breaker
+func (b *Breakers) Status(espID int) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	status := BreakerStatus{ESPID: espID, State: BreakerClosed}
+	br, ok := b.breakers[espID]
+	if !ok {
+		return status
+	}
+
+	status.State = b.state(br, now)
+	status.Successes, status.Failures = b.counts(br, now)
+	status.Trips = br.trips
+	status.LastError = br.lastError
+	if status.State != BreakerClosed {
+		openedAt := br.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if !br.lastFailureAt.IsZero() {
+		lastFailureAt := br.lastFailureAt
+		status.LastFailureAt = &lastFailureAt
+	}
+	return status
+}
@@ -0,0 +1,90 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// trippedBreakers returns breakers with ESP 1's tripped, and a permit for a
+// send that was allowed before the trip
+func trippedBreakers(t *testing.T) (*Breakers, Permit) {
+	t.Helper()
+	b := NewBreakers(BreakerConfig{FailureThreshold: 1, Window: time.Minute, Cooldown: time.Hour})
+	before, ok := b.Allow(1)
+	if !ok {
+		t.Fatal("closed breaker refused a send")
+	}
+	failed, _ := b.Allow(1)
+	b.Record(failed, errors.New("503 Service Unavailable"))
+	if state := b.Status(1).State; state != BreakerOpen {
+		t.Fatalf("state = %s, want %s", state, BreakerOpen)
+	}
+	return b, before
+}
+
+func TestBreakerLateSuccessDoesNotCloseHalfOpen(t *testing.T) {
+	b, late := trippedBreakers(t)
+	b.cfg.Cooldown = 0
+
+	probe, ok := b.Allow(1)
+	if !ok {
+		t.Fatal("half-open breaker refused the probe")
+	}
+	if _, ok := b.Allow(1); ok {
+		t.Error("half-open breaker allowed a second probe")
+	}
+
+	// A send started before the trip succeeds while the probe is in flight
+	b.Record(late, nil)
+	if state := b.Status(1).State; state != BreakerHalfOpen {
+		t.Fatalf("state after a late success = %s, want %s", state, BreakerHalfOpen)
+	}
+	if _, ok := b.Allow(1); ok {
+		t.Error("late success freed the probe")
+	}
+
+	b.Record(probe, nil)
+	if status := b.Status(1); status.State != BreakerClosed || status.Failures != 0 {
+		t.Errorf("status after the probe succeeded = %+v, want closed with no failures", status)
+	}
+}
+
+func TestBreakerFailedProbeTripsAgain(t *testing.T) {
+	b, _ := trippedBreakers(t)
+	b.cfg.Cooldown = 0
+
+	probe, _ := b.Allow(1)
+	b.Release(Permit{ESPID: 1})
+	if _, ok := b.Allow(1); ok {
+		t.Error("releasing an ordinary permit freed the probe")
+	}
+
+	b.cfg.Cooldown = time.Hour
+	b.Record(probe, errors.New("timeout"))
+	if status := b.Status(1); status.State != BreakerOpen || status.Trips != 2 {
+		t.Errorf("status after the probe failed = %+v, want open after 2 trips", status)
+	}
+}
+
+func TestBreakerReleasedProbe(t *testing.T) {
+	b, _ := trippedBreakers(t)
+	b.cfg.Cooldown = 0
+
+	probe, _ := b.Allow(1)
+	b.Release(probe)
+	next, ok := b.Allow(1)
+	if !ok {
+		t.Fatal("released probe wasn't handed out again")
+	}
+
+	// The released probe's permit no longer decides the outcome
+	b.Record(probe, nil)
+	if state := b.Status(1).State; state != BreakerHalfOpen {
+		t.Errorf("state = %s, want %s", state, BreakerHalfOpen)
+	}
+	b.Record(next, nil)
+	if state := b.Status(1).State; state != BreakerClosed {
+		t.Errorf("state = %s, want %s", state, BreakerClosed)
+	}
+}
@@ -0,0 +1,282 @@
+// Package routing picks the ESP a message is sent through. Each user's ESPs
+// that list the sender domain in their SendingDomains are candidates, and
+// one is chosen at random in proportion to its effective weight. Optionally, mail to
+// the same recipient domain sticks to the same ESP. ESPs whose circuit
+// breaker is open, or that have sent today's warm-up ceiling for the sender
+// domain, are skipped.
+package routing
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+// ErrNoESP means none of the user's ESPs can send for the sender domain
+var ErrNoESP = errors.New("no ESP available for sending domain")
+
+// Selection methods reported by Explain
+const (
+	MethodWeightedRandom = "weighted_random"
+	MethodSticky         = "sticky_recipient_domain"
+)
+
+// Options configures a Router
+type Options struct {
+	// Seed makes the weighted random choice reproducible; 0 seeds from the clock
+	Seed int64
+	// StickyRecipientDomains routes every message to a recipient domain
+	// through the same ESP for as long as the candidates don't change
+	StickyRecipientDomains bool
+	Breaker                BreakerConfig
+}
+
+// OptionsFromEnv reads ROUTING_SEED, ROUTING_STICKY_RECIPIENT_DOMAINS and
+// the ROUTING_BREAKER_* settings
+func OptionsFromEnv() Options {
+	seed, _ := strconv.ParseInt(os.Getenv("ROUTING_SEED"), 10, 64)
+	sticky, _ := strconv.ParseBool(os.Getenv("ROUTING_STICKY_RECIPIENT_DOMAINS"))
+
+	breaker := BreakerConfig{
+		FailureThreshold: envInt("ROUTING_BREAKER_FAILURE_THRESHOLD", 5),
+		FailureRate:      0.5,
+		Window:           time.Duration(envInt("ROUTING_BREAKER_WINDOW_SECONDS", 60)) * time.Second,
+		Cooldown:         time.Duration(envInt("ROUTING_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("ROUTING_BREAKER_FAILURE_RATE"), 64); err == nil && rate >= 0 && rate <= 1 {
+		breaker.FailureRate = rate
+	}
+	return Options{Seed: seed, StickyRecipientDomains: sticky, Breaker: breaker}
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Request describes the message being routed
+type Request struct {
+	UserID          int
+	SenderDomain    string
+	RecipientDomain string
+	// ESPs already tried for this message
+	Exclude []int
+}
+
+// Candidate is one of the user's ESPs as seen by a routing decision
+type Candidate struct {
+	ESPID    int    `json:"esp_id"`
+	Provider string `json:"provider"`
+	Weight   int    `json:"weight"`
+	// Weight after the reputation controller's adjustment
+	EffectiveWeight int  `json:"effective_weight"`
+	Eligible        bool `json:"eligible"`
+	// Why the ESP was left out, if it was
+	Reason string `json:"reason,omitempty"`
+	// Progress of the ESP's warm-up for the sender domain, if it has one
+	Warmup string `json:"warmup,omitempty"`
+	// Chance of the ESP being chosen by weighted random choice
+	Probability float64 `json:"probability"`
+}
+
+// Decision is the outcome of routing a message, with the reasoning behind it
+type Decision struct {
+	// Unset when Explain leaves the choice to weighted random choice
+	ESP        *models.ESP `json:"esp"`
+	Method     string      `json:"method"`
+	Candidates []Candidate `json:"candidates"`
+	Reason     string      `json:"reason"`
+}
+
+// Router selects ESPs for outgoing messages
+type Router struct {
+	db       *sql.DB
+	opts     Options
+	breakers *Breakers
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func NewRouter(db *sql.DB, opts Options) *Router {
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Router{
+		db:       db,
+		opts:     opts,
+		breakers: NewBreakers(opts.Breaker),
+		rnd:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Breakers returns the ESP circuit breakers consulted when routing
+func (r *Router) Breakers() *Breakers {
+	return r.breakers
+}
+
+// Select returns the ESP to send the message through
+func (r *Router) Select(req Request) (*models.ESP, error) {
+	decision, err := r.route(req, r.roll)
+	if err != nil {
+		return nil, err
+	}
+	return decision.ESP, nil
+}
+
+// Explain reports every candidate considered for the message, why
+// ineligible ones were left out and how the ESP is chosen. Weighted random
+// choices are reported as probabilities without drawing from the router's
+// random source, so explaining doesn't shift the sequence sends see.
+func (r *Router) Explain(req Request) (*Decision, error) {
+	return r.route(req, nil)
+}
+
+func (r *Router) route(req Request, roll func(total int) int) (*Decision, error) {
+	esps, err := models.GetESPsByUserID(r.db, req.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ESPs: %v", err)
+	}
+	warmups, err := models.GetWarmupsForDomain(r.db, req.UserID, req.SenderDomain)
+	if err != nil {
+		return nil, fmt.Errorf("error loading warm-up schedules: %v", err)
+	}
+	return r.decide(req, esps, warmups, roll)
+}
+
+// roll draws from the router's seeded random source
+func (r *Router) roll(total int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Intn(total)
+}
+
+// decide chooses among the given ESPs, capping those warming up for the
+// sender domain at the day's ceiling. Weighted random choices draw from
+// roll; with a nil roll no ESP is chosen.
+func (r *Router) decide(req Request, esps []models.ESP, warmups map[int]*models.Warmup, roll func(total int) int) (*Decision, error) {
+	decision := &Decision{Candidates: make([]Candidate, 0, len(esps))}
+
+	var eligible []int
+	total := 0
+	for i, esp := range esps {
+		c := Candidate{ESPID: esp.ESPID, Provider: esp.ProviderName, Weight: esp.Weight, EffectiveWeight: esp.EffectiveWeight()}
+		available, reason := r.breakers.available(esp.ESPID)
+		warmup, warming := warmups[esp.ESPID]
+		if warming {
+			c.Warmup = fmt.Sprintf("%s, day %d of %d: %d of %d sent today", warmup.Status,
+				warmup.Day+1, warmup.Days(), warmup.SentToday, warmup.Ceiling())
+		}
+		switch {
+		case !hasDomain(esp.SendingDomains, req.SenderDomain):
+			c.Reason = "sending domain not configured"
+		case esp.Weight <= 0:
+			c.Reason = "weight is zero"
+		case excluded(req.Exclude, esp.ESPID):
+			c.Reason = "already tried"
+		case !available:
+			c.Reason = reason
+		case warming && warmup.SentToday >= warmup.Ceiling():
+			c.Reason = "warm-up ceiling reached for today"
+		default:
+			c.Eligible = true
+			eligible = append(eligible, i)
+			total += c.EffectiveWeight
+		}
+		decision.Candidates = append(decision.Candidates, c)
+	}
+
+	if len(eligible) == 0 {
+		return decision, fmt.Errorf("%w: %s", ErrNoESP, req.SenderDomain)
+	}
+	for i := range decision.Candidates {
+		if decision.Candidates[i].Eligible {
+			decision.Candidates[i].Probability = float64(decision.Candidates[i].EffectiveWeight) / float64(total)
+		}
+	}
+
+	var chosen int
+	if r.opts.StickyRecipientDomains && req.RecipientDomain != "" {
+		chosen = stickyChoice(req, esps, eligible)
+		decision.Method = MethodSticky
+		decision.Reason = fmt.Sprintf("recipient domain %s is pinned to ESP %d by weighted rendezvous hashing",
+			strings.ToLower(req.RecipientDomain), esps[chosen].ESPID)
+	} else {
+		decision.Method = MethodWeightedRandom
+		if roll == nil {
+			decision.Reason = fmt.Sprintf("chosen by weighted random choice among %d eligible ESPs with the listed probabilities",
+				len(eligible))
+			return decision, nil
+		}
+		chosen = weightedChoice(esps, eligible, roll(total))
+		decision.Reason = fmt.Sprintf("chosen by weighted random choice among %d eligible ESPs (weight %d of %d)",
+			len(eligible), esps[chosen].EffectiveWeight(), total)
+	}
+
+	esp := esps[chosen]
+	decision.ESP = &esp
+	return decision, nil
+}
+
+// weightedChoice maps a roll in [0, total weight) onto an eligible ESP
+func weightedChoice(esps []models.ESP, eligible []int, roll int) int {
+	for _, i := range eligible {
+		if roll < esps[i].EffectiveWeight() {
+			return i
+		}
+		roll -= esps[i].EffectiveWeight()
+	}
+	return eligible[len(eligible)-1]
+}
+
+// stickyChoice picks an eligible ESP with weighted rendezvous hashing on the
+// recipient domain. Each domain keeps its ESP while the candidates are
+// unchanged, domains spread across ESPs in proportion to their weights, and
+// adding or removing an ESP only moves the domains that must move.
+func stickyChoice(req Request, esps []models.ESP, eligible []int) int {
+	best, bestScore := eligible[0], math.Inf(-1)
+	for _, i := range eligible {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d|%s|%s|%d", req.UserID, strings.ToLower(req.SenderDomain),
+			strings.ToLower(req.RecipientDomain), esps[i].ESPID)
+		// Map the hash into (0, 1) and score it as -weight / ln(u)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(esps[i].EffectiveWeight()) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+func excluded(espIDs []int, espID int) bool {
+	for _, id := range espIDs {
+		if id == espID {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
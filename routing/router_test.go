@@ -0,0 +1,208 @@
+package routing
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+func testRouter(opts Options) *Router {
+	if opts.Seed == 0 {
+		opts.Seed = 1
+	}
+	opts.Breaker = BreakerConfig{FailureThreshold: 1, Window: time.Minute, Cooldown: time.Hour}
+	return NewRouter(nil, opts)
+}
+
+func testESP(id, weight int, domains ...string) models.ESP {
+	return models.ESP{ESPID: id, ProviderName: "sendgrid", Weight: weight, WeightFactor: 1, SendingDomains: domains}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	r := testRouter(Options{})
+	esps := []models.ESP{testESP(1, 1, "example.com"), testESP(2, 3, "example.com")}
+	req := Request{UserID: 1, SenderDomain: "example.com"}
+
+	const n = 20000
+	counts := map[int]int{}
+	for i := 0; i < n; i++ {
+		decision, err := r.decide(req, esps, nil, r.roll)
+		if err != nil {
+			t.Fatalf("decide: %v", err)
+		}
+		counts[decision.ESP.ESPID]++
+	}
+
+	for espID, want := range map[int]float64{1: 0.25, 2: 0.75} {
+		got := float64(counts[espID]) / n
+		if math.Abs(got-want) > 0.02 {
+			t.Errorf("ESP %d chosen %.3f of the time, want about %.2f", espID, got, want)
+		}
+	}
+}
+
+func TestSeededChoicesRepeat(t *testing.T) {
+	esps := []models.ESP{testESP(1, 1, "example.com"), testESP(2, 1, "example.com"), testESP(3, 2, "example.com")}
+	req := Request{UserID: 1, SenderDomain: "example.com"}
+
+	choose := func(r *Router) []int {
+		var ids []int
+		for i := 0; i < 50; i++ {
+			decision, err := r.decide(req, esps, nil, r.roll)
+			if err != nil {
+				t.Fatalf("decide: %v", err)
+			}
+			ids = append(ids, decision.ESP.ESPID)
+		}
+		return ids
+	}
+
+	first := choose(testRouter(Options{Seed: 42}))
+
+	// Explaining in between must not shift the sequence
+	r := testRouter(Options{Seed: 42})
+	var second []int
+	for i := 0; i < 50; i++ {
+		if _, err := r.decide(req, esps, nil, nil); err != nil {
+			t.Fatalf("explain: %v", err)
+		}
+		decision, err := r.decide(req, esps, nil, r.roll)
+		if err != nil {
+			t.Fatalf("decide: %v", err)
+		}
+		second = append(second, decision.ESP.ESPID)
+	}
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("choice %d differs: %d vs %d", i, first[i], second[i])
+		}
+	}
+}
+
+func TestExplainReportsProbabilitiesWithoutChoosing(t *testing.T) {
+	r := testRouter(Options{})
+	esps := []models.ESP{testESP(1, 1, "example.com"), testESP(2, 3, "example.com")}
+
+	decision, err := r.decide(Request{UserID: 1, SenderDomain: "example.com"}, esps, nil, nil)
+	if err != nil {
+		t.Fatalf("decide: %v", err)
+	}
+	if decision.ESP != nil {
+		t.Errorf("explain chose ESP %d", decision.ESP.ESPID)
+	}
+	if decision.Method != MethodWeightedRandom {
+		t.Errorf("method = %s, want %s", decision.Method, MethodWeightedRandom)
+	}
+	want := map[int]float64{1: 0.25, 2: 0.75}
+	for _, c := range decision.Candidates {
+		if c.Probability != want[c.ESPID] {
+			t.Errorf("ESP %d probability = %v, want %v", c.ESPID, c.Probability, want[c.ESPID])
+		}
+	}
+}
+
+func TestStickyMappingIsStable(t *testing.T) {
+	r := testRouter(Options{StickyRecipientDomains: true})
+	esps := []models.ESP{
+		testESP(1, 1, "example.com"), testESP(2, 1, "example.com"),
+		testESP(3, 1, "example.com"), testESP(4, 1, "example.com"),
+	}
+	domains := []string{"gmail.com", "yahoo.com", "outlook.com", "example.org", "example.net", "aol.com"}
+
+	pinned := map[string]int{}
+	for _, domain := range domains {
+		req := Request{UserID: 1, SenderDomain: "example.com", RecipientDomain: domain}
+		for i := 0; i < 10; i++ {
+			decision, err := r.decide(req, esps, nil, r.roll)
+			if err != nil {
+				t.Fatalf("decide: %v", err)
+			}
+			if decision.Method != MethodSticky {
+				t.Fatalf("method = %s, want %s", decision.Method, MethodSticky)
+			}
+			if i == 0 {
+				pinned[domain] = decision.ESP.ESPID
+			} else if decision.ESP.ESPID != pinned[domain] {
+				t.Fatalf("%s moved from ESP %d to %d", domain, pinned[domain], decision.ESP.ESPID)
+			}
+		}
+	}
+
+	// Removing an ESP only moves the domains that were pinned to it
+	removed := pinned[domains[0]]
+	var remaining []models.ESP
+	for _, esp := range esps {
+		if esp.ESPID != removed {
+			remaining = append(remaining, esp)
+		}
+	}
+	for _, domain := range domains {
+		decision, err := r.decide(Request{UserID: 1, SenderDomain: "example.com", RecipientDomain: domain}, remaining, nil, r.roll)
+		if err != nil {
+			t.Fatalf("decide: %v", err)
+		}
+		if pinned[domain] != removed && decision.ESP.ESPID != pinned[domain] {
+			t.Errorf("%s moved from ESP %d to %d after removing ESP %d", domain, pinned[domain], decision.ESP.ESPID, removed)
+		}
+	}
+}
+
+func TestExclusionReasons(t *testing.T) {
+	r := testRouter(Options{})
+	r.Breakers().Record(Permit{ESPID: 5}, errors.New("connection refused"))
+
+	esps := []models.ESP{
+		testESP(1, 1, "other.com"),
+		testESP(2, 0, "example.com"),
+		testESP(3, 1, "example.com"),
+		testESP(4, 1, "example.com"),
+		testESP(5, 1, "example.com"),
+		testESP(6, 1, "example.com"),
+	}
+	warmups := map[int]*models.Warmup{
+		4: {ESPID: 4, Status: models.WarmupActive, DailyLimits: []int{10, 20}, SentToday: 10},
+	}
+	req := Request{UserID: 1, SenderDomain: "example.com", Exclude: []int{3}}
+
+	decision, err := r.decide(req, esps, warmups, r.roll)
+	if err != nil {
+		t.Fatalf("decide: %v", err)
+	}
+	if decision.ESP.ESPID != 6 {
+		t.Errorf("chose ESP %d, want 6", decision.ESP.ESPID)
+	}
+
+	want := map[int]string{
+		1: "sending domain not configured",
+		2: "weight is zero",
+		3: "already tried",
+		4: "warm-up ceiling reached for today",
+		5: "circuit breaker open",
+		6: "",
+	}
+	for _, c := range decision.Candidates {
+		if c.Reason != want[c.ESPID] {
+			t.Errorf("ESP %d reason = %q, want %q", c.ESPID, c.Reason, want[c.ESPID])
+		}
+		if c.Eligible != (want[c.ESPID] == "") {
+			t.Errorf("ESP %d eligible = %v", c.ESPID, c.Eligible)
+		}
+	}
+}
+
+func TestNoEligibleESP(t *testing.T) {
+	r := testRouter(Options{})
+	esps := []models.ESP{testESP(1, 1, "other.com")}
+
+	decision, err := r.decide(Request{UserID: 1, SenderDomain: "example.com"}, esps, nil, r.roll)
+	if !errors.Is(err, ErrNoESP) {
+		t.Fatalf("err = %v, want ErrNoESP", err)
+	}
+	if len(decision.Candidates) != 1 || decision.Candidates[0].Reason != "sending domain not configured" {
+		t.Errorf("candidates = %+v", decision.Candidates)
+	}
+}
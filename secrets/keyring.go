@@ -0,0 +1,228 @@
+// Package secrets encrypts stored credentials with envelope encryption. Each
+// value is sealed with its own random data key, and the data key is wrapped
+// with a master key from configuration. Rotating the master key only
+// rewraps data keys.
+//
+// Values are bound to additional data naming where they're stored, such as
+// the owning row, so a ciphertext copied elsewhere fails to open. Wrapped
+// data keys are also bound to the ID of the master key wrapping them.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotConfigured means no master key has been loaded
+	ErrNotConfigured = errors.New("credential encryption is not configured")
+	// ErrUnknownKey means a value was sealed with a master key we don't have
+	ErrUnknownKey = errors.New("unknown master key")
+)
+
+// Keyring holds the active master key, used to seal new values, and any
+// previous master keys still needed to open existing ones
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// Envelope is a sealed value along with its wrapped data key
+type Envelope struct {
+	// ID of the master key that wrapped DataKey
+	KeyID      string
+	DataKey    []byte
+	Ciphertext []byte
+}
+
+// NewKeyring builds a keyring from 32 byte AES-256 keys by ID
+func NewKeyring(activeID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, fmt.Errorf("active master key %q not in keyring", activeID)
+	}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes", id)
+		}
+	}
+	return &Keyring{activeID: activeID, keys: keys}, nil
+}
+
+// KeyringFromEnv loads CREDENTIALS_MASTER_KEY, the active key, and the
+// comma separated CREDENTIALS_PREVIOUS_MASTER_KEYS. Keys are written as
+// <key-id>:<base64 encoded 32 byte key>.
+func KeyringFromEnv() (*Keyring, error) {
+	active := os.Getenv("CREDENTIALS_MASTER_KEY")
+	if active == "" {
+		return nil, errors.New("CREDENTIALS_MASTER_KEY is not set")
+	}
+	activeID, key, err := parseKey(active)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CREDENTIALS_MASTER_KEY: %v", err)
+	}
+	keys := map[string][]byte{activeID: key}
+
+	for _, spec := range strings.Split(os.Getenv("CREDENTIALS_PREVIOUS_MASTER_KEYS"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		id, key, err := parseKey(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CREDENTIALS_PREVIOUS_MASTER_KEYS: %v", err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("master key %q is configured twice", id)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(activeID, keys)
+}
+
+func parseKey(spec string) (string, []byte, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, errors.New("expected <key-id>:<base64 key>")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("key %q is not valid base64", parts[0])
+	}
+	return parts[0], key, nil
+}
+
+// ActiveKeyID returns the ID of the key new values are sealed with
+func (k *Keyring) ActiveKeyID() string {
+	return k.activeID
+}
+
+// Seal encrypts plaintext under a new data key wrapped with the active key,
+// binding both to aad
+func (k *Keyring) Seal(plaintext, aad []byte) (*Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataKey, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.keys[k.activeID], dataKey, wrapAAD(k.activeID, aad))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{KeyID: k.activeID, DataKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+// Open decrypts an envelope sealed with any key in the keyring. aad must
+// match the value it was sealed with.
+func (k *Keyring) Open(env *Envelope, aad []byte) ([]byte, error) {
+	dataKey, err := k.unwrap(env, wrapAAD(env.KeyID, aad))
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, env.Ciphertext, aad)
+}
+
+// Rewrap wraps an envelope's data key with the active key, leaving the
+// ciphertext as is. aad must match the value it was sealed with.
+func (k *Keyring) Rewrap(env *Envelope, aad []byte) (*Envelope, error) {
+	dataKey, err := k.unwrap(env, wrapAAD(env.KeyID, aad))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.keys[k.activeID], dataKey, wrapAAD(k.activeID, aad))
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyID: k.activeID, DataKey: wrapped, Ciphertext: env.Ciphertext}, nil
+}
+
+func (k *Keyring) unwrap(env *Envelope, aad []byte) ([]byte, error) {
+	key, ok := k.keys[env.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownKey, env.KeyID)
+	}
+	dataKey, err := open(key, env.DataKey, aad)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+// wrapAAD is the additional data a data key is wrapped with: the master key
+// ID, then the value's own additional data. The ID is length prefixed so the
+// two can't be shifted into each other.
+func wrapAAD(keyID string, aad []byte) []byte {
+	data := make([]byte, 0, 4+len(keyID)+len(aad))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(keyID)))
+	data = append(data, keyID...)
+	return append(data, aad...)
+}
+
+// seal encrypts with AES-256-GCM, prefixing the random nonce
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var (
+	mu      sync.RWMutex
+	keyring *Keyring
+)
+
+// SetKeyring makes k the keyring used to seal and open stored credentials
+func SetKeyring(k *Keyring) {
+	mu.Lock()
+	defer mu.Unlock()
+	keyring = k
+}
+
+// GetKeyring returns the configured keyring
+func GetKeyring() (*Keyring, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if keyring == nil {
+		return nil, ErrNotConfigured
+	}
+	return keyring, nil
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	k, err := NewKeyring("k1", map[string][]byte{"k1": testKey(t)})
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	plaintext := []byte(`{"secret_key":"s3cret"}`)
+
+	env, err := k.Seal(plaintext, []byte("esp/1"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if env.KeyID != "k1" || bytes.Contains(env.Ciphertext, plaintext) {
+		t.Fatalf("envelope = %+v", env)
+	}
+	got, err := k.Open(env, []byte("esp/1"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Open = %s, want %s", got, plaintext)
+	}
+}
+
+func TestOpenRejectsOtherAAD(t *testing.T) {
+	k, _ := NewKeyring("k1", map[string][]byte{"k1": testKey(t)})
+	env, err := k.Seal([]byte("secret"), []byte("esp/1"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// The same envelope copied to another row
+	if _, err := k.Open(env, []byte("esp/2")); err == nil {
+		t.Error("Open with another row's AAD succeeded")
+	}
+
+	// A data key moved under another envelope's ciphertext
+	other, _ := k.Seal([]byte("other"), []byte("esp/2"))
+	swapped := &Envelope{KeyID: env.KeyID, DataKey: env.DataKey, Ciphertext: other.Ciphertext}
+	if _, err := k.Open(swapped, []byte("esp/2")); err == nil {
+		t.Error("Open with another envelope's data key succeeded")
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	old, _ := NewKeyring("old", map[string][]byte{"old": oldKey})
+	env, err := old.Seal([]byte("secret"), []byte("esp/1"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	rotated, _ := NewKeyring("new", map[string][]byte{"new": newKey, "old": oldKey})
+	if _, err := rotated.Rewrap(env, []byte("esp/2")); err == nil {
+		t.Error("Rewrap with another row's AAD succeeded")
+	}
+	rewrapped, err := rotated.Rewrap(env, []byte("esp/1"))
+	if err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	if rewrapped.KeyID != "new" || !bytes.Equal(rewrapped.Ciphertext, env.Ciphertext) {
+		t.Errorf("rewrapped = %+v", rewrapped)
+	}
+
+	// The old key is no longer needed
+	current, _ := NewKeyring("new", map[string][]byte{"new": newKey})
+	got, err := current.Open(rewrapped, []byte("esp/1"))
+	if err != nil || string(got) != "secret" {
+		t.Errorf("Open = %q, %v; want secret", got, err)
+	}
+	if _, err := current.Open(env, []byte("esp/1")); err == nil {
+		t.Error("Open under the removed key succeeded")
+	}
+
+	// A wrapped data key relabeled with another key ID doesn't unwrap
+	relabeled := &Envelope{KeyID: "old", DataKey: rewrapped.DataKey, Ciphertext: rewrapped.Ciphertext}
+	both, _ := NewKeyring("new", map[string][]byte{"new": newKey, "old": newKey})
+	if _, err := both.Open(relabeled, []byte("esp/1")); err == nil {
+		t.Error("Open of a relabeled data key succeeded")
+	}
+}
@@ -0,0 +1,174 @@
+package sending
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+var (
+	// ErrRateLimited means the ESP has used up its send rate for now
+	ErrRateLimited = errors.New("send rate limit reached")
+	// ErrCapReached means the ESP has sent its daily or monthly volume
+	ErrCapReached = errors.New("send volume cap reached")
+)
+
+// LimitError means no eligible ESP could take the message within its
+// limits. RetryAfter estimates when one can.
+type LimitError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v; retry after %s", e.Err, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// bucketKey identifies a token bucket; an empty domain is the ESP's own
+type bucketKey struct {
+	espID  int
+	domain string
+}
+
+type tokenBucket struct {
+	limit  models.SendLimit
+	tokens float64
+	last   time.Time
+}
+
+// size is the bucket's capacity, defaulting to one second's worth of tokens
+func (b *tokenBucket) size() float64 {
+	if b.limit.Burst > 0 {
+		return float64(b.limit.Burst)
+	}
+	return math.Max(1, math.Ceil(b.limit.RatePerSecond))
+}
+
+// refill adds the tokens earned since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.size(), b.tokens+now.Sub(b.last).Seconds()*b.limit.RatePerSecond)
+	b.last = now
+}
+
+// rateLimiter holds the in-memory token buckets of every ESP and sending
+// domain with a rate limit
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[bucketKey]*tokenBucket{}}
+}
+
+// bucket returns the bucket for key, starting it full and resetting it when
+// its limit has been changed
+func (l *rateLimiter) bucket(key bucketKey, limit models.SendLimit, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, last: now}
+		b.tokens = b.size()
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// take removes a token from the ESP's bucket and the sending domain's, if
+// they are rate limited. If either is empty nothing is taken, and it
+// returns how long until both have a token.
+func (l *rateLimiter) take(esp *models.ESP, domain string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := l.limited(esp, domain, now)
+	var wait time.Duration
+	for _, b := range buckets {
+		if b.tokens < 1 {
+			need := time.Duration((1 - b.tokens) / b.limit.RatePerSecond * float64(time.Second))
+			if need > wait {
+				wait = need
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// giveBack returns a token taken for a message that wasn't sent
+func (l *rateLimiter) giveBack(esp *models.ESP, domain string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, b := range l.limited(esp, domain, now) {
+		b.tokens = math.Min(b.size(), b.tokens+1)
+	}
+}
+
+// limited returns the buckets of the ESP and the sending domain that are rate
+// limited
+func (l *rateLimiter) limited(esp *models.ESP, domain string, now time.Time) []*tokenBucket {
+	var buckets []*tokenBucket
+	if esp.Limits.RatePerSecond > 0 {
+		buckets = append(buckets, l.bucket(bucketKey{esp.ESPID, ""}, esp.Limits.SendLimit, now))
+	}
+	if limit, ok := esp.Limits.ForDomain(domain); ok && limit.RatePerSecond > 0 {
+		buckets = append(buckets, l.bucket(bucketKey{esp.ESPID, strings.ToLower(domain)}, limit, now))
+	}
+	return buckets
+}
+
+// reserve claims room for one message within the ESP's rate limits and
+// volume caps for the sending domain, including the ceiling of a warm-up
+// schedule. It returns ErrRateLimited with the time until a token is
+// available, or ErrCapReached with the time until the next UTC day. The rate
+// limit token is given back when the caps turn the message away.
+func (s *Service) reserve(esp *models.ESP, domain string) (time.Duration, error) {
+	now := time.Now()
+	if ok, wait := s.limiter.take(esp, domain, now); !ok {
+		return wait, ErrRateLimited
+	}
+
+	wait, err := s.reserveUsage(esp, domain, now)
+	if err != nil {
+		s.limiter.giveBack(esp, domain, time.Now())
+	}
+	return wait, err
+}
+
+// reserveUsage counts the message against the ESP's volume caps
+func (s *Service) reserveUsage(esp *models.ESP, domain string, now time.Time) (time.Duration, error) {
+	warmups, err := models.GetWarmupsForDomain(s.db, esp.UserID, domain)
+	if err != nil {
+		return 0, fmt.Errorf("error loading warm-up schedules: %v", err)
+	}
+	capped := *esp
+	if w, ok := warmups[esp.ESPID]; ok {
+		capped.Limits = esp.Limits.WithDomainDailyCap(domain, w.Ceiling())
+	}
+
+	ok, err := models.ReserveSendUsage(s.db, &capped, domain, now)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return tomorrow.Sub(now), ErrCapReached
+	}
+	return 0, nil
+}
@@ -0,0 +1,65 @@
+package sending
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	esp := &models.ESP{ESPID: 1}
+	esp.Limits.SendLimit = models.SendLimit{RatePerSecond: 1, Burst: 2}
+	esp.Limits.Domains = map[string]models.SendLimit{"Example.org": {RatePerSecond: 0.5, Burst: 1}}
+
+	l := newRateLimiter()
+	now := time.Unix(1700000000, 0)
+
+	// Other domains only use the ESP's bucket
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(esp, "other.org", now); !ok {
+			t.Fatalf("take %d from a full bucket failed", i)
+		}
+	}
+	if ok, wait := l.take(esp, "other.org", now); ok || wait != time.Second {
+		t.Errorf("take from an empty bucket = %v, %s; want false, 1s", ok, wait)
+	}
+
+	// The domain's bucket is full but the ESP's is empty
+	if ok, _ := l.take(esp, "example.org", now); ok {
+		t.Error("take succeeded while the ESP's bucket was empty")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.take(esp, "example.org", now); !ok {
+		t.Error("take failed after the ESP's bucket refilled")
+	}
+	if ok, wait := l.take(esp, "example.org", now.Add(time.Second)); ok || wait != time.Second {
+		t.Errorf("take from the domain's empty bucket = %v, %s; want false, 1s", ok, wait)
+	}
+}
+
+func TestRateLimiterGiveBack(t *testing.T) {
+	esp := &models.ESP{ESPID: 1}
+	esp.Limits.SendLimit = models.SendLimit{RatePerSecond: 1, Burst: 1}
+	esp.Limits.Domains = map[string]models.SendLimit{"example.org": {RatePerSecond: 1, Burst: 1}}
+
+	l := newRateLimiter()
+	now := time.Unix(1700000000, 0)
+	if ok, _ := l.take(esp, "example.org", now); !ok {
+		t.Fatal("take from a full bucket failed")
+	}
+
+	// A message turned away by the volume caps doesn't use up the rate
+	l.giveBack(esp, "example.org", now)
+	if ok, _ := l.take(esp, "example.org", now); !ok {
+		t.Error("take failed after the token was given back")
+	}
+
+	// Giving back never fills a bucket past its size
+	l.giveBack(esp, "example.org", now)
+	l.giveBack(esp, "example.org", now)
+	l.take(esp, "example.org", now)
+	if ok, _ := l.take(esp, "example.org", now); ok {
+		t.Error("bucket held more than its burst")
+	}
+}
@@ -0,0 +1,360 @@
+// Package sending submits provider-neutral messages through the ESP chosen
+// by the router, using that provider's send API, and records which user and
+// ESP each message belongs to. Recipients on the user's suppression list are
+// dropped before routing.
+package sending
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/routing"
+)
+
+// ErrUnsupportedProvider means the chosen ESP's provider has no send API adapter
+var ErrUnsupportedProvider = errors.New("provider does not support sending")
+
+// errNoMessageID means the provider accepted a message without identifying it
+var errNoMessageID = errors.New("provider did not return a message ID")
+
+// Config controls how messages are submitted to providers
+type Config struct {
+	// Base URLs of provider send APIs by provider name, overriding the
+	// adapters' defaults, e.g. to point at local mock servers
+	Endpoints map[string]string
+	// Timeout of each provider API request
+	Timeout time.Duration
+	// Providers that messages received over SMTP are relayed to over SMTP,
+	// unchanged, instead of through their send API
+	SMTPUpstream map[string]bool
+	// SMTP addresses of providers by name, overriding the adapters' defaults
+	SMTPEndpoints map[string]string
+	// Number of ESPs a message is tried on before giving up
+	MaxAttempts int
+	// How long a send may wait for a rate limited ESP
+	MaxLimitWait time.Duration
+}
+
+// ConfigFromEnv reads PROVIDER_ENDPOINT_<PROVIDER> and
+// PROVIDER_SMTP_ENDPOINT_<PROVIDER> for each registered provider,
+// SMTP_UPSTREAM_PROVIDERS (comma separated), SEND_TIMEOUT_SECONDS (default
+// 30), SEND_MAX_ATTEMPTS (default 3) and SEND_LIMIT_MAX_WAIT_SECONDS
+// (default 10)
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Endpoints:     map[string]string{},
+		Timeout:       30 * time.Second,
+		SMTPUpstream:  map[string]bool{},
+		SMTPEndpoints: map[string]string{},
+		MaxAttempts:   3,
+		MaxLimitWait:  10 * time.Second,
+	}
+	for _, name := range providers.Names() {
+		if endpoint := os.Getenv("PROVIDER_ENDPOINT_" + strings.ToUpper(name)); endpoint != "" {
+			cfg.Endpoints[name] = endpoint
+		}
+		if endpoint := os.Getenv("PROVIDER_SMTP_ENDPOINT_" + strings.ToUpper(name)); endpoint != "" {
+			cfg.SMTPEndpoints[name] = endpoint
+		}
+	}
+	for _, name := range strings.Split(os.Getenv("SMTP_UPSTREAM_PROVIDERS"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			cfg.SMTPUpstream[name] = true
+		}
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("SEND_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		cfg.Timeout = time.Duration(seconds) * time.Second
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("SEND_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		cfg.MaxAttempts = attempts
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("SEND_LIMIT_MAX_WAIT_SECONDS")); err == nil && seconds >= 0 {
+		cfg.MaxLimitWait = time.Duration(seconds) * time.Second
+	}
+	return cfg
+}
+
+// Result identifies a sent message
+type Result struct {
+	MessageID string `json:"message_id"`
+	ESPID     int    `json:"esp_id"`
+	Provider  string `json:"provider"`
+	// Number of ESPs the message was submitted to, including failed ones
+	Attempts int `json:"attempts"`
+	// Recipients left out because they are on the user's suppression list
+	Suppressed []string `json:"suppressed,omitempty"`
+}
+
+// Service sends messages on behalf of users
+type Service struct {
+	db      *sql.DB
+	router  *routing.Router
+	client  *http.Client
+	limiter *rateLimiter
+	cfg     Config
+}
+
+func NewService(db *sql.DB, router *routing.Router, cfg Config) *Service {
+	return &Service{
+		db:      db,
+		router:  router,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		limiter: newRateLimiter(),
+		cfg:     cfg,
+	}
+}
+
+// Send routes the message to one of the user's ESPs by its From domain and
+// submits it through that provider. Suppressed recipients are left out.
+func (s *Service) Send(ctx context.Context, userID int, msg *providers.Message) (*Result, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	return s.send(ctx, userID, msg, nil)
+}
+
+// SendRaw sends a message received over SMTP. It is routed like Send; if the
+// chosen provider is configured for upstream SMTP, raw is relayed unchanged
+// to the message's recipients, otherwise msg goes through the send API.
+// Only the envelope is checked: relayed mail may have no subject or body.
+func (s *Service) SendRaw(ctx context.Context, userID int, msg *providers.Message, raw []byte) (*Result, error) {
+	if err := msg.ValidateEnvelope(); err != nil {
+		return nil, err
+	}
+	return s.send(ctx, userID, msg, raw)
+}
+
+// send drops the message's suppressed recipients before delivering it to
+// the rest
+func (s *Service) send(ctx context.Context, userID int, msg *providers.Message, raw []byte) (*Result, error) {
+	suppressed, err := s.dropSuppressed(userID, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.deliver(ctx, userID, msg, raw)
+	if err != nil {
+		return nil, err
+	}
+	result.Suppressed = suppressed
+	return result, nil
+}
+
+// deliver sends the message through the routed ESP. ESPs at their rate
+// limits or volume caps are passed over for the next one the router picks;
+// if all of them are rate limited, it waits up to MaxLimitWait for one to
+// free up. When the provider looks down, the failure is recorded on the
+// ESP's circuit breaker and the message is retried on the next ESP, up to
+// MaxAttempts ESPs.
+func (s *Service) deliver(ctx context.Context, userID int, msg *providers.Message, raw []byte) (*Result, error) {
+	breakers := s.router.Breakers()
+	domain := msg.From.Domain()
+
+	var tried, limited []int
+	var lastErr error
+	var limitErr *LimitError
+	var waited time.Duration
+	for attempts := 0; attempts < s.cfg.MaxAttempts; {
+		esp, err := s.route(userID, msg, append(append([]int(nil), tried...), limited...))
+		if err != nil {
+			if !errors.Is(err, routing.ErrNoESP) {
+				return nil, err
+			}
+			// Report why the last ESP failed rather than that none are left
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			if limitErr == nil {
+				return nil, err
+			}
+			if errors.Is(limitErr, ErrRateLimited) && waited+limitErr.RetryAfter <= s.cfg.MaxLimitWait {
+				if err := sleep(ctx, limitErr.RetryAfter); err != nil {
+					return nil, err
+				}
+				waited += limitErr.RetryAfter
+				limited, limitErr = nil, nil
+				continue
+			}
+			return nil, limitErr
+		}
+
+		// Another send may have taken the half-open probe since routing
+		permit, ok := breakers.Allow(esp.ESPID)
+		if !ok {
+			tried = append(tried, esp.ESPID)
+			continue
+		}
+
+		wait, err := s.reserve(esp, domain)
+		if err != nil {
+			breakers.Release(permit)
+			if !errors.Is(err, ErrRateLimited) && !errors.Is(err, ErrCapReached) {
+				return nil, err
+			}
+			limited = append(limited, esp.ESPID)
+			if limitErr == nil || wait < limitErr.RetryAfter {
+				limitErr = &LimitError{Err: err, RetryAfter: wait}
+			}
+			continue
+		}
+		tried = append(tried, esp.ESPID)
+		attempts++
+
+		result, err := s.attempt(ctx, esp, userID, msg, raw)
+		if err == nil {
+			breakers.Record(permit, nil)
+			result.Attempts = attempts
+			return result, nil
+		}
+
+		// The message wasn't sent, so it doesn't count against the caps
+		if err := models.ReleaseSendUsage(s.db, esp.ESPID, domain, time.Now()); err != nil {
+			log.Printf("Error releasing send usage of ESP %d: %v", esp.ESPID, err)
+		}
+		if ctx.Err() != nil || !providerFailure(err) {
+			// Not the provider's fault
+			breakers.Release(permit)
+			return nil, err
+		}
+
+		log.Printf("Send through ESP %d failed, trying another ESP: %v", esp.ESPID, err)
+		breakers.Record(permit, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// providerFailure reports whether a send error suggests the provider is
+// unavailable, so the ESP's breaker should count it and another ESP may
+// succeed. Errors caused by the message or the ESP's settings don't count.
+func providerFailure(err error) bool {
+	var sendErr *providers.SendError
+	var smtpErr *textproto.Error
+	switch {
+	case errors.Is(err, providers.ErrInvalidMessage), errors.Is(err, providers.ErrMissingCredentials),
+		errors.Is(err, ErrUnsupportedProvider), errors.Is(err, errNoMessageID):
+		return false
+	case errors.As(err, &sendErr):
+		return sendErr.Temporary()
+	case errors.As(err, &smtpErr):
+		return smtpErr.Code < 500
+	}
+	// Timeouts and connection errors
+	return true
+}
+
+// attempt sends the message through one ESP
+func (s *Service) attempt(ctx context.Context, esp *models.ESP, userID int, msg *providers.Message, raw []byte) (*Result, error) {
+	adapter, ok := providers.Get(esp.ProviderName)
+	if raw != nil && ok && s.cfg.SMTPUpstream[adapter.Name()] {
+		if relayer, ok := adapter.(providers.SMTPRelayer); ok {
+			return s.relayVia(ctx, esp, relayer, userID, msg, raw)
+		}
+	}
+	return s.sendVia(ctx, esp, userID, msg)
+}
+
+// relayVia relays a raw message to the provider's SMTP service
+func (s *Service) relayVia(ctx context.Context, esp *models.ESP, relayer providers.SMTPRelayer, userID int, msg *providers.Message, raw []byte) (*Result, error) {
+	provider := strings.ToLower(esp.ProviderName)
+	addr, username, password, err := relayer.SMTPRelay(esp.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint, ok := s.cfg.SMTPEndpoints[provider]; ok {
+		addr = endpoint
+	}
+
+	recipients := msg.Recipients()
+	to := make([]string, len(recipients))
+	for i, a := range recipients {
+		to[i] = a.Email
+	}
+	messageID, err := relaySMTP(ctx, addr, username, password, msg.From.Email, to, raw, s.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s SMTP relay failed: %w", provider, err)
+	}
+	if messageID == "" {
+		log.Printf("%s SMTP relay for ESP %d returned no queue ID; message not associated", provider, esp.ESPID)
+	} else if err := models.AssociateMessage(s.db, messageID, userID, esp.ESPID); err != nil {
+		log.Printf("Error associating message %s with ESP %d: %v", messageID, esp.ESPID, err)
+	}
+
+	return &Result{MessageID: messageID, ESPID: esp.ESPID, Provider: provider}, nil
+}
+
+// route picks one of the user's ESPs for the message, other than the ones
+// already tried, and loads it with its credentials
+func (s *Service) route(userID int, msg *providers.Message, tried []int) (*models.ESP, error) {
+	req := routing.Request{UserID: userID, SenderDomain: msg.From.Domain(), Exclude: tried}
+	if recipients := msg.Recipients(); len(recipients) > 0 {
+		req.RecipientDomain = recipients[0].Domain()
+	}
+	selected, err := s.router.Select(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The router only loads ESP settings; credentials are read separately
+	esp, err := models.GetESPByID(s.db, selected.ESPID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ESP %d: %v", selected.ESPID, err)
+	}
+	return esp, nil
+}
+
+// sendVia submits the message through one ESP and records the association
+func (s *Service) sendVia(ctx context.Context, esp *models.ESP, userID int, msg *providers.Message) (*Result, error) {
+	adapter, ok := providers.Get(esp.ProviderName)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, esp.ProviderName)
+	}
+	sender, ok := adapter.(providers.Sender)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, adapter.Name())
+	}
+
+	endpoint, ok := s.cfg.Endpoints[adapter.Name()]
+	if !ok {
+		endpoint = sender.DefaultEndpoint(esp.Credentials)
+	}
+
+	messageID, err := sender.Send(ctx, s.client, endpoint, esp.Credentials, msg)
+	if err != nil {
+		return nil, err
+	}
+	if messageID == "" {
+		return nil, fmt.Errorf("%w: %s", errNoMessageID, adapter.Name())
+	}
+
+	// The provider has accepted the message, so a failure here only loses
+	// attribution; report the send as successful either way
+	if err := models.AssociateMessage(s.db, messageID, userID, esp.ESPID); err != nil {
+		log.Printf("Error associating message %s with ESP %d: %v", messageID, esp.ESPID, err)
+	}
+
+	return &Result{MessageID: messageID, ESPID: esp.ESPID, Provider: adapter.Name()}, nil
+}
@@ -0,0 +1,62 @@
+package sending
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+)
+
+// ErrSuppressed means every recipient of a message is on the user's
+// suppression list
+var ErrSuppressed = errors.New("all recipients are suppressed")
+
+// Suppression returns the user's unexpired suppression entry covering an
+// address, or nil if it may be sent to
+func (s *Service) Suppression(userID int, address string) (*models.Suppression, error) {
+	found, err := models.FindSuppressions(s.db, userID, []string{address})
+	if err != nil {
+		return nil, err
+	}
+	return found[strings.ToLower(address)], nil
+}
+
+// dropSuppressed removes the message's suppressed recipients and returns
+// their addresses. It returns ErrSuppressed if none are left.
+func (s *Service) dropSuppressed(userID int, msg *providers.Message) ([]string, error) {
+	recipients := msg.Recipients()
+	addresses := make([]string, len(recipients))
+	for i, a := range recipients {
+		addresses[i] = a.Email
+	}
+	found, err := models.FindSuppressions(s.db, userID, addresses)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	var suppressed []string
+	keep := func(addrs []providers.Address) []providers.Address {
+		var kept []providers.Address
+		for _, a := range addrs {
+			if _, ok := found[strings.ToLower(a.Email)]; ok {
+				suppressed = append(suppressed, a.Email)
+				continue
+			}
+			kept = append(kept, a)
+		}
+		return kept
+	}
+	msg.To = keep(msg.To)
+	msg.CC = keep(msg.CC)
+	msg.BCC = keep(msg.BCC)
+
+	if len(msg.Recipients()) == 0 {
+		return suppressed, fmt.Errorf("%w: %s", ErrSuppressed, strings.Join(suppressed, ", "))
+	}
+	return suppressed, nil
+}
@@ -0,0 +1,91 @@
+package sending
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// relaySMTP submits a raw message to an upstream SMTP server and returns the
+// queue ID from its reply to DATA, e.g. "250 Ok: queued as <id>", if any
+func relaySMTP(ctx context.Context, addr, username, password, from string, to []string, raw []byte, timeout time.Duration) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid SMTP address %q: %v", addr, err)
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return "", err
+		}
+	}
+	// PlainAuth refuses to send the password unencrypted except to localhost
+	if err := c.Auth(smtp.PlainAuth("", username, password, host)); err != nil {
+		return "", err
+	}
+	if err := c.Mail(from); err != nil {
+		return "", err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return "", err
+		}
+	}
+
+	// smtp.Client.Data discards the final reply, which carries the queue ID
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	w := c.Text.DotWriter()
+	if _, err := w.Write(raw); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	_, reply, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	c.Quit()
+
+	return queueID(reply), nil
+}
+
+// queueID extracts the ID from a "queued as <id>" reply
+func queueID(reply string) string {
+	i := strings.Index(strings.ToLower(reply), "queued as ")
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(reply[i+len("queued as "):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], "<>")
+}
@@ -0,0 +1,169 @@
+// Package smtpd is an SMTP submission server for apps that can't use the
+// HTTP send API. Clients authenticate with their username and API key, and
+// each accepted message is routed and sent exactly like POST /api/v1/messages.
+package smtpd
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nzenitram/relay-esp/sending"
+)
+
+// Config controls the SMTP listener
+type Config struct {
+	// Listen address, e.g. ":2525". The server is disabled when empty.
+	Addr string
+	// Name used in the greeting and EHLO reply
+	Hostname string
+	// Offered through STARTTLS when set
+	TLS *tls.Config
+	// Allow AUTH on connections that haven't started TLS
+	AllowInsecureAuth bool
+	MaxMessageBytes   int
+	MaxRecipients     int
+	// How long a connection may sit idle between commands
+	Timeout time.Duration
+}
+
+// ConfigFromEnv reads the SMTP_* environment variables. STARTTLS is offered
+// when SMTP_TLS_CERT_FILE and SMTP_TLS_KEY_FILE are both set.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Addr:              os.Getenv("SMTP_ADDR"),
+		Hostname:          os.Getenv("SMTP_HOSTNAME"),
+		AllowInsecureAuth: os.Getenv("SMTP_ALLOW_INSECURE_AUTH") == "true",
+		MaxMessageBytes:   envInt("SMTP_MAX_MESSAGE_BYTES", 25<<20),
+		MaxRecipients:     envInt("SMTP_MAX_RECIPIENTS", 100),
+		Timeout:           time.Duration(envInt("SMTP_TIMEOUT_SECONDS", 300)) * time.Second,
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+
+	certFile, keyFile := os.Getenv("SMTP_TLS_CERT_FILE"), os.Getenv("SMTP_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("error loading SMTP TLS certificate: %v", err)
+		}
+		cfg.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	return cfg, nil
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Server accepts SMTP connections
+type Server struct {
+	db     *sql.DB
+	sender *sending.Service
+	cfg    Config
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(db *sql.DB, sender *sending.Service, cfg Config) *Server {
+	return &Server{db: db, sender: sender, cfg: cfg, conns: map[net.Conn]bool{}}
+}
+
+// ListenAndServe accepts connections until Close is called
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Printf("Error accepting SMTP connection: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			newSession(s, conn).serve()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, waits up to timeout for sessions in
+// progress to finish and then drops the rest
+func (s *Server) Close(timeout time.Duration) {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+}
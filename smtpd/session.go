@@ -0,0 +1,491 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+	"github.com/nzenitram/relay-esp/providers"
+	"github.com/nzenitram/relay-esp/routing"
+	"github.com/nzenitram/relay-esp/sending"
+)
+
+// errAuthCancelled means the client answered a challenge with "*"
+var errAuthCancelled = errors.New("authentication cancelled")
+
+// session is one client connection
+type session struct {
+	srv  *Server
+	conn net.Conn
+	text *textproto.Conn
+
+	tls  bool
+	helo string
+	user *models.User
+
+	// The current mail transaction
+	from  string
+	rcpts []string
+}
+
+func newSession(srv *Server, conn net.Conn) *session {
+	return &session{srv: srv, conn: conn, text: textproto.NewConn(conn)}
+}
+
+func (s *session) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *session) reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+// serve runs the command loop until the client quits or the connection fails
+func (s *session) serve() {
+	// s.conn is replaced by STARTTLS
+	defer func() {
+		s.conn.Close()
+	}()
+
+	s.conn.SetDeadline(time.Now().Add(s.srv.cfg.Timeout))
+	s.reply(220, "%s ESMTP relay-esp ready", s.srv.cfg.Hostname)
+
+	for {
+		s.conn.SetDeadline(time.Now().Add(s.srv.cfg.Timeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.handleHelo(arg, false)
+		case "EHLO":
+			s.handleHelo(arg, true)
+		case "STARTTLS":
+			s.handleStartTLS()
+		case "AUTH":
+			s.handleAuth(arg)
+		case "MAIL":
+			s.handleMail(arg)
+		case "RCPT":
+			s.handleRcpt(arg)
+		case "DATA":
+			s.handleData()
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			s.reply(252, "2.5.0 Cannot verify user")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.reply(500, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (s *session) handleHelo(arg string, extended bool) {
+	if arg == "" {
+		s.reply(501, "5.5.4 Domain required")
+		return
+	}
+	s.helo = arg
+	s.reset()
+
+	if !extended {
+		s.reply(250, "%s", s.srv.cfg.Hostname)
+		return
+	}
+
+	lines := []string{
+		s.srv.cfg.Hostname,
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+		"SIZE " + strconv.Itoa(s.srv.cfg.MaxMessageBytes),
+	}
+	if s.srv.cfg.TLS != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.tls || s.srv.cfg.AllowInsecureAuth {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		s.text.PrintfLine("250%s%s", sep, line)
+	}
+}
+
+func (s *session) handleStartTLS() {
+	if s.srv.cfg.TLS == nil {
+		s.reply(502, "5.5.1 STARTTLS not supported")
+		return
+	}
+	if s.tls {
+		s.reply(503, "5.5.1 TLS already active")
+		return
+	}
+	s.reply(220, "2.0.0 Ready to start TLS")
+
+	tlsConn := tls.Server(s.conn, s.srv.cfg.TLS)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("SMTP TLS handshake with %s failed: %v", s.conn.RemoteAddr(), err)
+		s.conn.Close()
+		return
+	}
+
+	// The client starts over after STARTTLS (RFC 3207)
+	s.conn = tlsConn
+	s.text = textproto.NewConn(tlsConn)
+	s.tls = true
+	s.helo = ""
+	s.user = nil
+	s.reset()
+}
+
+func (s *session) handleAuth(arg string) {
+	if s.helo == "" {
+		s.reply(503, "5.5.1 Send EHLO first")
+		return
+	}
+	if s.user != nil {
+		s.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+	if !s.tls && !s.srv.cfg.AllowInsecureAuth {
+		s.reply(538, "5.7.11 Encryption required for authentication")
+		return
+	}
+
+	mechanism, initial := arg, ""
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		mechanism, initial = arg[:i], strings.TrimSpace(arg[i+1:])
+	}
+
+	var username, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		username, password, err = s.authPlain(initial)
+	case "LOGIN":
+		username, password, err = s.authLogin(initial)
+	default:
+		s.reply(504, "5.5.4 Unrecognized authentication mechanism")
+		return
+	}
+	if err == errAuthCancelled {
+		s.reply(501, "5.0.0 Authentication cancelled")
+		return
+	}
+	if err != nil {
+		s.reply(501, "5.5.2 %v", err)
+		return
+	}
+
+	user, err := s.authenticate(username, password)
+	if err != nil {
+		log.Printf("Error authenticating SMTP user %q: %v", username, err)
+		s.reply(454, "4.7.0 Temporary authentication failure")
+		return
+	}
+	if user == nil {
+		s.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.user = user
+	s.reply(235, "2.7.0 Authentication successful")
+}
+
+// authPlain reads an RFC 4616 "authzid\0authcid\0password" response
+func (s *session) authPlain(initial string) (string, string, error) {
+	response, err := s.challenge("", initial)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(response), "\x00")
+	if len(parts) != 3 {
+		return "", "", errors.New("invalid PLAIN response")
+	}
+	return parts[1], parts[2], nil
+}
+
+// authLogin prompts for the username and password in turn
+func (s *session) authLogin(initial string) (string, string, error) {
+	username, err := s.challenge("Username:", initial)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := s.challenge("Password:", "")
+	if err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
+// challenge sends a 334 prompt, unless the client already sent its response
+// with the AUTH command, and decodes the base64 answer
+func (s *session) challenge(prompt, initial string) ([]byte, error) {
+	response := initial
+	if response == "" {
+		s.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		response = strings.TrimSpace(line)
+	}
+	if response == "*" {
+		return nil, errAuthCancelled
+	}
+	if response == "=" {
+		return []byte{}, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return nil, errors.New("invalid base64 response")
+	}
+	return decoded, nil
+}
+
+// authenticate looks up the user by API key, which is the SMTP password. The
+// username must be the user's username or email. It returns nil if the
+// credentials don't match.
+func (s *session) authenticate(username, password string) (*models.User, error) {
+	if username == "" || password == "" {
+		return nil, nil
+	}
+
+	user, err := models.GetUserByAPIKey(s.srv.db, password)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(username, user.Username) && !strings.EqualFold(username, user.Email) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func (s *session) handleMail(arg string) {
+	if s.user == nil {
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	}
+	if s.from != "" {
+		s.reply(503, "5.5.1 Nested MAIL command")
+		return
+	}
+
+	path, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range params {
+		if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			size, err := strconv.Atoi(param[len("SIZE="):])
+			if err == nil && size > s.srv.cfg.MaxMessageBytes {
+				s.reply(552, "5.3.4 Message too big")
+				return
+			}
+		}
+	}
+
+	// A null reverse-path is only used for bounces, which we don't relay
+	if path == "" {
+		s.reply(550, "5.1.7 Sender address required")
+		return
+	}
+	s.from = path
+	s.reply(250, "2.1.0 OK")
+}
+
+func (s *session) handleRcpt(arg string) {
+	if s.from == "" {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(s.rcpts) >= s.srv.cfg.MaxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	path, _, ok := parsePath(arg, "TO:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if _, err := mail.ParseAddress(path); err != nil {
+		s.reply(553, "5.1.3 Invalid recipient address")
+		return
+	}
+
+	// Refuse suppressed recipients up front so the client knows which ones
+	// won't be delivered
+	suppression, err := s.srv.sender.Suppression(s.user.ID, path)
+	if err != nil {
+		log.Printf("Error checking suppressions for user %d: %v", s.user.ID, err)
+		s.reply(451, "4.3.0 Temporary failure checking recipient")
+		return
+	}
+	if suppression != nil {
+		s.reply(550, "5.7.1 Recipient is suppressed (%s)", suppression.Reason)
+		return
+	}
+	s.rcpts = append(s.rcpts, path)
+	s.reply(250, "2.1.5 OK")
+}
+
+func (s *session) handleData() {
+	if len(s.rcpts) == 0 {
+		s.reply(503, "5.5.1 Send RCPT first")
+		return
+	}
+	s.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	dot := s.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dot, int64(s.srv.cfg.MaxMessageBytes)+1))
+	if err != nil {
+		s.conn.Close()
+		return
+	}
+	defer s.reset()
+
+	if len(raw) > s.srv.cfg.MaxMessageBytes {
+		if _, err := io.Copy(io.Discard, dot); err != nil {
+			s.conn.Close()
+			return
+		}
+		s.reply(552, "5.3.4 Message too big")
+		return
+	}
+
+	s.deliver(raw)
+}
+
+// deliver parses the message and sends it through the user's ESPs
+func (s *session) deliver(raw []byte) {
+	msg, err := providers.ParseMIME(raw)
+	if err != nil {
+		s.reply(554, "5.6.0 %v", err)
+		return
+	}
+	applyEnvelope(msg, s.rcpts)
+
+	result, err := s.srv.sender.SendRaw(context.Background(), s.user.ID, msg, raw)
+	if err != nil {
+		code, status := sendStatus(err)
+		if code == 451 {
+			log.Printf("Error relaying SMTP message for user %d: %v", s.user.ID, err)
+		}
+		// Provider error bodies may span lines
+		s.reply(code, "%s %s", status, strings.Join(strings.Fields(err.Error()), " "))
+		return
+	}
+	if result.MessageID == "" {
+		s.reply(250, "2.0.0 OK")
+		return
+	}
+	s.reply(250, "2.0.0 OK queued as %s", result.MessageID)
+}
+
+// sendStatus maps a send error onto an SMTP reply code and enhanced status
+func sendStatus(err error) (int, string) {
+	var sendErr *providers.SendError
+	var smtpErr *textproto.Error
+	var limitErr *sending.LimitError
+	switch {
+	case errors.Is(err, providers.ErrInvalidMessage):
+		return 554, "5.6.0"
+	case errors.Is(err, routing.ErrNoESP), errors.Is(err, sending.ErrSuppressed):
+		return 550, "5.7.1"
+	case errors.Is(err, sending.ErrUnsupportedProvider), errors.Is(err, providers.ErrMissingCredentials):
+		return 554, "5.3.5"
+	case errors.As(err, &limitErr):
+		return 451, "4.7.1"
+	case errors.As(err, &sendErr) && !sendErr.Temporary():
+		return 554, "5.3.0"
+	case errors.As(err, &smtpErr) && smtpErr.Code >= 500:
+		return 554, "5.3.0"
+	}
+	return 451, "4.3.0"
+}
+
+// applyEnvelope makes the envelope recipients authoritative: header To and
+// Cc addresses that weren't RCPT'd are dropped, and RCPT'd addresses missing
+// from the headers are sent as BCC
+func applyEnvelope(msg *providers.Message, rcpts []string) {
+	envelope := map[string]bool{}
+	for _, rcpt := range rcpts {
+		envelope[strings.ToLower(rcpt)] = true
+	}
+
+	seen := map[string]bool{}
+	keep := func(addrs []providers.Address) []providers.Address {
+		var kept []providers.Address
+		for _, a := range addrs {
+			email := strings.ToLower(a.Email)
+			if envelope[email] && !seen[email] {
+				seen[email] = true
+				kept = append(kept, a)
+			}
+		}
+		return kept
+	}
+	msg.To = keep(msg.To)
+	msg.CC = keep(msg.CC)
+
+	msg.BCC = nil
+	for _, rcpt := range rcpts {
+		email := strings.ToLower(rcpt)
+		if !seen[email] {
+			seen[email] = true
+			msg.BCC = append(msg.BCC, providers.Address{Email: rcpt})
+		}
+	}
+}
+
+// parsePath parses "FROM:<address> PARAM=value ..." and returns the address
+// and parameters
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidPatch means a merge patch wasn't a JSON object
+var ErrInvalidPatch = errors.New("merge patch must be a JSON object")
+
+// MergePatch applies a JSON Merge Patch (RFC 7386) to a JSON object: patch
+// members replace the document's, null members remove them, and nested
+// objects are merged recursively.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target map[string]interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	patchObject, ok := p.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidPatch
+	}
+
+	return json.Marshal(mergePatch(target, patchObject))
+}
+
+func mergePatch(target interface{}, patch map[string]interface{}) map[string]interface{} {
+	targetObject, ok := target.(map[string]interface{})
+	if !ok || targetObject == nil {
+		targetObject = map[string]interface{}{}
+	}
+
+	for name, value := range patch {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		if valueObject, ok := value.(map[string]interface{}); ok {
+			targetObject[name] = mergePatch(targetObject[name], valueObject)
+			continue
+		}
+		targetObject[name] = value
+	}
+	return targetObject
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"replace member", `{"a":"b","c":"d"}`, `{"a":"z"}`, `{"a":"z","c":"d"}`},
+		{"add member", `{"a":"b"}`, `{"c":1}`, `{"a":"b","c":1}`},
+		{"null removes member", `{"a":"b","c":"d"}`, `{"a":null}`, `{"c":"d"}`},
+		{"null for missing member", `{"a":"b"}`, `{"x":null}`, `{"a":"b"}`},
+		{"nested objects merge", `{"a":{"b":1,"c":2}}`, `{"a":{"c":3,"d":4}}`, `{"a":{"b":1,"c":3,"d":4}}`},
+		{"null removes nested member", `{"a":{"b":1,"c":2}}`, `{"a":{"b":null}}`, `{"a":{"c":2}}`},
+		{"object replaces scalar", `{"a":"b"}`, `{"a":{"c":null,"d":1}}`, `{"a":{"d":1}}`},
+		{"scalar replaces object", `{"a":{"b":1}}`, `{"a":2}`, `{"a":2}`},
+		{"arrays are replaced whole", `{"a":[1,2,3]}`, `{"a":[4]}`, `{"a":[4]}`},
+		{"empty patch", `{"a":"b"}`, `{}`, `{"a":"b"}`},
+		{"null document", `null`, `{"a":"b"}`, `{"a":"b"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePatchRejectsNonObjectPatch(t *testing.T) {
+	for _, patch := range []string{`[1]`, `"a"`, `null`, `3`} {
+		if _, err := MergePatch([]byte(`{"a":"b"}`), []byte(patch)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("MergePatch with patch %s: err = %v, want ErrInvalidPatch", patch, err)
+		}
+	}
+}
+
+func TestMergePatchInvalidJSON(t *testing.T) {
+	if _, err := MergePatch([]byte(`{"a":`), []byte(`{}`)); err == nil {
+		t.Error("invalid document accepted")
+	}
+	if _, err := MergePatch([]byte(`{}`), []byte(`{"a":`)); err == nil {
+		t.Error("invalid patch accepted")
+	}
+}
@@ -0,0 +1,149 @@
+// Package warmup advances warm-up schedules one day at a time and pauses
+// them when the ESP's bounce or complaint rate goes over the schedule's
+// thresholds. Routing and sending enforce each schedule's daily ceiling.
+package warmup
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+// Config controls how often schedules are checked and how rates are measured
+type Config struct {
+	Interval time.Duration
+	// How far back bounce and complaint rates are measured
+	Lookback time.Duration
+	// Messages an ESP needs in the lookback window before its rates can
+	// pause a schedule
+	MinSample int
+}
+
+// ConfigFromEnv reads the WARMUP_* environment variables, falling back to
+// defaults for any that are unset or invalid
+func ConfigFromEnv() Config {
+	return Config{
+		Interval:  time.Duration(envInt("WARMUP_INTERVAL_MINUTES", 60)) * time.Minute,
+		Lookback:  time.Duration(envInt("WARMUP_LOOKBACK_HOURS", 24)) * time.Hour,
+		MinSample: envInt("WARMUP_MIN_SAMPLE", 50),
+	}
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Controller checks schedules on a timer
+type Controller struct {
+	db  *sql.DB
+	cfg Config
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewController(db *sql.DB, cfg Config) *Controller {
+	return &Controller{db: db, cfg: cfg, done: make(chan struct{})}
+}
+
+// Start checks schedules now and then every Interval until Stop is called
+func (c *Controller) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if err := c.RunOnce(); err != nil {
+				log.Printf("Error checking warm-up schedules: %v", err)
+			}
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for the current run to finish and stops the controller
+func (c *Controller) Stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// RunOnce pauses active schedules whose ESP is over a threshold and moves
+// the others on to the next day once a UTC day has passed
+func (c *Controller) RunOnce() error {
+	warmups, err := models.GetUnfinishedWarmups(c.db)
+	if err != nil {
+		return fmt.Errorf("error loading warm-up schedules: %v", err)
+	}
+
+	end := time.Now()
+	today := time.Date(end.UTC().Year(), end.UTC().Month(), end.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	stats := map[int]map[int]models.EventStats{}
+	for _, w := range warmups {
+		if w.Status != models.WarmupActive {
+			continue
+		}
+
+		userStats, ok := stats[w.UserID]
+		if !ok {
+			userStats, err = models.GetESPEventStats(c.db, w.UserID, end.Add(-c.cfg.Lookback), end)
+			if err != nil {
+				log.Printf("Error loading event stats for user %d: %v", w.UserID, err)
+				continue
+			}
+			stats[w.UserID] = userStats
+		}
+
+		if reason := c.pauseReason(w, userStats[w.ESPID]); reason != "" {
+			w.Pause(reason)
+			log.Printf("Paused warm-up %d of ESP %d for %s: %s", w.ID, w.ESPID, w.SendingDomain, reason)
+		} else if today.After(w.DayStartedOn) {
+			w.Day++
+			w.DayStartedOn = today
+			if w.Day >= w.Days() {
+				w.Day = w.Days() - 1
+				w.Status = models.WarmupCompleted
+			}
+		} else {
+			continue
+		}
+
+		if err := models.UpdateWarmupProgress(c.db, w); err != nil {
+			log.Printf("Error updating warm-up %d: %v", w.ID, err)
+		}
+	}
+	return nil
+}
+
+// pauseReason explains why the schedule should pause, or returns "" if the
+// ESP's rates are within its thresholds
+func (c *Controller) pauseReason(w *models.Warmup, s models.EventStats) string {
+	if s.TotalEvents < c.cfg.MinSample {
+		return ""
+	}
+
+	bounceRate := float64(s.BounceCount) / float64(s.TotalEvents)
+	if bounceRate > w.MaxBounceRate {
+		return fmt.Sprintf("bounce rate %.2f%% above %.2f%%", bounceRate*100, w.MaxBounceRate*100)
+	}
+	complaintRate := float64(s.SpamReportCount) / float64(s.TotalEvents)
+	if complaintRate > w.MaxComplaintRate {
+		return fmt.Sprintf("complaint rate %.3f%% above %.3f%%", complaintRate*100, w.MaxComplaintRate*100)
+	}
+	return ""
+}
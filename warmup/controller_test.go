@@ -0,0 +1,33 @@
+package warmup
+
+import (
+	"testing"
+
+	"github.com/nzenitram/relay-esp/models"
+)
+
+func TestPauseReason(t *testing.T) {
+	c := NewController(nil, Config{MinSample: 100})
+	w := &models.Warmup{MaxBounceRate: 0.05, MaxComplaintRate: 0.001}
+
+	tests := []struct {
+		name  string
+		stats models.EventStats
+		pause bool
+	}{
+		{"within thresholds", models.EventStats{TotalEvents: 1000, BounceCount: 50, SpamReportCount: 1}, false},
+		{"bounce rate over", models.EventStats{TotalEvents: 1000, BounceCount: 51}, true},
+		{"complaint rate over", models.EventStats{TotalEvents: 1000, SpamReportCount: 2}, true},
+		{"sample too small", models.EventStats{TotalEvents: 99, BounceCount: 99}, false},
+		{"no events", models.EventStats{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := c.pauseReason(w, tt.stats)
+			if (reason != "") != tt.pause {
+				t.Errorf("pauseReason() = %q, want pause %v", reason, tt.pause)
+			}
+		})
+	}
+}